@@ -3,15 +3,22 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
-	nestedLogrusFormatter "github.com/antonfisher/nested-logrus-formatter"
+	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/sirupsen/logrus"
 
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/audit"
 	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
 	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/driver"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/logger"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/metrics"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/preflight"
 )
 
 const (
@@ -23,6 +30,11 @@ func main() {
 	var (
 		configFile = flag.String("config", defaultConfigFile, "plugin config file")
 		version    = flag.Bool("version", false, "print plugin version")
+		validate   = flag.Bool("validate", false, "check config against NexentaStor appliance(s), print report and exit")
+		resize     = flag.String("resize", "", "resize volume by name to -size and exit, volume may be in use")
+		size       = flag.String("size", "", "new volume size for -resize: bytes or number with K, M, G, T, P unit")
+		shrink     = flag.Bool("allow-shrink", false, "allow -resize to make volume smaller (never below used space)")
+		auditFile  = flag.String("audit-log", getResizeAuditLogFile(), "audit log file to write -resize event to")
 	)
 
 	flag.Parse()
@@ -32,8 +44,20 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *validate {
+		os.Exit(runValidate(*configFile))
+	}
+
+	if *resize != "" {
+		os.Exit(runResize(*configFile, *auditFile, *resize, *size, *shrink))
+	}
+
 	// init logger
-	l := initLogger()
+	lg := logger.New(logrus.Fields{
+		"driver": fmt.Sprintf("%s@%s", config.Name, config.Version),
+		"cmp":    "Main",
+	}, config.LogFile)
+	l := lg.Entry()
 
 	l.Infof("%s@%s-%s (%s) started...", config.Name, config.Version, config.Commit, config.DateTime)
 	l.Info("run plugin with CLI options:")
@@ -45,61 +69,241 @@ func main() {
 		l.Fatalf("Cannot use config file: %s", err)
 	}
 
-	// logger level
-	if cfg.Debug {
-		l.Logger.SetLevel(logrus.DebugLevel)
-	} else {
-		l.Logger.SetLevel(logrus.InfoLevel)
+	lg.Configure(cfg)
+
+	if !cfg.FileExists() {
+		l.Warnf("config file '%s' not found, use plugin settings only", *configFile)
 	}
 
-	l.Info("config file options:")
-	l.Infof("- NexentaStor address(es): %s", cfg.Address)
-	l.Infof("- NexentaStor username: %s", cfg.Username)
-	l.Infof("- default dataset: %s", cfg.DefaultDataset)
-	l.Infof("- default data IP: %s", cfg.DefaultDataIP)
-	l.Infof("- default mount options: %s", cfg.DefaultMountOptions)
-	l.Infof("- debug: %t", cfg.Debug)
+	l.Info("config options (source: default/file/env):")
+	l.Infof("- NexentaStor address(es): %s [%s]", cfg.Address, cfg.GetSource("restIp"))
+	l.Infof("- NexentaStor username: %s [%s]", cfg.Username, cfg.GetSource("username"))
+	l.Infof("- NexentaStor password: *** [%s]", cfg.GetSource("password"))
+	l.Infof("- default dataset: %s [%s]", cfg.DefaultDataset, cfg.GetSource("defaultDataset"))
+	l.Infof("- default data IP: %s [%s]", cfg.DefaultDataIP, cfg.GetSource("defaultDataIp"))
+	l.Infof("- default mount options: %s [%s]", cfg.DefaultMountOptions, cfg.GetSource("defaultMountOptions"))
+	l.Infof("- debug: %t [%s]", cfg.Debug, cfg.GetSource("debug"))
+	l.Infof("- metrics address: %s [%s]", cfg.MetricsAddress, cfg.GetSource("metricsAddress"))
+	l.Infof("- reconcile dry run: %t [%s]", cfg.ReconcileDryRun, cfg.GetSource("reconcileDryRun"))
+	l.Infof("- health check interval: %ds [%s]", cfg.HealthCheckInterval, cfg.GetSource("healthCheckInterval"))
+	l.Infof("- health check timeout: %ds [%s]", cfg.HealthCheckTimeout, cfg.GetSource("healthCheckTimeout"))
+	l.Infof("- mount timeout: %ds [%s]", cfg.MountTimeout, cfg.GetSource("mountTimeout"))
+	l.Infof("- unmount timeout: %ds [%s]", cfg.UnmountTimeout, cfg.GetSource("unmountTimeout"))
+	l.Infof("- shutdown timeout: %ds [%s]", cfg.ShutdownTimeout, cfg.GetSource("shutdownTimeout"))
+	l.Infof("- unmount on shutdown: %t [%s]", cfg.UnmountOnShutdown, cfg.GetSource("unmountOnShutdown"))
+	l.Infof("- list cache TTL: %ds [%s]", cfg.ListCacheTTL, cfg.GetSource("listCacheTtl"))
+	l.Infof("- list refresh interval: %ds [%s]", cfg.ListRefreshInterval, cfg.GetSource("listRefreshInterval"))
+	l.Infof("- managed volumes only: %t [%s]", cfg.ManagedVolumesOnly, cfg.GetSource("managedVolumesOnly"))
+	l.Infof("- adoptable roots: '%s' [%s]", cfg.AdoptableRoots, cfg.GetSource("adoptableRoots"))
+	l.Infof("- REST timeout: %ds [%s]", cfg.RestTimeout, cfg.GetSource("restTimeout"))
+	l.Infof("- job timeout: %ds [%s]", cfg.JobTimeout, cfg.GetSource("jobTimeout"))
+	l.Infof("- request timeout: %ds [%s]", cfg.RequestTimeout, cfg.GetSource("requestTimeout"))
+	l.Infof(
+		"- retries: %d attempts, delay %d..%dms, jitter %d%% [%s, %s, %s, %s]",
+		cfg.RetryAttempts,
+		cfg.RetryDelay,
+		cfg.RetryMaxDelay,
+		cfg.RetryJitter,
+		cfg.GetSource("retryAttempts"),
+		cfg.GetSource("retryDelay"),
+		cfg.GetSource("retryMaxDelay"),
+		cfg.GetSource("retryJitter"),
+	)
+	l.Infof("- log format: %s [%s]", cfg.LogFormat, cfg.GetSource("logFormat"))
+	l.Infof("- log max size: %dMB [%s]", cfg.LogMaxSize, cfg.GetSource("logMaxSize"))
+	l.Infof("- log max files: %d [%s]", cfg.LogMaxFiles, cfg.GetSource("logMaxFiles"))
+	l.Infof("- log levels: %v [%s]", cfg.LogLevels, cfg.GetSource("logLevels"))
+
+	// volume lifecycle audit log, plugin works without it if the file cannot be opened
+	auditLog, err := audit.New(config.AuditLogFile)
+	if err != nil {
+		l.Warnf("audit log is disabled: %s", err)
+	}
 
 	// create driver
 	d, err := driver.New(driver.Args{
 		Config: cfg,
 		Log:    l,
+		Audit:  auditLog,
 	})
 	if err != nil {
 		l.Fatalf("Failed to create volume driver: %s", err)
 	}
 
-	l.Infof("run server on '%s'...", defaultSocketAddress)
-	handler := volume.NewHandler(d)
-	err = handler.ServeUnix(defaultSocketAddress, 0)
+	// reload config on file changes and on SIGHUP, keep the last valid config if the new one is broken
+	watcher := config.NewWatcher(config.WatcherArgs{
+		Config: cfg,
+		OnChange: func(newCfg *config.Config) error {
+			if err := d.Reload(newCfg); err != nil {
+				return err
+			}
+			lg.Configure(newCfg)
+			return nil
+		},
+		Log: l,
+	})
+	stopWatcher := make(chan struct{})
+	if err := watcher.Start(stopWatcher); err != nil {
+		l.Warnf("config file changes will not be detected, send SIGHUP to reload config: %s", err)
+	}
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			l.Info("SIGHUP received, reload config...")
+			watcher.Reload()
+		}
+	}()
+
+	// check volume mounts health in background, stale mounts are reported or remounted
+	stopHealthCheck := make(chan struct{})
+	d.StartHealthCheck(stopHealthCheck)
+
+	// refresh cached volume list in background if enabled
+	stopListRefresher := make(chan struct{})
+	d.StartListRefresher(stopListRefresher)
+
+	// metrics listener is optional, changes of its address are applied on plugin restart only
+	if cfg.MetricsAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Default)
+			l.Infof("run metrics server on '%s/metrics'...", cfg.MetricsAddress)
+			if err := http.ListenAndServe(cfg.MetricsAddress, mux); err != nil {
+				l.Errorf("Failed to start metrics server: %s", err)
+			}
+		}()
+	}
+
+	// own listener is used instead of handler.ServeUnix(), so it can be closed on shutdown
+	if err := os.MkdirAll(filepath.Dir(defaultSocketAddress), 0755); err != nil {
+		l.Fatalf("Failed to create socket directory: %s", err)
+	}
+	listener, err := sockets.NewUnixSocket(defaultSocketAddress, 0)
 	if err != nil {
+		l.Fatalf("Failed to create socket '%s': %s", defaultSocketAddress, err)
+	}
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGTERM, syscall.SIGINT)
+
+	l.Infof("run server on '%s'...", defaultSocketAddress)
+	handler := volume.NewHandler(metrics.InstrumentDriver(d))
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- handler.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
 		l.Fatalf("Failed to start server: %s", err)
-	} else {
-		l.Info("driver process terminated.")
+	case sig := <-shutdown:
+		l.Infof("%s received, shut down...", sig)
+	}
+
+	// stop accepting connections, requests on open connections are rejected by the driver
+	listener.Close()
+	close(stopWatcher)
+	close(stopHealthCheck)
+	close(stopListRefresher)
+
+	if err := d.Shutdown(); err != nil {
+		l.Error(err)
+	}
+	if err := auditLog.Close(); err != nil {
+		l.Warnf("cannot close audit log: %s", err)
+	}
+
+	l.Info("driver process terminated.")
+	if err := lg.Close(); err != nil {
+		l.Warnf("cannot close log file: %s", err)
 	}
 }
 
-func initLogger() *logrus.Entry {
-	l := logrus.New().WithFields(logrus.Fields{
-		"driver": fmt.Sprintf("%s@%s", config.Name, config.Version),
-		"cmp":    "Main",
-	})
+// runValidate runs preflight checks and returns process exit code
+func runValidate(configFile string) int {
+	l := logrus.New().WithField("cmp", "Main")
+	l.Logger.SetOutput(os.Stderr)
+	l.Logger.SetLevel(logrus.WarnLevel)
+
+	fmt.Printf("%s@%s-%s (%s), config file: '%s'\n", config.Name, config.Version, config.Commit, config.DateTime, configFile)
 
-	// set logger formatter
-	l.Logger.SetFormatter(&nestedLogrusFormatter.Formatter{
-		HideKeys:    true,
-		FieldsOrder: []string{"driver", "cmp", "ns", "func", "req", "reqID", "job"},
+	cfg, err := config.New(configFile)
+	if err != nil {
+		fmt.Printf("[FAIL] config: %s\nResult: FAILED\n", err)
+		return 1
+	}
+
+	report := preflight.Run(preflight.Args{
+		Config: cfg,
+		Log:    l,
 	})
+	report.Print(os.Stdout)
+
+	return report.ExitCode()
+}
+
+// runResize resizes the volume and returns process exit code
+func runResize(configFile, auditLogFile, volumeName, size string, allowShrink bool) int {
+	l := logrus.New().WithField("cmp", "Main")
+	l.Logger.SetOutput(os.Stderr)
+	l.Logger.SetLevel(logrus.WarnLevel)
+
+	sizeBytes, err := driver.ParseSize(size)
+	if err != nil {
+		fmt.Printf("Invalid -size: %s\n", err)
+		return 1
+	}
 
-	logFileWriter, err := os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY, 0666)
+	cfg, err := config.New(configFile)
 	if err != nil {
-		l.Warnf("failed to create log file '%s' inside the container: %s", config.LogFile, err)
-		l.Logger.SetOutput(os.Stdout)
-		return l
+		fmt.Printf("Cannot use config file: %s\n", err)
+		return 1
+	}
+	if !cfg.FileExists() {
+		l.Warnf(
+			"config file '%s' not found, plugin settings are not visible to the command, "+
+				"only environment variables of the command are used",
+			configFile,
+		)
 	}
 
-	mw := io.MultiWriter(os.Stdout, logFileWriter)
-	l.Logger.SetOutput(mw)
+	// resize is audited like volume lifecycle events, volume is not resized if the event cannot be written
+	auditLog, err := audit.New(auditLogFile)
+	if err != nil {
+		fmt.Printf("Cannot open audit log, use -audit-log to set its path: %s\n", err)
+		return 1
+	}
+	defer auditLog.Close()
 
-	return l
+	err = driver.ResizeVolume(driver.ResizeArgs{
+		Config:      cfg,
+		Log:         l,
+		Audit:       auditLog,
+		Volume:      volumeName,
+		Size:        sizeBytes,
+		AllowShrink: allowShrink,
+	})
+	if err != nil {
+		fmt.Printf("Cannot resize volume '%s': %s\n", volumeName, err)
+		return 1
+	}
+
+	fmt.Printf("Volume '%s' has been resized to %s\n", volumeName, size)
+	return 0
+}
+
+// getResizeAuditLogFile returns the plugin's audit log path on the host if the command is run from the plugin's
+// rootfs (/var/lib/docker/plugins/<PLUGIN_ID>/rootfs/bin/), the path inside plugin's container otherwise
+func getResizeAuditLogFile() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return config.AuditLogFile
+	}
+
+	rootfs := filepath.Dir(filepath.Dir(executable))
+	if filepath.Base(rootfs) != "rootfs" {
+		return config.AuditLogFile
+	}
+	return filepath.Join(filepath.Dir(rootfs), "propagated-mount", filepath.Base(config.AuditLogFile))
 }
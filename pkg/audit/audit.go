@@ -0,0 +1,139 @@
+// Audit writes volume lifecycle events to an append-only JSON-lines file
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// volume lifecycle actions
+const (
+	ActionCreate  = "Create"
+	ActionMount   = "Mount"
+	ActionUnmount = "Unmount"
+	ActionRemove  = "Remove"
+	ActionResize  = "Resize" // admin command, Create resizes existing volumes as a part of Create event
+)
+
+// event outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// Event - volume lifecycle event, a single line in the audit log
+type Event struct {
+	Time        time.Time         `json:"time"`
+	Action      string            `json:"action"`
+	RequestID   string            `json:"requestId,omitempty"` // plugin request ID from logs and error messages
+	Volume      string            `json:"volume"`
+	ContainerID string            `json:"containerId,omitempty"`
+	Host        string            `json:"host"`
+	Node        string            `json:"node,omitempty"` // NexentaStor REST API address
+	Path        string            `json:"path,omitempty"` // NexentaStor filesystem path
+	Options     map[string]string `json:"options,omitempty"`
+	Outcome     string            `json:"outcome"`
+	Error       string            `json:"error,omitempty"`
+	DurationMs  int64             `json:"durationMs"`
+}
+
+// Logger writes audit events to the file, file is re-opened if it was moved or removed by external rotation
+type Logger struct {
+	path string
+	host string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// New opens audit log file for appending
+func New(path string) (*Logger, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get hostname for audit log: %s", err)
+	}
+
+	a := &Logger{path: path, host: host}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Write completes the event with time, host, outcome and duration, and appends it to the audit log.
+// Nil logger does nothing.
+func (a *Logger) Write(event *Event, startTime time.Time, err error) error {
+	if a == nil {
+		return nil
+	}
+
+	event.Time = startTime.UTC()
+	event.Host = a.host
+	event.DurationMs = int64(time.Since(startTime) / time.Millisecond)
+	if err != nil {
+		event.Outcome = OutcomeFailure
+		event.Error = err.Error()
+	} else {
+		event.Outcome = OutcomeSuccess
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("Cannot marshal audit event %+v: %s", event, err)
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.reopenIfRotated(); err != nil {
+		return err
+	}
+
+	if _, err := a.file.Write(line); err != nil {
+		return fmt.Errorf("Cannot write to audit log '%s': %s", a.path, err)
+	}
+
+	return a.file.Sync()
+}
+
+// Close closes audit log file
+func (a *Logger) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+func (a *Logger) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("Cannot open audit log '%s': %s", a.path, err)
+	}
+	a.file = file
+	return nil
+}
+
+// reopenIfRotated opens the file again if the path points to another file or doesn't exist
+func (a *Logger) reopenIfRotated() error {
+	pathInfo, err := os.Stat(a.path)
+	if err == nil {
+		fileInfo, err := a.file.Stat()
+		if err == nil && os.SameFile(pathInfo, fileInfo) {
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("Cannot get stats for audit log '%s': %s", a.path, err)
+	}
+
+	a.file.Close()
+	return a.open()
+}
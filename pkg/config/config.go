@@ -3,11 +3,15 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
@@ -35,6 +39,13 @@ const (
 
 	// path to a log file inside the plugin's container
 	LogFile = "/var/log/nexentastor-docker-volume-plugin.log"
+
+	// path to a plugin mounts state file inside the plugin's container, it's kept on the propagated mount
+	StateFile = PluginMountPointsRoot + "/state.json"
+
+	// path to a volume lifecycle audit log file inside the plugin's container, it's kept on the propagated mount,
+	// so it's available on the host and is not lost on plugin upgrade
+	AuditLogFile = PluginMountPointsRoot + "/audit.log"
 )
 
 // supported mount filesystem types
@@ -43,21 +54,124 @@ const (
 	FsTypeNFS string = "nfs"
 )
 
+// log formats
+const (
+	// LogFormatText - human readable log lines
+	LogFormatText = "text"
+
+	// LogFormatJSON - JSON object per log line
+	LogFormatJSON = "json"
+)
+
+// default values for optional parameters
+const (
+	defaultLogFormat   = LogFormatText
+	defaultLogMaxSize  = 10 // MB
+	defaultLogMaxFiles = 3
+
+	defaultHealthCheckInterval = 30 // seconds
+	defaultHealthCheckTimeout  = 5  // seconds
+
+	// NFS mount and container bind mount take up to 40s; umount, forced and lazy umount of a mount point
+	// take up to 30s
+	defaultMountTimeout   = 20 // seconds
+	defaultUnmountTimeout = 10 // seconds
+
+	// Docker kills the plugin in 10 seconds after SIGTERM
+	defaultShutdownTimeout = 8 // seconds
+
+	// Docker waits 60s for Get, List, Path and Capabilities responses and 120s for Create, Remove, Mount
+	// and Unmount ones, so plugin's error is returned before Docker gives up on any request
+	defaultRequestTimeout = 55 // seconds
+	defaultRestTimeout    = 15 // seconds
+	defaultJobTimeout     = 30 // seconds
+
+	// vendored NS provider stops waiting for an async job after 60 seconds
+	maxJobTimeout = 60 // seconds
+
+	defaultListCacheTTL = 10 // seconds
+
+	// delays between all attempts take ~17s, attempts are stopped by the request deadline anyway
+	defaultRetryAttempts = 6
+	defaultRetryDelay    = 1000 // milliseconds
+	defaultRetryMaxDelay = 5000 // milliseconds
+	defaultRetryJitter   = 20   // percent
+)
+
+// config parameter sources, see Config.GetSource()
+const (
+	// SourceDefault - parameter is not set, default value is used
+	SourceDefault = "default"
+
+	// SourceFile - parameter is set in the config file
+	SourceFile = "file"
+
+	// SourceEnv - parameter is set by environment variable (`docker plugin set NAME=VALUE`)
+	SourceEnv = "env"
+)
+
 // NexentaStor address format
 var regexpAddress = regexp.MustCompile("^https?://[^:]+:[0-9]{1,5}$")
 
-// Config - plugin config from file
+// NexentaStor dataset path format: "pool/dataset/..."
+var regexpDatasetPath = regexp.MustCompile("^[^/ ]+(/[^/ ]+)*$")
+
+// Config - plugin config from file and environment variables.
+// Environment variables (set by `docker plugin set NAME=VALUE`, see "env" section in `config.json`)
+// are layered over the config file values, empty variables are ignored.
 type Config struct {
-	Address             string `yaml:"restIp"`
-	Username            string `yaml:"username"`
-	Password            string `yaml:"password"`
-	DefaultDataset      string `yaml:"defaultDataset,omitempty"`
-	DefaultDataIP       string `yaml:"defaultDataIp,omitempty"`
-	Debug               bool   `yaml:"debug,omitempty"`
-	DefaultMountOptions string `yaml:"defaultMountOptions,omitempty"`
+	Address             string `yaml:"restIp" env:"REST_IP"`
+	Username            string `yaml:"username" env:"USERNAME"`
+	Password            string `yaml:"password" env:"PASSWORD"`
+	DefaultDataset      string `yaml:"defaultDataset,omitempty" env:"DEFAULT_DATASET"`
+	DefaultDataIP       string `yaml:"defaultDataIp,omitempty" env:"DEFAULT_DATA_IP"`
+	Debug               bool   `yaml:"debug,omitempty" env:"DEBUG"`
+	DefaultMountOptions string `yaml:"defaultMountOptions,omitempty" env:"DEFAULT_MOUNT_OPTIONS"`
+	MetricsAddress      string `yaml:"metricsAddress,omitempty" env:"METRICS_ADDRESS"`
+	ReconcileDryRun     bool   `yaml:"reconcileDryRun,omitempty" env:"RECONCILE_DRY_RUN"` // report startup cleanup only
+
+	// volume mounts health check
+	HealthCheckInterval int `yaml:"healthCheckInterval,omitempty" env:"HEALTH_CHECK_INTERVAL"` // seconds, 0 - disabled
+	HealthCheckTimeout  int `yaml:"healthCheckTimeout,omitempty" env:"HEALTH_CHECK_TIMEOUT"`   // seconds
+
+	// mount/umount commands timeouts, hung command is killed
+	MountTimeout   int `yaml:"mountTimeout,omitempty" env:"MOUNT_TIMEOUT"`     // seconds
+	UnmountTimeout int `yaml:"unmountTimeout,omitempty" env:"UNMOUNT_TIMEOUT"` // seconds
+
+	// graceful shutdown on SIGTERM/SIGINT
+	ShutdownTimeout   int  `yaml:"shutdownTimeout,omitempty" env:"SHUTDOWN_TIMEOUT"`      // seconds to wait for requests
+	UnmountOnShutdown bool `yaml:"unmountOnShutdown,omitempty" env:"UNMOUNT_ON_SHUTDOWN"` // unmount not used volumes
+
+	// deadlines of NS REST requests, NS async jobs and whole plugin requests
+	RestTimeout    int `yaml:"restTimeout,omitempty" env:"REST_TIMEOUT"`       // seconds
+	JobTimeout     int `yaml:"jobTimeout,omitempty" env:"JOB_TIMEOUT"`         // seconds
+	RequestTimeout int `yaml:"requestTimeout,omitempty" env:"REQUEST_TIMEOUT"` // seconds, 0 - no deadline
+
+	// volume list cache and filter
+	ListCacheTTL        int  `yaml:"listCacheTtl,omitempty" env:"LIST_CACHE_TTL"`               // seconds, 0 - no cache
+	ListRefreshInterval int  `yaml:"listRefreshInterval,omitempty" env:"LIST_REFRESH_INTERVAL"` // seconds, 0 - disabled
+	ManagedVolumesOnly  bool `yaml:"managedVolumesOnly,omitempty" env:"MANAGED_VOLUMES_ONLY"`   // hide foreign filesystems
+
+	// datasets which filesystems outside of defaultDataset can be adopted from, "," to separate datasets
+	AdoptableRoots string `yaml:"adoptableRoots,omitempty" env:"ADOPTABLE_ROOTS"`
+
+	// retries of NS requests failed with transient errors (network errors, HTTP 5xx, EBUSY, async job timeouts)
+	RetryAttempts int `yaml:"retryAttempts,omitempty" env:"RETRY_ATTEMPTS"`  // all attempts, 1 - no retries
+	RetryDelay    int `yaml:"retryDelay,omitempty" env:"RETRY_DELAY"`        // milliseconds, doubled for each retry
+	RetryMaxDelay int `yaml:"retryMaxDelay,omitempty" env:"RETRY_MAX_DELAY"` // milliseconds
+	RetryJitter   int `yaml:"retryJitter,omitempty" env:"RETRY_JITTER"`      // percent of the delay, randomly +/-
+
+	// logging
+	LogFormat   string            `yaml:"logFormat,omitempty" env:"LOG_FORMAT"`
+	LogMaxSize  int               `yaml:"logMaxSize,omitempty" env:"LOG_MAX_SIZE"`   // MB, 0 - no rotation
+	LogMaxFiles int               `yaml:"logMaxFiles,omitempty" env:"LOG_MAX_FILES"` // rotated files to keep
+	LogLevels   map[string]string `yaml:"logLevels,omitempty" env:"LOG_LEVELS"`      // component -> level
 
 	filePath    string
+	fileExists  bool
+	loaded      bool
 	lastMobTime time.Time
+	sources     map[string]string
 }
 
 // New creates config instance
@@ -76,37 +190,244 @@ func (c *Config) GetFilePath() string {
 	return c.filePath
 }
 
-// Refresh reads and validates config, returns `true` if config has been changed
+// FileExists returns true if config file was found, otherwise config is built from environment variables only
+func (c *Config) FileExists() bool {
+	return c.fileExists
+}
+
+// GetSource returns source of the effective parameter value by its yaml name: "default", "file" or "env"
+func (c *Config) GetSource(name string) string {
+	if source, ok := c.sources[name]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// Refresh reads and validates config, returns `true` if config has been changed.
+// Missing config file is not an error, all parameters may be set by environment variables.
+// New values are parsed into a fresh config and applied only if they are valid, so a broken
+// config file leaves current values untouched and will be read again on the next call.
+// Refresh modifies the config in place, use Watcher to share config between goroutines.
 func (c *Config) Refresh() (changed bool, err error) {
 	if c.filePath == "" {
 		return false, fmt.Errorf("Cannot read config file, filePath not specified")
 	}
 
+	var modTime time.Time
+	fileExists := true
 	fileInfo, err := os.Stat(c.filePath)
 	if err != nil {
-		return false, fmt.Errorf("Cannot get stats for '%s' config file: %s", c.filePath, err)
+		if !os.IsNotExist(err) {
+			return false, fmt.Errorf("Cannot get stats for '%s' config file: %s", c.filePath, err)
+		}
+		fileExists = false
+	} else {
+		modTime = fileInfo.ModTime()
 	}
 
-	changed = c.lastMobTime != fileInfo.ModTime()
+	changed = !c.loaded || c.fileExists != fileExists || c.lastMobTime != modTime
 
 	if changed {
-		c.lastMobTime = fileInfo.ModTime()
+		next := &Config{
+			filePath:    c.filePath,
+			fileExists:  fileExists,
+			loaded:      true,
+			lastMobTime: modTime,
+			sources:     map[string]string{},
+		}
+
+		if err := next.load(); err != nil {
+			return changed, err
+		}
+
+		*c = *next
+	}
+
+	return changed, nil
+}
+
+// IsDatasetPath returns true if the path is a valid NexentaStor dataset path: "pool/dataset/..."
+func IsDatasetPath(path string) bool {
+	if !regexpDatasetPath.MatchString(path) {
+		return false
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// GetAdoptableRoots returns datasets which filesystems can be adopted from
+func (c *Config) GetAdoptableRoots() []string {
+	roots := []string{}
+	for _, root := range strings.Split(c.AdoptableRoots, ",") {
+		if root = strings.TrimSpace(root); root != "" {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// Equal returns true if both configs have the same parameter values
+func (c *Config) Equal(other *Config) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+
+	a := reflect.ValueOf(c).Elem()
+	b := reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		if a.Type().Field(i).Tag.Get("yaml") == "" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			return false
+		}
+	}
+
+	return true
+}
 
+// load reads config file (if exists) and environment variables into empty config, validates the result
+func (c *Config) load() error {
+	if c.fileExists {
 		content, err := ioutil.ReadFile(c.filePath)
 		if err != nil {
-			return changed, fmt.Errorf("Cannot read '%s' config file: %s", c.filePath, err)
+			return fmt.Errorf("Cannot read '%s' config file: %s", c.filePath, err)
 		}
 
 		if err := yaml.Unmarshal(content, c); err != nil {
-			return changed, fmt.Errorf("Cannot parse yaml in '%s' config file: %s", c.filePath, err)
+			return fmt.Errorf("Cannot parse yaml in '%s' config file: %s", c.filePath, err)
 		}
 
-		if err := c.Validate(); err != nil {
-			return changed, err
+		fileParams := map[string]interface{}{}
+		if err := yaml.Unmarshal(content, &fileParams); err != nil {
+			return fmt.Errorf("Cannot parse yaml in '%s' config file: %s", c.filePath, err)
+		}
+		for name := range fileParams {
+			c.sources[name] = SourceFile
 		}
 	}
 
-	return changed, nil
+	if err := c.applyEnv(); err != nil {
+		return err
+	}
+
+	c.applyDefaults()
+
+	return c.Validate()
+}
+
+// applyDefaults sets default values for optional parameters which are not set neither in file nor in env
+func (c *Config) applyDefaults() {
+	if c.GetSource("logFormat") == SourceDefault {
+		c.LogFormat = defaultLogFormat
+	}
+	if c.GetSource("logMaxSize") == SourceDefault {
+		c.LogMaxSize = defaultLogMaxSize
+	}
+	if c.GetSource("logMaxFiles") == SourceDefault {
+		c.LogMaxFiles = defaultLogMaxFiles
+	}
+	if c.GetSource("healthCheckInterval") == SourceDefault {
+		c.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	if c.GetSource("healthCheckTimeout") == SourceDefault {
+		c.HealthCheckTimeout = defaultHealthCheckTimeout
+	}
+	if c.GetSource("mountTimeout") == SourceDefault {
+		c.MountTimeout = defaultMountTimeout
+	}
+	if c.GetSource("unmountTimeout") == SourceDefault {
+		c.UnmountTimeout = defaultUnmountTimeout
+	}
+	if c.GetSource("shutdownTimeout") == SourceDefault {
+		c.ShutdownTimeout = defaultShutdownTimeout
+	}
+	if c.GetSource("restTimeout") == SourceDefault {
+		c.RestTimeout = defaultRestTimeout
+	}
+	if c.GetSource("jobTimeout") == SourceDefault {
+		c.JobTimeout = defaultJobTimeout
+	}
+	if c.GetSource("requestTimeout") == SourceDefault {
+		c.RequestTimeout = defaultRequestTimeout
+	}
+	if c.GetSource("listCacheTtl") == SourceDefault {
+		c.ListCacheTTL = defaultListCacheTTL
+	}
+	if c.GetSource("retryAttempts") == SourceDefault {
+		c.RetryAttempts = defaultRetryAttempts
+	}
+	if c.GetSource("retryDelay") == SourceDefault {
+		c.RetryDelay = defaultRetryDelay
+	}
+	if c.GetSource("retryMaxDelay") == SourceDefault {
+		c.RetryMaxDelay = defaultRetryMaxDelay
+	}
+	if c.GetSource("retryJitter") == SourceDefault {
+		c.RetryJitter = defaultRetryJitter
+	}
+}
+
+// applyEnv overrides config parameters by non-empty environment variables set in `env` struct tags
+func (c *Config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		envName := t.Field(i).Tag.Get("env")
+		if envName == "" {
+			continue
+		}
+
+		value := os.Getenv(envName)
+		if value == "" {
+			continue
+		}
+
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		field := v.Field(i)
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("Cannot parse '%s' environment variable value '%s' as boolean: %s", envName, value, err)
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("Cannot parse '%s' environment variable value '%s' as integer: %s", envName, value, err)
+			}
+			field.SetInt(int64(n))
+		case reflect.Map: // "key1=value1,key2=value2"
+			m := map[string]string{}
+			for _, pair := range strings.Split(value, ",") {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 {
+					return fmt.Errorf(
+						"Cannot parse '%s' environment variable value '%s', expected format: 'key1=value1,key2=value2'",
+						envName,
+						value,
+					)
+				}
+				m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+			field.Set(reflect.ValueOf(m))
+		default:
+			return fmt.Errorf("Environment variable '%s' has unsupported type: %s", envName, field.Kind())
+		}
+
+		c.sources[name] = SourceEnv
+	}
+
+	return nil
 }
 
 // Validate validates current config
@@ -142,6 +463,119 @@ func (c *Config) Validate() error {
 		errors = append(errors, fmt.Sprintf("parameter 'defaultDataIp' is missed"))
 	}
 
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			errors = append(
+				errors,
+				fmt.Sprintf("parameter 'metricsAddress' has invalid value '%s', should be '[host]:port'", c.MetricsAddress),
+			)
+		}
+	}
+
+	if c.LogFormat != "" && c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		errors = append(
+			errors,
+			fmt.Sprintf(
+				"parameter 'logFormat' has invalid value '%s', should be '%s' or '%s'",
+				c.LogFormat,
+				LogFormatText,
+				LogFormatJSON,
+			),
+		)
+	}
+	if c.HealthCheckInterval < 0 {
+		errors = append(
+			errors,
+			fmt.Sprintf("parameter 'healthCheckInterval' should not be negative, got: %d", c.HealthCheckInterval),
+		)
+	}
+	if c.HealthCheckTimeout <= 0 {
+		errors = append(
+			errors,
+			fmt.Sprintf("parameter 'healthCheckTimeout' should be positive, got: %d", c.HealthCheckTimeout),
+		)
+	}
+	if c.MountTimeout <= 0 {
+		errors = append(errors, fmt.Sprintf("parameter 'mountTimeout' should be positive, got: %d", c.MountTimeout))
+	}
+	if c.UnmountTimeout <= 0 {
+		errors = append(errors, fmt.Sprintf("parameter 'unmountTimeout' should be positive, got: %d", c.UnmountTimeout))
+	}
+	if c.ShutdownTimeout < 0 {
+		errors = append(
+			errors,
+			fmt.Sprintf("parameter 'shutdownTimeout' should not be negative, got: %d", c.ShutdownTimeout),
+		)
+	}
+	if c.RestTimeout <= 0 {
+		errors = append(errors, fmt.Sprintf("parameter 'restTimeout' should be positive, got: %d", c.RestTimeout))
+	}
+	if c.JobTimeout <= 0 || c.JobTimeout > maxJobTimeout {
+		errors = append(
+			errors,
+			fmt.Sprintf("parameter 'jobTimeout' should be in range 1..%d, got: %d", maxJobTimeout, c.JobTimeout),
+		)
+	}
+	if c.RequestTimeout < 0 {
+		errors = append(
+			errors,
+			fmt.Sprintf("parameter 'requestTimeout' should not be negative, got: %d", c.RequestTimeout),
+		)
+	}
+	if c.ListCacheTTL < 0 {
+		errors = append(errors, fmt.Sprintf("parameter 'listCacheTtl' should not be negative, got: %d", c.ListCacheTTL))
+	}
+	if c.ListRefreshInterval < 0 {
+		errors = append(
+			errors,
+			fmt.Sprintf("parameter 'listRefreshInterval' should not be negative, got: %d", c.ListRefreshInterval),
+		)
+	}
+	for _, root := range c.GetAdoptableRoots() {
+		if !IsDatasetPath(root) {
+			errors = append(
+				errors,
+				fmt.Sprintf("parameter 'adoptableRoots' has invalid dataset: '%s', should be 'pool/dataset'", root),
+			)
+		}
+	}
+	if c.RetryAttempts <= 0 {
+		errors = append(errors, fmt.Sprintf("parameter 'retryAttempts' should be positive, got: %d", c.RetryAttempts))
+	}
+	if c.RetryDelay < 0 {
+		errors = append(errors, fmt.Sprintf("parameter 'retryDelay' should not be negative, got: %d", c.RetryDelay))
+	}
+	if c.RetryMaxDelay < c.RetryDelay {
+		errors = append(
+			errors,
+			fmt.Sprintf(
+				"parameter 'retryMaxDelay' should not be less than 'retryDelay' (%d), got: %d",
+				c.RetryDelay,
+				c.RetryMaxDelay,
+			),
+		)
+	}
+	if c.RetryJitter < 0 || c.RetryJitter > 100 {
+		errors = append(
+			errors,
+			fmt.Sprintf("parameter 'retryJitter' should be in range 0..100, got: %d", c.RetryJitter),
+		)
+	}
+	if c.LogMaxSize < 0 {
+		errors = append(errors, fmt.Sprintf("parameter 'logMaxSize' should not be negative, got: %d", c.LogMaxSize))
+	}
+	if c.LogMaxFiles < 0 {
+		errors = append(errors, fmt.Sprintf("parameter 'logMaxFiles' should not be negative, got: %d", c.LogMaxFiles))
+	}
+	for component, level := range c.LogLevels {
+		if _, err := logrus.ParseLevel(level); err != nil {
+			errors = append(
+				errors,
+				fmt.Sprintf("parameter 'logLevels' has invalid level '%s' for '%s' component", level, component),
+			)
+		}
+	}
+
 	if len(errors) != 0 {
 		return fmt.Errorf("Bad format, fix following issues: %s", strings.Join(errors, "; "))
 	}
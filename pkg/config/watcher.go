@@ -0,0 +1,110 @@
+package config
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// time to wait for more file events before config reload, editors may write a file in several steps
+const watcherDebounceInterval = 200 * time.Millisecond
+
+// Watcher keeps the last valid config and reloads it on config file changes or on demand (SIGHUP)
+type Watcher struct {
+	log      *logrus.Entry
+	filePath string
+	onChange func(*Config) error
+
+	mu      sync.Mutex
+	current *Config
+}
+
+// WatcherArgs - params to create a new config watcher
+type WatcherArgs struct {
+	// Config - initial valid config
+	Config *Config
+
+	// OnChange is called with a new valid config before it replaces the current one,
+	// if it returns an error then the current config is kept
+	OnChange func(*Config) error
+
+	Log *logrus.Entry
+}
+
+// NewWatcher creates a new config watcher
+func NewWatcher(args WatcherArgs) *Watcher {
+	return &Watcher{
+		log:      args.Log.WithField("cmp", "ConfigWatcher"),
+		filePath: args.Config.GetFilePath(),
+		onChange: args.OnChange,
+		current:  args.Config,
+	}
+}
+
+// Config returns the last valid config, returned config must not be modified
+func (w *Watcher) Config() *Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current
+}
+
+// Reload reads config into a new instance and replaces the current one if the new config is valid
+// and differs from the current one. Invalid config is logged and the last valid config is kept.
+func (w *Watcher) Reload() (changed bool, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	next, err := New(w.filePath)
+	if err != nil {
+		w.log.Errorf("config reload failed, keep using the last valid config: %s", err)
+		return false, err
+	}
+
+	if next.Equal(w.current) {
+		w.log.Debug("config has not been changed")
+		return false, nil
+	}
+
+	if w.onChange != nil {
+		if err := w.onChange(next); err != nil {
+			w.log.Errorf("cannot apply new config, keep using the last valid config: %s", err)
+			return false, err
+		}
+	}
+
+	w.current = next
+	w.log.Info("config has been reloaded")
+
+	return true, nil
+}
+
+// Start watches config file changes until stop channel is closed, config gets reloaded on each change.
+// Returns an error if file changes cannot be watched, Reload() still can be used in this case.
+func (w *Watcher) Start(stop <-chan struct{}) error {
+	events := make(chan struct{}, 1)
+
+	if err := watchFile(w.filePath, events, stop); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-events:
+				time.Sleep(watcherDebounceInterval)
+				select {
+				case <-events:
+				default:
+				}
+				w.log.Infof("config file '%s' change detected", w.filePath)
+				w.Reload()
+			}
+		}
+	}()
+
+	w.log.Debugf("watching '%s' config file changes", w.filePath)
+	return nil
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotify poll timeout to check stop channel, ms
+const watchFilePollTimeout = 1000
+
+// watchFile sends to events channel on any change in config file's directory using inotify.
+// Directory is watched instead of the file itself to catch file replacements (editors, symlink swaps).
+func watchFile(filePath string, events chan<- struct{}, stop <-chan struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("Cannot init inotify: %s", err)
+	}
+
+	dir := filepath.Dir(filePath)
+	mask := uint32(unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+		unix.IN_ATTRIB | unix.IN_MODIFY)
+	if _, err := unix.InotifyAddWatch(fd, dir, mask); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("Cannot watch '%s' directory: %s", dir, err)
+	}
+
+	go func() {
+		defer unix.Close(fd)
+
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		pollFds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			n, err := unix.Poll(pollFds, watchFilePollTimeout)
+			if err == unix.EINTR || n == 0 {
+				continue
+			} else if err != nil {
+				return
+			}
+
+			// event details are not used, config file gets re-read on any change in the directory
+			if n, err := unix.Read(fd, buf); err != nil || n <= 0 {
+				continue
+			}
+
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package config
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// watchFile is not supported on this platform, config can be reloaded by SIGHUP only
+func watchFile(filePath string, events chan<- struct{}, stop <-chan struct{}) error {
+	return fmt.Errorf("Watching config file changes is not supported on %s", runtime.GOOS)
+}
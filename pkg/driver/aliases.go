@@ -0,0 +1,278 @@
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/audit"
+)
+
+// propertyAliasPrefix - prefix of user properties of plugin's dataset which keep volumes registered as aliases
+// of filesystems outside of the dataset (`adopt=pool/dataset/fs` Create option): one property per volume,
+// the value is the filesystem path, empty value - the alias is removed. All Docker hosts see the same aliases,
+// aliases of different volumes changed concurrently on different hosts don't overwrite each other.
+const propertyAliasPrefix = userPropertyPrefix + "alias."
+
+// getAliasProperty returns user property name of the volume alias. NS user property names are lowercase,
+// so uppercase letter of the volume name is escaped as "_" with the lowercase letter, "_" is escaped as "__".
+func getAliasProperty(volumeName string) string {
+	var b strings.Builder
+	b.WriteString(propertyAliasPrefix)
+	for _, c := range volumeName {
+		if c == '_' {
+			b.WriteString("__")
+		} else if unicode.IsUpper(c) {
+			b.WriteRune('_')
+			b.WriteRune(unicode.ToLower(c))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// parseAliasProperty returns volume name of the alias user property, ok is false for other properties
+func parseAliasProperty(property string) (volumeName string, ok bool) {
+	if !strings.HasPrefix(property, propertyAliasPrefix) {
+		return "", false
+	}
+
+	var b strings.Builder
+	escaped := false
+	for _, c := range strings.TrimPrefix(property, propertyAliasPrefix) {
+		if escaped && c != '_' {
+			b.WriteRune(unicode.ToUpper(c))
+		} else if !escaped && c == '_' {
+			escaped = true
+			continue
+		} else {
+			b.WriteRune(c)
+		}
+		escaped = false
+	}
+	return b.String(), true
+}
+
+// getAliases returns volume aliases registered in plugin's dataset: volume name -> filesystem path
+func (r *request) getAliases() (map[string]string, error) {
+	datasetPath := r.config.DefaultDataset
+	_, dataset, err := r.getFilesystemProperties(datasetPath, datasetPath)
+	if err != nil {
+		return nil, fmt.Errorf("InternalError: Cannot get volume aliases of '%s': %s", datasetPath, err)
+	}
+
+	aliases := map[string]string{}
+	for property, value := range dataset.UserProperties {
+		if volumeName, ok := parseAliasProperty(property); ok && value != "" {
+			aliases[volumeName] = value
+		}
+	}
+	return aliases, nil
+}
+
+// getAlias returns filesystem path of the alias volume, empty path if the volume is not an alias
+func (r *request) getAlias(volumeName string) (string, error) {
+	datasetPath := r.config.DefaultDataset
+	_, dataset, err := r.getFilesystemProperties(datasetPath, datasetPath)
+	if err != nil {
+		return "", fmt.Errorf("InternalError: Cannot get volume aliases of '%s': %s", datasetPath, err)
+	}
+	return dataset.UserProperties[getAliasProperty(volumeName)], nil
+}
+
+// setAlias saves the volume alias to plugin's dataset, empty filesystem path removes the alias
+func (r *request) setAlias(volumeName, filesystemPath string) error {
+	datasetPath := r.config.DefaultDataset
+	return r.setFilesystemProperties(datasetPath, datasetPath, map[string]string{
+		getAliasProperty(volumeName): filesystemPath,
+	})
+}
+
+// getVolumeFilesystem returns filesystem of the volume with user properties: filesystem of plugin's dataset,
+// or adopted filesystem (alias is true) if there is no such filesystem and the volume is an alias. Aliases are read
+// only if the filesystem of plugin's dataset doesn't exist, so volumes of the dataset don't depend on them.
+// Results are the same as getFilesystemProperties ones, path of plugin's dataset is returned if neither exists.
+func (r *request) getVolumeFilesystem(volumeName string) (
+	path string,
+	alias bool,
+	nsProvider ns.ProviderInterface,
+	filesystem filesystemProperties,
+	err error,
+) {
+	datasetPath := r.config.DefaultDataset
+	path = filepath.Join(datasetPath, volumeName)
+	nsProvider, filesystem, err = r.getFilesystemProperties(path, path)
+	if !ns.IsNotExistNefError(err) {
+		return path, false, nsProvider, filesystem, err
+	}
+
+	aliasPath, aliasErr := r.getAlias(volumeName)
+	if aliasErr != nil {
+		return path, false, nil, filesystemProperties{}, aliasErr
+	} else if aliasPath == "" {
+		return path, false, nsProvider, filesystem, err
+	}
+
+	nsProvider, filesystem, err = r.getFilesystemProperties(aliasPath, aliasPath)
+	return aliasPath, true, nsProvider, filesystem, err
+}
+
+// getVolumePath returns filesystem path of the volume: adopted filesystem for an alias volume
+// (alias is true), filesystem of plugin's dataset otherwise, even if it doesn't exist
+func (r *request) getVolumePath(volumeName string) (path string, alias bool, err error) {
+	path, alias, nsProvider, _, err := r.getVolumeFilesystem(volumeName)
+	if ns.IsNotExistNefError(err) {
+		return path, alias, nil
+	} else if nsProvider == nil {
+		return "", false, err
+	} else if err != nil {
+		return "", false, fmt.Errorf("InternalError: Cannot get filesystem '%s': %s", path, err)
+	}
+	return path, alias, nil
+}
+
+// isAdoptable returns true if the filesystem is one of the roots or it's a child of one of them
+func isAdoptable(filesystemPath string, roots []string) bool {
+	for _, root := range roots {
+		if filesystemPath == root || strings.HasPrefix(filesystemPath, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// createAlias registers the volume as an alias of the filesystem outside of plugin's dataset.
+// The filesystem must be under one of `adoptableRoots`, it's marked as managed and shared over NFS if needed,
+// but it's never created or destroyed by the plugin. Requested options must match the saved ones if the filesystem
+// is managed already.
+func (d *Driver) createAlias(
+	r *request,
+	volumeName, filesystemPath string,
+	options, requested volumeOptions,
+	auditEvent *audit.Event,
+) error {
+	datasetPath := r.config.DefaultDataset
+	auditEvent.Path = filesystemPath
+
+	roots := r.config.GetAdoptableRoots()
+	if len(roots) == 0 {
+		return fmt.Errorf(
+			"FailedPrecondition: Filesystems outside of '%s' cannot be adopted, 'adoptableRoots' is not set",
+			datasetPath,
+		)
+	} else if filesystemPath == datasetPath || strings.HasPrefix(filesystemPath, datasetPath+"/") {
+		return fmt.Errorf(
+			"InvalidArgument: Filesystem '%s' is in plugin's dataset '%s', use '-o %s=true' to adopt it by name",
+			filesystemPath,
+			datasetPath,
+			optionAdopt,
+		)
+	} else if !isAdoptable(filesystemPath, roots) {
+		return fmt.Errorf(
+			"PermissionDenied: Filesystem '%s' is not in any of adoptable roots: %s",
+			filesystemPath,
+			strings.Join(roots, ", "),
+		)
+	}
+
+	d.aliasesMu.Lock()
+	defer d.aliasesMu.Unlock()
+
+	existingPath, err := r.getAlias(volumeName)
+	if err != nil {
+		return err
+	}
+	if existingPath != "" {
+		if existingPath == filesystemPath {
+			r.log.Infof("volume '%s' is already an alias of '%s' filesystem", volumeName, filesystemPath)
+			saved, err := r.getVolumeOptions(filesystemPath)
+			if err != nil {
+				return err
+			}
+			return checkRequestedOptions(volumeName, requested, saved)
+		}
+		return fmt.Errorf(
+			"AlreadyExists: Volume '%s' is already an alias of another filesystem '%s'",
+			volumeName,
+			existingPath,
+		)
+	}
+
+	// volume name must not be taken by a filesystem of plugin's dataset
+	volumePath := filepath.Join(datasetPath, volumeName)
+	if _, _, err := r.getFilesystemProperties(datasetPath, volumePath); err == nil {
+		return fmt.Errorf("AlreadyExists: Volume '%s' exists as filesystem '%s'", volumeName, volumePath)
+	} else if !ns.IsNotExistNefError(err) {
+		return fmt.Errorf("InternalError: Cannot get filesystem '%s': %s", volumePath, err)
+	}
+
+	nsProvider, filesystem, err := r.getFilesystemProperties(filesystemPath, filesystemPath)
+	if ns.IsNotExistNefError(err) {
+		return fmt.Errorf("NotFound: Cannot adopt NexentaStor filesystem '%s', it doesn't exist", filesystemPath)
+	} else if nsProvider == nil {
+		return err
+	}
+	r.log.Infof("path '%s' resolved on %s NexentaStor", filesystemPath, nsProvider)
+	auditEvent.Node = fmt.Sprint(nsProvider)
+	if err != nil {
+		return fmt.Errorf("InternalError: Cannot get filesystem '%s': %s", filesystemPath, err)
+	}
+
+	if filesystem.isManaged() {
+		saved, err := loadVolumeOptions(filesystem)
+		if err != nil {
+			return fmt.Errorf("FailedPrecondition: Cannot load options of filesystem '%s': %s", filesystemPath, err)
+		}
+		if err := checkRequestedOptions(volumeName, requested, saved); err != nil {
+			return err
+		}
+	} else {
+		properties, err := newManagedProperties(options)
+		if err != nil {
+			return fmt.Errorf("InternalError: Cannot prepare filesystem user properties: %s", err)
+		}
+		if err := r.setFilesystemProperties(filesystemPath, filesystemPath, properties); err != nil {
+			return err
+		}
+	}
+
+	if !filesystem.SharedOverNfs {
+		if err := r.createNfsShare(filesystemPath, ns.Filesystem{Path: filesystemPath}); err != nil {
+			return err
+		}
+		r.log.Infof("filesystem '%s' has been shared over NFS", filesystemPath)
+	}
+
+	if err := r.setAlias(volumeName, filesystemPath); err != nil {
+		return err
+	}
+
+	d.volumeList.invalidate()
+
+	return nil
+}
+
+// removeAlias unregisters alias volume, adopted filesystem is kept as is
+func (d *Driver) removeAlias(r *request, volumeName string) error {
+	d.aliasesMu.Lock()
+	defer d.aliasesMu.Unlock()
+
+	existingPath, err := r.getAlias(volumeName)
+	if err != nil {
+		return err
+	} else if existingPath == "" {
+		return nil
+	}
+
+	if err := r.setAlias(volumeName, ""); err != nil {
+		return err
+	}
+
+	d.volumeList.invalidate()
+
+	return nil
+}
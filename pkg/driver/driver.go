@@ -2,36 +2,90 @@ package driver
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/sirupsen/logrus"
+	"k8s.io/utils/keymutex"
 
 	"github.com/Nexenta/go-nexentastor/pkg/ns"
 	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/arrays"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/audit"
 	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/metrics"
 	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/mounter"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/state"
 )
 
 // mount options regexps
 var regexpMountOptionVers = regexp.MustCompile("^vers=.*$")
 var regexpMountOptionTimeo = regexp.MustCompile("^timeo=.*$")
 
+// container bind mount name used by previous plugin versions: bind/<VOLUME_NAME>-<CONTAINER_ID>,
+// current layout is bind/<VOLUME_NAME>/<CONTAINER_ID>
+var regexpLegacyContainerBindMountName = regexp.MustCompile("^(.+)-([0-9a-f]{64})$")
+
+// number of locks to serialize mount operations of the same volume, different volumes may share a lock
+const volumeLocksCount = 64
+
 // Driver - Docker Volume driver for NS, it implements methods /VolumeDriver.*:
 // https://docs.docker.com/v17.09/engine/extend/plugins_volume/
 type Driver struct {
-	log        *logrus.Entry
-	config     *config.Config
-	nsResolver *ns.Resolver
-	mounter    *mounter.Mounter
+	log     *logrus.Entry
+	mounter *mounter.Mounter
+	audit   *audit.Logger
+	state   *state.Store
+	health  *healthChecker
+
+	// mountPointsRoot - path inside the plugin's container to mount volumes
+	mountPointsRoot string
+
+	// current holds *snapshot, it's replaced as a whole on config reload
+	current atomic.Value
+
+	// volumeLocks serializes Mount, Unmount and remount of the same volume,
+	// so check-then-act sequences over the state and the mount table don't interleave
+	volumeLocks keymutex.KeyMutex
+
+	// inFlight tracks requests to wait for on shutdown
+	inFlight inFlight
+
+	// volumeList caches List results, Create and Remove invalidate it
+	volumeList volumeListCache
+
+	// aliasesMu serializes changes of volume aliases of adopted filesystems on this host
+	aliasesMu sync.Mutex
+}
+
+// snapshot - config and NS resolver created for it, never changed after creation,
+// a request uses the snapshot taken at its start even if config is reloaded meanwhile
+type snapshot struct {
+	config   *config.Config
+	resolver *resolver
 }
 
 // Args - params to create a new driver
 type Args struct {
 	Config *config.Config
 	Log    *logrus.Entry
+
+	// Audit - volume lifecycle audit log, optional
+	Audit *audit.Logger
+
+	// StateFile - path to the mounts state file, config.StateFile if not set
+	StateFile string
+
+	// MountPointsRoot - path to mount volumes, config.PluginMountPointsRoot if not set
+	MountPointsRoot string
+
+	// Mounter - executes mount commands, mounter.New() if not set
+	Mounter *mounter.Mounter
 }
 
 // New - create new NS volume driver
@@ -39,10 +93,62 @@ func New(args Args) (*Driver, error) {
 	l := args.Log.WithField("cmp", "Driver")
 	l.Debug("created...")
 
+	nsResolver, err := newResolver(args.Config, l)
+	if err != nil {
+		return nil, err
+	}
+
+	stateFile := args.StateFile
+	if stateFile == "" {
+		stateFile = config.StateFile
+	}
+
+	mountsState, err := state.New(stateFile, l)
+	if err != nil {
+		return nil, err
+	}
+
+	mountPointsRoot := args.MountPointsRoot
+	if mountPointsRoot == "" {
+		mountPointsRoot = config.PluginMountPointsRoot
+	}
+
+	volumeMounter := args.Mounter
+	if volumeMounter == nil {
+		volumeMounter = mounter.New(l)
+	}
+
+	d := &Driver{
+		log:     l,
+		mounter: withMountTimeouts(volumeMounter, args.Config),
+		audit:   args.Audit,
+		state:   mountsState,
+		health:  newHealthChecker(),
+
+		mountPointsRoot: mountPointsRoot,
+
+		volumeLocks: keymutex.NewHashed(volumeLocksCount),
+	}
+	d.current.Store(&snapshot{config: args.Config, resolver: nsResolver})
+
+	if err := d.reconcile(args.Config.ReconcileDryRun); err != nil {
+		return nil, err
+	}
+
+	metrics.MountedVolumes.SetCollectFunc(d.collectMountedVolumes)
+	metrics.BindMounts.SetCollectFunc(d.collectBindMounts)
+	metrics.VolumeMountHealthy.SetCollectFunc(d.collectVolumeMountHealth)
+
+	return d, nil
+}
+
+// newResolver creates NS resolver for the config, REST clients of all nodes collect metrics
+// and can log with request scoped logger
+func newResolver(cfg *config.Config, l *logrus.Entry) (*resolver, error) {
 	nsResolver, err := ns.NewResolver(ns.ResolverArgs{
-		Address:            args.Config.Address,
-		Username:           args.Config.Username,
-		Password:           args.Config.Password,
+		Address:            cfg.Address,
+		Username:           cfg.Username,
+		Password:           cfg.Password,
 		Log:                l,
 		InsecureSkipVerify: true, //TODO move to config
 	})
@@ -50,60 +156,71 @@ func New(args Args) (*Driver, error) {
 		return nil, fmt.Errorf("Cannot create NexentaStor resolver: %s", err)
 	}
 
-	return &Driver{
-		log:        l,
-		config:     args.Config,
-		nsResolver: nsResolver,
-		mounter:    mounter.New(l),
-	}, nil
+	setRestClients(
+		nsResolver,
+		l,
+		time.Duration(cfg.RestTimeout)*time.Second,
+		time.Duration(cfg.JobTimeout)*time.Second,
+	)
+
+	return newNodeResolver(nsResolver), nil
+}
+
+// withMountTimeouts returns a copy of the mounter with mount/umount commands timeouts from the config
+func withMountTimeouts(m *mounter.Mounter, cfg *config.Config) *mounter.Mounter {
+	return m.WithTimeouts(
+		time.Duration(cfg.MountTimeout)*time.Second,
+		time.Duration(cfg.UnmountTimeout)*time.Second,
+	)
 }
 
-// refreshConfig reads config file and re-creates NS resolver if the config has been changed
-func (d *Driver) refreshConfig() error {
-	changed, err := d.config.Refresh()
+// Reload applies a new valid config, re-creates NS resolver for it.
+// Config and resolver are swapped atomically, requests in progress keep using the previous ones.
+// Config must not be changed after it's passed to the driver.
+func (d *Driver) Reload(cfg *config.Config) error {
+	nsResolver, err := newResolver(cfg, d.log)
 	if err != nil {
 		return err
 	}
 
-	if changed {
-		d.nsResolver, err = ns.NewResolver(ns.ResolverArgs{
-			Address:            d.config.Address,
-			Username:           d.config.Username,
-			Password:           d.config.Password,
-			Log:                d.log,
-			InsecureSkipVerify: true, //TODO move to config
-		})
-		if err != nil {
-			return fmt.Errorf("Cannot create NexentaStor resolver: %s", err)
-		}
-	}
+	d.current.Store(&snapshot{config: cfg, resolver: nsResolver})
 
 	return nil
 }
 
+// snapshot returns current config and NS resolver
+func (d *Driver) snapshot() *snapshot {
+	return d.current.Load().(*snapshot)
+}
+
 // resolveNS finds NS to use by dataset or filesystem path
-func (d *Driver) resolveNS(datasetPath string) (ns.ProviderInterface, error) {
-	nsProvider, err := d.nsResolver.Resolve(datasetPath)
+func (r *request) resolveNS(datasetPath string) (ns.ProviderInterface, error) {
+	nsProvider, err := r.resolver.resolve(datasetPath)
 	if err != nil {
-		humanizedErr := fmt.Errorf("Cannot resolve '%s' on any NexentaStor(s): %s", datasetPath, err)
-
-		// propagate NefError
-		nefCode := ns.GetNefErrorCode(err)
-		if nefCode != "" { // TODO add IsNefError() method
-			return nil, &ns.NefError{
-				Err:  humanizedErr,
-				Code: nefCode,
-			}
-		}
-
-		return nil, humanizedErr
+		return nil, humanizeResolveError(datasetPath, err)
 	}
 	return nsProvider, nil
 }
 
+func humanizeResolveError(datasetPath string, err error) error {
+	humanizedErr := fmt.Errorf("Cannot resolve '%s' on any NexentaStor(s): %s", datasetPath, err)
+
+	// propagate NefError
+	if ns.IsNefError(err) {
+		return &ns.NefError{
+			Err:  humanizedErr,
+			Code: ns.GetNefErrorCode(err),
+		}
+	}
+
+	return humanizedErr
+}
+
 // Capabilities returns plugin capabilities
 func (d *Driver) Capabilities() *volume.CapabilitiesResponse {
-	l := d.log.WithField("func", "Capabilities()")
+	r := d.newRequest("Capabilities()")
+	l := r.log
+	defer r.finish(nil)
 	l.Info("request")
 
 	return &volume.CapabilitiesResponse{
@@ -114,59 +231,190 @@ func (d *Driver) Capabilities() *volume.CapabilitiesResponse {
 }
 
 // Create Docker volume, created filesystem on NS
-func (d *Driver) Create(req *volume.CreateRequest) error {
-	l := d.log.WithField("func", "Create()")
+func (d *Driver) Create(req *volume.CreateRequest) (err error) {
+	r := d.newRequest("Create()")
+	l := r.log
 	l.Infof("request: '%+v'", req)
 
+	auditEvent := &audit.Event{
+		Action:    audit.ActionCreate,
+		RequestID: r.id,
+		Volume:    req.Name,
+		Options:   req.Options,
+	}
+	defer d.writeAudit(l, auditEvent, time.Now(), &err)
+	defer r.finish(&err)
+
+	if err := d.inFlight.enter(); err != nil {
+		return logError(l, err)
+	}
+	defer d.inFlight.leave()
+
 	volumeName := req.Name
 	if volumeName == "" {
 		return logError(l, fmt.Errorf("InvalidArgument: req.Name must be provided"))
 	}
 
-	if err := d.refreshConfig(); err != nil {
-		return logError(l, fmt.Errorf("FailedPrecondition: Cannot use config file: %s", err))
+	options, create, err := parseVolumeOptions(req.Options)
+	if err != nil {
+		return logError(l, fmt.Errorf("InvalidArgument: %s", err))
 	}
 
-	datasetPath := d.config.DefaultDataset
-	filesystemPath := filepath.Join(datasetPath, volumeName)
+	// volume is registered as an alias of a filesystem outside of plugin's dataset
+	if create.adoptPath != "" {
+		if err := d.createAlias(r, volumeName, create.adoptPath, options, create.requested, auditEvent); err != nil {
+			return logError(l, err)
+		}
+		if create.size != 0 {
+			err := r.resizeFilesystem(create.adoptPath, create.adoptPath, create.size, create.allowShrink)
+			if err != nil {
+				return logError(l, err)
+			}
+		}
+		l.Infof("done: volume '%s' is an alias of adopted NexentaStor filesystem '%s'", volumeName, create.adoptPath)
+		return nil
+	}
 
-	nsProvider, err := d.resolveNS(datasetPath)
+	properties, err := newManagedProperties(options)
+	if err != nil {
+		return logError(l, fmt.Errorf("InternalError: Cannot prepare filesystem user properties: %s", err))
+	}
+
+	datasetPath := r.config.DefaultDataset
+	filesystemPath, alias, err := r.getVolumePath(volumeName)
 	if err != nil {
 		return logError(l, err)
 	}
-	l.Infof("path '%s' resolved on %s NexentaStor", datasetPath, nsProvider)
+	auditEvent.Path = filesystemPath
+	if alias {
+		saved, err := r.getVolumeOptions(filesystemPath)
+		if err != nil {
+			return logError(l, err)
+		}
+		if err := checkRequestedOptions(volumeName, create.requested, saved); err != nil {
+			return logError(l, err)
+		}
+		if create.size != 0 {
+			if err := r.resizeFilesystem(filesystemPath, filesystemPath, create.size, create.allowShrink); err != nil {
+				return logError(l, err)
+			}
+		}
+		l.Infof("done: volume '%s' is already an alias of NexentaStor filesystem '%s'", volumeName, filesystemPath)
+		return nil
+	}
 
-	filesystemAlreadyExist := false
-	err = nsProvider.CreateFilesystem(ns.CreateFilesystemParams{Path: filesystemPath})
+	// filesystem created by the failed attempt exists on the new pool owner after failover,
+	// adopted filesystem is not created, it must exist
+	filesystemAlreadyExist := create.adoptInPlace
+	var createFilesystem func(ns.ProviderInterface) error
+	if !create.adoptInPlace {
+		createFilesystem = func(nsProvider ns.ProviderInterface) error {
+			err := nsProvider.CreateFilesystem(ns.CreateFilesystemParams{
+				Path:                filesystemPath,
+				ReferencedQuotaSize: create.size,
+			})
+			if ns.IsAlreadyExistNefError(err) {
+				filesystemAlreadyExist = true
+				return nil
+			}
+			return err
+		}
+	}
+	nsProvider, err := r.withRetry(datasetPath, createFilesystem)
+	if nsProvider == nil {
+		return logError(l, err)
+	}
+	l.Infof("path '%s' resolved on %s NexentaStor", datasetPath, nsProvider)
+	auditEvent.Node = fmt.Sprint(nsProvider)
 	if err != nil {
-		if ns.IsAlreadyExistNefError(err) {
-			filesystemAlreadyExist = true
-		} else {
+		return logError(l, fmt.Errorf(
+			"InternalError: Cannot create NexentaStor filesystem '%s' for volume '%s': %s",
+			filesystemPath,
+			volumeName,
+			err,
+		))
+	}
+
+	// filesystem created by this request is destroyed if it cannot be shared, so Create can be repeated
+	cleanup := func() {}
+	if !filesystemAlreadyExist {
+		cleanup = func() { r.destroyFilesystem(datasetPath, filesystemPath) }
+	}
+
+	// existing filesystem is marked as managed only if it's adopted explicitly
+	markFilesystem := !filesystemAlreadyExist
+	if filesystemAlreadyExist {
+		_, fsProperties, err := r.getFilesystemProperties(datasetPath, filesystemPath)
+		if create.adoptInPlace && ns.IsNotExistNefError(err) {
 			return logError(l, fmt.Errorf(
-				"InternalError: Cannot create NexentaStor filesystem '%s' for volume '%s': %s",
+				"NotFound: Cannot adopt NexentaStor filesystem '%s', it doesn't exist",
 				filesystemPath,
-				volumeName,
-				err,
 			))
+		} else if err != nil {
+			return logError(l, fmt.Errorf("InternalError: Cannot get filesystem '%s': %s", filesystemPath, err))
+		}
+		if !fsProperties.isManaged() {
+			if !create.adoptInPlace && r.config.ManagedVolumesOnly {
+				return logError(l, fmt.Errorf(
+					"AlreadyExists: NexentaStor filesystem '%s' is not managed by the plugin, "+
+						"use '-o %s=true' option to adopt it",
+					filesystemPath,
+					optionAdopt,
+				))
+			}
+			markFilesystem = create.adoptInPlace
+		}
+		if !markFilesystem {
+			saved, err := loadVolumeOptions(fsProperties)
+			if err != nil {
+				return logError(l, fmt.Errorf(
+					"FailedPrecondition: Cannot load options of filesystem '%s': %s",
+					filesystemPath,
+					err,
+				))
+			}
+			if err := checkRequestedOptions(volumeName, create.requested, saved); err != nil {
+				return logError(l, err)
+			}
+		}
+	}
+
+	if markFilesystem {
+		if err := r.setFilesystemProperties(datasetPath, filesystemPath, properties); err != nil {
+			cleanup()
+			return logError(l, err)
+		}
+	}
+
+	// existing volume is resized online, created filesystem already has the size
+	if filesystemAlreadyExist && create.size != 0 {
+		if err := r.resizeFilesystem(datasetPath, filesystemPath, create.size, create.allowShrink); err != nil {
+			return logError(l, err)
 		}
 	}
 
 	// get NexentaStor filesystem information
-	filesystem, err := nsProvider.GetFilesystem(filesystemPath)
+	filesystem, err := r.getFilesystem(datasetPath, filesystemPath)
 	if err != nil {
+		cleanup()
 		return logError(l, fmt.Errorf("InternalError: Cannot get filesystem '%s': %s", filesystemPath, err))
 	}
 
 	// check if NS filesystem is shared over NFS, create NFS share if it doesn't exist
 	if !filesystem.SharedOverNfs {
-		err := d.createNfsShare(nsProvider, filesystem)
+		err := r.createNfsShare(datasetPath, filesystem)
 		if err != nil {
+			cleanup()
 			return logError(l, err)
 		}
 		l.Infof("filesystem '%s' has been shared over NFS", filesystemPath)
 	}
 
-	if filesystemAlreadyExist {
+	d.volumeList.invalidate()
+
+	if create.adoptInPlace {
+		l.Infof("done: NexentaStor filesystem '%s' has been adopted for '%s' volume", filesystemPath, volumeName)
+	} else if filesystemAlreadyExist {
 		l.Infof(
 			"done: NexentaStor filesystem '%s' already exists and can be used for '%s' volume",
 			filesystemPath,
@@ -186,23 +434,37 @@ func (d *Driver) Create(req *volume.CreateRequest) error {
 // Remove removes Docker volume.
 // This method does NOT remove filesystem from NS, `docker volume list`
 // will still show the volume in the list while filesystem is shared on NS.
-func (d *Driver) Remove(req *volume.RemoveRequest) error {
-	l := d.log.WithField("func", "Remove()")
+func (d *Driver) Remove(req *volume.RemoveRequest) (err error) {
+	r := d.newRequest("Remove()")
+	l := r.log
 	l.Infof("request: '%+v'", req)
 
+	auditEvent := &audit.Event{Action: audit.ActionRemove, RequestID: r.id, Volume: req.Name}
+	defer d.writeAudit(l, auditEvent, time.Now(), &err)
+	defer r.finish(&err)
+
+	if err := d.inFlight.enter(); err != nil {
+		return logError(l, err)
+	}
+	defer d.inFlight.leave()
+
 	volumeName := req.Name
 	if volumeName == "" {
 		return logError(l, fmt.Errorf("InvalidArgument: req.Name must be provided"))
 	}
 
-	if err := d.refreshConfig(); err != nil {
-		return logError(l, fmt.Errorf("FailedPrecondition: Cannot use config file: %s", err))
-	}
+	filesystemPath, alias, nsProvider, filesystem, err := r.getVolumeFilesystem(volumeName)
+	auditEvent.Path = filesystemPath
 
-	datasetPath := d.config.DefaultDataset
-	filesystemPath := filepath.Join(datasetPath, volumeName)
+	// adopted filesystem is never destroyed, only the alias is removed, even if the filesystem doesn't exist
+	if alias {
+		if err := d.removeAlias(r, volumeName); err != nil {
+			return logError(l, err)
+		}
+		l.Infof("done: alias '%s' has been removed, filesystem '%s' is kept on NexentaStor", volumeName, filesystemPath)
+		return nil
+	}
 
-	nsProvider, err := d.resolveNS(filesystemPath)
 	if err != nil {
 		if ns.IsNotExistNefError(err) {
 			l.Infof("done: NexentaStor filesystem '%v' already doesn't exist, return OK response", filesystemPath)
@@ -211,46 +473,44 @@ func (d *Driver) Remove(req *volume.RemoveRequest) error {
 		return logError(l, err)
 	}
 	l.Infof("path '%s' resolved on %s NexentaStor", filesystemPath, nsProvider)
+	auditEvent.Node = fmt.Sprint(nsProvider)
+
+	// volume options are only reported, filesystem is kept
+	if options, err := loadVolumeOptions(filesystem); err != nil {
+		l.Warnf("cannot load options of volume '%s': %s", volumeName, err)
+	} else {
+		l.Infof("volume '%s' options: %v", volumeName, options)
+		auditEvent.Options = options
+	}
+
+	d.volumeList.invalidate()
 
 	l.Infof("done: return OK and keep filesystem '%s' on NexentaStor for further usage", filesystemPath)
 	return nil
 }
 
 // List lists all shared filesystems on NS as volumes
-func (d *Driver) List() (*volume.ListResponse, error) {
-	l := d.log.WithField("func", "List()")
+func (d *Driver) List() (res *volume.ListResponse, err error) {
+	r := d.newRequest("List()")
+	l := r.log
+	defer r.finish(&err)
 	l.Infof("request")
 
-	if err := d.refreshConfig(); err != nil {
-		return nil, logError(l, fmt.Errorf("FailedPrecondition: Cannot use config file: %s", err))
-	}
-
-	// a root of all driver's filesystem
-	datasetPath := d.config.DefaultDataset
-
-	nsProvider, err := d.resolveNS(datasetPath)
+	// names of filesystems shared over NFS in a root of all driver's filesystem
+	names, err := d.listVolumes(r)
 	if err != nil {
 		return nil, logError(l, err)
 	}
-	l.Infof("path '%s' resolved on %s NexentaStor", datasetPath, nsProvider)
-
-	filesystems, err := nsProvider.GetFilesystems(datasetPath)
-	if err != nil {
-		return nil, logError(l, fmt.Errorf("InternalError: Cannot get filesystems: %s", err))
-	}
 
 	volumes := []*volume.Volume{}
-	for _, fs := range filesystems {
-		if fs.SharedOverNfs {
-			name := strings.TrimPrefix(fs.Path, datasetPath+"/")
-			volumes = append(volumes, &volume.Volume{
-				Name: name,
-				// as docs says (https://docs.docker.com/v17.09/engine/extend/plugins_volume/#volumedriverlist)
-				// it's OK to return w\o MountPoint, in our case driver use mount + bind-mounts for each container
-				// and there is no way to say what is "Mountpoint" for particular Docker volume
-				//Mountpoint: filepath.Join(config.DriverMountPointsRoot, name),
-			})
-		}
+	for _, name := range names {
+		volumes = append(volumes, &volume.Volume{
+			Name: name,
+			// as docs says (https://docs.docker.com/v17.09/engine/extend/plugins_volume/#volumedriverlist)
+			// it's OK to return w\o MountPoint, in our case driver use mount + bind-mounts for each container
+			// and there is no way to say what is "Mountpoint" for particular Docker volume
+			//Mountpoint: filepath.Join(config.DriverMountPointsRoot, name),
+		})
 	}
 
 	l.Infof("done: found %d entries(s)", len(volumes))
@@ -260,8 +520,10 @@ func (d *Driver) List() (*volume.ListResponse, error) {
 }
 
 // Get volume by its name, find out if NS has this filesystem created
-func (d *Driver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
-	l := d.log.WithField("func", "Get()")
+func (d *Driver) Get(req *volume.GetRequest) (res *volume.GetResponse, err error) {
+	r := d.newRequest("Get()")
+	l := r.log
+	defer r.finish(&err)
 	l.Infof("request: '%+v'", req)
 
 	volumeName := req.Name
@@ -269,24 +531,15 @@ func (d *Driver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
 		return nil, logError(l, fmt.Errorf("InvalidArgument: req.Name must be provided"))
 	}
 
-	if err := d.refreshConfig(); err != nil {
-		return nil, logError(l, fmt.Errorf("FailedPrecondition: Cannot use config file: %s", err))
-	}
-
-	datasetPath := d.config.DefaultDataset
-	filesystemPath := filepath.Join(datasetPath, volumeName)
-
-	nsProvider, err := d.resolveNS(filesystemPath)
-	if err != nil {
+	filesystemPath, alias, nsProvider, filesystem, err := r.getVolumeFilesystem(volumeName)
+	if nsProvider == nil {
 		if ns.IsNotExistNefError(err) {
 			l.Infof("done: filesystem '%v' doesn't exist on NexentaStor, return empty response", filesystemPath)
 			return nil, nil
 		}
 		return nil, logError(l, err)
 	}
-	l.Infof("path '%s' resolved on %s NexentaStor", datasetPath, nsProvider)
-
-	filesystem, err := nsProvider.GetFilesystem(filesystemPath)
+	l.Infof("path '%s' resolved on %s NexentaStor", filesystemPath, nsProvider)
 	if err != nil {
 		return nil, logError(l, fmt.Errorf("InternalError: Cannot get filesystem '%s': %s", filesystemPath, err))
 	}
@@ -294,13 +547,44 @@ func (d *Driver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
 	if !filesystem.SharedOverNfs {
 		l.Infof(
 			"done: filesystem '%s' found on %s NexentaStor, but return empty response because it's not shared",
-			datasetPath,
+			filesystemPath,
 			nsProvider,
 		)
 		return nil, nil
 	}
 
-	l.Infof("done: filesystem '%s' was found for '%v' volume", filesystem.String(), volumeName)
+	if !filesystem.isManaged() && r.config.ManagedVolumesOnly {
+		l.Infof(
+			"done: filesystem '%s' found on %s NexentaStor, but return empty response because it's not managed",
+			filesystemPath,
+			nsProvider,
+		)
+		return nil, nil
+	}
+
+	options, err := loadVolumeOptions(filesystem)
+	if err != nil {
+		return nil, logError(l, fmt.Errorf(
+			"FailedPrecondition: Cannot load options of volume '%s': %s",
+			volumeName,
+			err,
+		))
+	}
+
+	// `docker volume inspect` shows driver options only on the host which created the volume
+	status := d.volumeStatus(volumeName)
+	if status == nil {
+		status = map[string]interface{}{}
+	}
+	status["options"] = options
+	if filesystem.ReferencedQuotaSize != 0 {
+		status["size"] = formatSize(filesystem.ReferencedQuotaSize)
+	}
+	if alias {
+		status["adoptedFilesystem"] = filesystemPath
+	}
+
+	l.Infof("done: filesystem '%s' was found for '%v' volume", filesystem.Path, volumeName)
 	return &volume.GetResponse{
 		Volume: &volume.Volume{
 			Name: volumeName,
@@ -308,13 +592,16 @@ func (d *Driver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
 			// it's OK to return w\o MountPoint, in our case driver use mount + bind-mounts for each container
 			// and there is no way to say what is "Mountpoint" for particular Docker volume
 			//Mountpoint: filepath.Join(config.DriverMountPointsRoot, volumeName),
+			Status: status,
 		},
 	}, nil
 }
 
 // Path returns volume mount point
-func (d *Driver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
-	l := d.log.WithField("func", "Path()")
+func (d *Driver) Path(req *volume.PathRequest) (res *volume.PathResponse, err error) {
+	r := d.newRequest("Path()")
+	l := r.log
+	defer r.finish(&err)
 	l.Infof("request: '%+v'", req)
 
 	volumeName := req.Name
@@ -337,24 +624,42 @@ func (d *Driver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
 // Mount mounts NS share to a Docker host, then bind-mounts this share to another folder for particular container.
 //
 // Working model:
-// NS share "S" <---> Docker host folder "H" (mount -t nfs S H) <--+--> Mount for container A (mount -o bind H A)
-//                                                                 |--> Mount for container B (mount -o bind H B)
-//                                                                 |--> Mount for container C (mount -o bind H C)
-//                                                                 `--> Mount for container D (mount -o bind H D)
+//
+//	NS share "S" <---> Docker host folder "H" (mount -t nfs S H) <--+--> Mount for container A (mount -o bind H A)
+//	                                                                |--> Mount for container B (mount -o bind H B)
+//	                                                                |--> Mount for container C (mount -o bind H C)
+//	                                                                `--> Mount for container D (mount -o bind H D)
 //
 // On host all 'mount' happen under:
-// /var/lib/docker/plugins/<PLUGIN_ID>/propagated-mount/volume/<VOLUME_NAME>              - mounted NS share
-// /var/lib/docker/plugins/<PLUGIN_ID>/propagated-mount/bind/<VOLUME_NAME>-<CONTAINER_ID> - bind container(s) to share
+//
+//	/var/lib/docker/plugins/<PLUGIN_ID>/propagated-mount/volume/<VOLUME_NAME>              - mounted NS share
+//	/var/lib/docker/plugins/<PLUGIN_ID>/propagated-mount/bind/<VOLUME_NAME>/<CONTAINER_ID> - bind container(s) to share
 //
 // Inside driver's container all 'mount' happen under:
-// /mnt/nexentastor-docker-volume-plugin/volume/<VOLUME_NAME>              - mounted NS share
-// /mnt/nexentastor-docker-volume-plugin/bind/<VOLUME_NAME>-<CONTAINER_ID> - bind container(s) to share
-// `/mnt/nexentastor-docker-volume-plugin` is a "propagatedmount" parameter in the `config.json`.
 //
-func (d *Driver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
-	l := d.log.WithField("func", "Mount()")
+//	/mnt/nexentastor-docker-volume-plugin/volume/<VOLUME_NAME>              - mounted NS share
+//	/mnt/nexentastor-docker-volume-plugin/bind/<VOLUME_NAME>/<CONTAINER_ID> - bind container(s) to share
+//
+// `/mnt/nexentastor-docker-volume-plugin` is a "propagatedmount" parameter in the `config.json`.
+func (d *Driver) Mount(req *volume.MountRequest) (res *volume.MountResponse, err error) {
+	r := d.newRequest("Mount()")
+	l := r.log
 	l.Infof("request: '%+v'", req)
 
+	auditEvent := &audit.Event{
+		Action:      audit.ActionMount,
+		RequestID:   r.id,
+		Volume:      req.Name,
+		ContainerID: req.ID,
+	}
+	defer d.writeAudit(l, auditEvent, time.Now(), &err)
+	defer r.finish(&err)
+
+	if err := d.inFlight.enter(); err != nil {
+		return nil, logError(l, err)
+	}
+	defer d.inFlight.leave()
+
 	volumeName := req.Name
 	if volumeName == "" {
 		return nil, logError(l, fmt.Errorf("InvalidArgument: req.Name must be provided"))
@@ -365,46 +670,85 @@ func (d *Driver) Mount(req *volume.MountRequest) (*volume.MountResponse, error)
 		return nil, logError(l, fmt.Errorf("InvalidArgument: req.ID must be provided"))
 	}
 
-	if err := d.refreshConfig(); err != nil {
-		return nil, logError(l, fmt.Errorf("FailedPrecondition: Cannot use config file: %s", err))
-	}
+	unlock := d.lockVolume(l, volumeName)
+	defer unlock()
 
-	datasetPath := d.config.DefaultDataset
-	filesystemPath := filepath.Join(datasetPath, volumeName)
+	auditEvent.Path = filepath.Join(r.config.DefaultDataset, volumeName)
 
-	nsProvider, err := d.resolveNS(filesystemPath)
-	if err != nil {
+	volumeMountPoint := getVolumeMountPoint(r.mountPointsRoot, volumeName) // path to mount NS filesystem
+
+	// fast path: volume is already mounted on the host and the mount is healthy, bind-mount it w/o NS requests,
+	// so new containers can start while NS REST API is unavailable, NFS share is checked in background
+	if existingMount, ok := d.getHealthyVolumeMount(r, volumeName); ok {
+		l.Infof("volume '%s' is already mounted to '%s', use it w/o NexentaStor requests", volumeName, volumeMountPoint)
+		auditEvent.Options = map[string]string{
+			"mountOptions": strings.Join(r.getMountOptions(existingMount.VolumeOptions...), ","),
+		}
+		auditEvent.Node = existingMount.Node
+		if existingMount.Filesystem != "" {
+			auditEvent.Path = existingMount.Filesystem
+		}
+		go d.checkVolumeShare(volumeName)
+
+		containerBindMountPoint, err := r.bindMountVolume(volumeName, containerID)
+		if err != nil {
+			return nil, logError(l, err)
+		}
+		return &volume.MountResponse{
+			Mountpoint: containerBindMountPoint,
+		}, nil
+	}
+
+	// volume may be an alias of a filesystem outside of plugin's dataset
+	filesystemPath, _, nsProvider, fsProperties, err := r.getVolumeFilesystem(volumeName)
+	auditEvent.Path = filesystemPath
+	if nsProvider == nil {
 		return nil, logError(l, err)
 	}
 	l.Infof("path '%s' resolved on %s NexentaStor", filesystemPath, nsProvider)
+	auditEvent.Node = fmt.Sprint(nsProvider)
+	if err != nil {
+		return nil, logError(l, fmt.Errorf("FailedPrecondition: Cannot get filesystem '%s': %s", filesystemPath, err))
+	}
+
+	// volume options are saved on NS by Create, so the volume is mounted the same way on any host
+	options, err := loadVolumeOptions(fsProperties)
+	if err != nil {
+		return nil, logError(l, fmt.Errorf(
+			"FailedPrecondition: Cannot load options of filesystem '%s': %s",
+			filesystemPath,
+			err,
+		))
+	}
 
 	// get NexentaStor filesystem information
-	filesystem, err := nsProvider.GetFilesystem(filesystemPath)
+	filesystem, err := r.getFilesystem(filesystemPath, filesystemPath)
 	if err != nil {
 		return nil, logError(l, fmt.Errorf("FailedPrecondition: Cannot get filesystem '%s': %s", filesystemPath, err))
 	}
+	mountOptions := r.getMountOptions(options.mountOptions()...)
+	auditEvent.Options = map[string]string{"mountOptions": strings.Join(mountOptions, ",")}
 
 	// check if NS filesystem is shared over NFS, create NFS share if it doesn't exist
 	if !filesystem.SharedOverNfs {
-		err := d.createNfsShare(nsProvider, filesystem)
+		err := r.createNfsShare(filesystemPath, filesystem)
 		if err != nil {
 			return nil, logError(l, err)
 		}
 	}
 
-	dataIP := d.config.DefaultDataIP
-	volumeMountPoint := getVolumeMountPoint(volumeName) // path inside driver's container to mount NS filesystem
-
-	//TODO get mount options from runtime params, set default if not specified?
-	mountOptions := []string{}
-	for _, option := range strings.Split(d.config.DefaultMountOptions, ",") {
-		if option != "" {
-			mountOptions = append(mountOptions, option)
-		}
-	}
+	dataIP := r.config.DefaultDataIP
 
 	// mount filesystem to volume mount point
-	err = d.mountNFSShare(filesystem, dataIP, volumeMountPoint, mountOptions)
+	err = r.mountNFSShare(
+		volumeName,
+		auditEvent.Node,
+		filesystem,
+		dataIP,
+		volumeMountPoint,
+		mountOptions,
+		options.mountOptions(),
+	)
 	if err != nil {
 		return nil, logError(l, err)
 	}
@@ -415,26 +759,27 @@ func (d *Driver) Mount(req *volume.MountRequest) (*volume.MountResponse, error)
 		volumeMountPoint,
 	)
 
-	// bind mount volume mount to a container specific mount
-	containerBindMountPoint := getContainerBindMountPath(volumeName, containerID)
-	err = d.mounter.BindMount(volumeMountPoint, containerBindMountPoint)
+	r.setVolumeOwner(options, volumeMountPoint)
+
+	containerBindMountPoint, err := r.bindMountVolume(volumeName, containerID)
 	if err != nil {
 		return nil, logError(l, err)
 	}
 
-	l.Infof(
-		"done: volume mount point '%s' has been bind-mounted to container mount point '%s'",
-		volumeMountPoint,
-		containerBindMountPoint,
-	)
 	return &volume.MountResponse{
 		Mountpoint: containerBindMountPoint,
 	}, nil
 }
 
-func (d *Driver) mountNFSShare(filesystem ns.Filesystem, dataIP, targetPath string, mountOptions []string) error {
-	// NFS style mount source
-	mountSource := getNFSMountSource(dataIP, filesystem.MountPoint)
+// getMountOptions returns NFS mount options: config ones, volume ones and defaults for options not set by user
+func (r *request) getMountOptions(volumeMountOptions ...string) []string {
+	mountOptions := []string{}
+	for _, option := range strings.Split(r.config.DefaultMountOptions, ",") {
+		if option != "" {
+			mountOptions = append(mountOptions, option)
+		}
+	}
+	mountOptions = append(mountOptions, volumeMountOptions...)
 
 	// NFS v3 is used by default if no version specified by user
 	mountOptions = arrays.AppendIfRegexpNotExistString(mountOptions, regexpMountOptionVers, "vers=3")
@@ -442,58 +787,200 @@ func (d *Driver) mountNFSShare(filesystem ns.Filesystem, dataIP, targetPath stri
 	// NFS option `timeo=100` is used by default if not specified by user
 	mountOptions = arrays.AppendIfRegexpNotExistString(mountOptions, regexpMountOptionTimeo, "timeo=100")
 
+	return mountOptions
+}
+
+// bindMountVolume bind-mounts volume mount to a container specific mount, returns container mount point
+func (r *request) bindMountVolume(volumeName, containerID string) (string, error) {
+	volumeMountPoint := getVolumeMountPoint(r.mountPointsRoot, volumeName)
+	containerBindMountPoint := getContainerBindMountPath(r.mountPointsRoot, volumeName, containerID)
+	if err := r.mounter.BindMount(volumeMountPoint, containerBindMountPoint); err != nil {
+		return "", err
+	}
+
+	err := r.state.AddBind(volumeName, containerID, state.Bind{
+		Path:      containerBindMountPoint,
+		MountedAt: time.Now(),
+	})
+	if err != nil {
+		r.log.Warnf("cannot save container bind mount to the state: %s", err)
+	}
+
+	r.log.Infof(
+		"done: volume mount point '%s' has been bind-mounted to container mount point '%s'",
+		volumeMountPoint,
+		containerBindMountPoint,
+	)
+	return containerBindMountPoint, nil
+}
+
+// getHealthyVolumeMount returns volume mount from the state if it has all mount options required by the config
+// and the volume options saved in the state, and its mount point responds now, volume lock must be held
+func (d *Driver) getHealthyVolumeMount(r *request, volumeName string) (state.Volume, bool) {
+	existingMount, ok := r.state.GetVolume(volumeName)
+	if !ok {
+		return state.Volume{}, false
+	}
+
+	mountOptions := r.getMountOptions(existingMount.VolumeOptions...)
+	if missedOptions := missedMountOptions(existingMount.Options, mountOptions); len(missedOptions) != 0 {
+		r.log.Debugf("existing mount of '%s' misses mount options %v, don't use it", volumeName, missedOptions)
+		return state.Volume{}, false
+	}
+
+	timeout := time.Duration(r.config.HealthCheckTimeout) * time.Second
+	result := d.health.check(volumeName, existingMount.MountPoint, timeout)
+	d.health.set(volumeName, result)
+	if result.Status != healthOK {
+		r.log.Warnf(
+			"existing mount '%s' of '%s' is %s (%s), get filesystem from NexentaStor",
+			existingMount.MountPoint,
+			volumeName,
+			result.Status,
+			result.Error,
+		)
+		return state.Volume{}, false
+	}
+
+	return existingMount, true
+}
+
+// checkVolumeShare makes sure that filesystem of the volume mounted by the fast path is still shared over NFS,
+// it runs in background after the Mount response, errors are logged only
+func (d *Driver) checkVolumeShare(volumeName string) {
+	r := d.newRequest("checkVolumeShare()")
+	defer r.finish(nil)
+
+	if err := d.inFlight.enter(); err != nil {
+		r.log.Infof("skip NFS share check of volume '%s': %s", volumeName, err)
+		return
+	}
+	defer d.inFlight.leave()
+
+	filesystemPath, _, err := r.getVolumePath(volumeName)
+	if err != nil {
+		r.log.Warnf("cannot check NFS share of mounted volume '%s': %s", volumeName, err)
+		return
+	}
+
+	filesystem, err := r.getFilesystem(filesystemPath, filesystemPath)
+	if err != nil {
+		r.log.Warnf("cannot check NFS share of mounted volume '%s': %s", volumeName, err)
+		return
+	}
+
+	if filesystem.SharedOverNfs {
+		r.log.Debugf("filesystem '%s' of mounted volume '%s' is shared over NFS", filesystemPath, volumeName)
+		return
+	}
+
+	if err := r.createNfsShare(filesystemPath, filesystem); err != nil {
+		r.log.Errorf("filesystem '%s' of mounted volume '%s' is not shared over NFS: %s", filesystemPath, volumeName, err)
+		return
+	}
+	r.log.Infof("filesystem '%s' of mounted volume '%s' has been shared over NFS again", filesystemPath, volumeName)
+}
+
+// missedMountOptions returns required options which existing mount doesn't have
+func missedMountOptions(existingOptions, mountOptions []string) []string {
+	missedOptions := []string{}
+	for _, o := range mountOptions {
+		// treat vers=4 and vers=4.0 as same versions
+		if !arrays.ContainsString(existingOptions, o) && !arrays.ContainsString(existingOptions, o+".0") {
+			missedOptions = append(missedOptions, o)
+		}
+	}
+	return missedOptions
+}
+
+// mountNFSShare mounts NS filesystem to the volume mount point and saves it to the state with the volume options
+// saved on NS, volume mount from the state is used if it has all required mount options
+func (r *request) mountNFSShare(
+	volumeName, node string,
+	filesystem ns.Filesystem,
+	dataIP, targetPath string,
+	mountOptions, volumeMountOptions []string,
+) error {
+	// NFS style mount source
+	mountSource := getNFSMountSource(dataIP, filesystem.MountPoint)
+
 	// check if this filesystem is already mounted on the host
 	// validate if this mount can be used within another container (has same source, target and options)
-	existingMount, err := d.mounter.FindMountByTargetPath(targetPath)
-	if err != nil {
-		return err
-	} else if existingMount != nil {
-		d.log.Debugf("existing mount found: %+v", existingMount)
+	if existingMount, ok := r.state.GetVolume(volumeName); ok {
+		r.log.Debugf("existing mount found in the state: %+v", existingMount)
 
 		// TODO this is does not work if user changes fs mount point on NS side
-		// if existingMount.Device != mountSource {
+		// if existingMount.Source != mountSource {
 		// 	return fmt.Errorf(
 		// 		"Mount point '%s' already exists and cannot be used for a new container, "+
 		// 			"because mount sources are different. Needed: '%s', already mounted: '%s'",
 		// 		targetPath,
 		// 		mountSource,
-		// 		existingMount.Device,
+		// 		existingMount.Source,
 		// 	)
 		// }
 
 		// compare mount options
-		missedOptions := []string{}
-		for _, o := range mountOptions {
-			// treat vers=4 and vers=4.0 as same versions
-			if !arrays.ContainsString(existingMount.Opts, o) && !arrays.ContainsString(existingMount.Opts, o+".0") {
-				missedOptions = append(missedOptions, o)
-			}
-		}
-		if len(missedOptions) != 0 {
+		if missedOptions := missedMountOptions(existingMount.Options, mountOptions); len(missedOptions) != 0 {
 			return fmt.Errorf(
 				"Mount '%s' (source: '%s') already exists, but cannot be used within the new container, "+
 					"following mount options are missed: %v",
 				targetPath,
-				mountSource,
+				existingMount.Source,
 				missedOptions,
 			)
 		}
 
-		d.log.Infof(
+		r.log.Infof(
 			"mount point '%s' (source: '%s') already exists and can be used within the new container",
 			targetPath,
-			mountSource,
+			existingMount.Source,
 		)
 		return nil
 	}
 
-	return d.mounter.Mount(mountSource, targetPath, config.FsTypeNFS, mountOptions)
+	err := r.mounter.Mount(mountSource, targetPath, config.FsTypeNFS, mountOptions)
+	if err != nil {
+		return err
+	}
+
+	err = r.state.SetVolume(volumeName, state.Volume{
+		Filesystem:    filesystem.Path,
+		Source:        mountSource,
+		Options:       mountOptions,
+		VolumeOptions: volumeMountOptions,
+		Node:          node,
+		MountPoint:    targetPath,
+		MountedAt:     time.Now(),
+	})
+	if err != nil {
+		r.log.Warnf("cannot save volume mount to the state: %s", err)
+	}
+
+	return nil
 }
 
-// createNfsShare creates filesystem share on NS, sets up ACL for it
-func (d *Driver) createNfsShare(nsProvider ns.ProviderInterface, filesystem ns.Filesystem) error {
-	err := nsProvider.CreateNfsShare(ns.CreateNfsShareParams{
-		Filesystem: filesystem.Path,
+// getFilesystem returns filesystem from NS node resolved by the path, retries on HA failover
+func (r *request) getFilesystem(resolvePath, filesystemPath string) (filesystem ns.Filesystem, err error) {
+	_, err = r.withRetry(resolvePath, func(nsProvider ns.ProviderInterface) (err error) {
+		filesystem, err = nsProvider.GetFilesystem(filesystemPath)
+		return err
+	})
+	return filesystem, err
+}
+
+// createNfsShare creates filesystem share on NS node resolved by the path, sets up ACL for it.
+// Both requests are retried on transient errors, share is deleted if ACL cannot be set,
+// so the filesystem is not left shared w/o ACL and will be shared again by the next request.
+func (r *request) createNfsShare(resolvePath string, filesystem ns.Filesystem) error {
+	_, err := r.withRetry(resolvePath, func(nsProvider ns.ProviderInterface) error {
+		err := nsProvider.CreateNfsShare(ns.CreateNfsShareParams{
+			Filesystem: filesystem.Path,
+		})
+		if ns.IsAlreadyExistNefError(err) { // created by the previous attempt
+			return nil
+		}
+		return err
 	})
 	if err != nil {
 		return fmt.Errorf("InternalError: Cannot share filesystem '%s' over NFS: %s", filesystem.Path, err)
@@ -509,19 +996,66 @@ func (d *Driver) createNfsShare(nsProvider ns.ProviderInterface, filesystem ns.F
 	// }
 
 	// apply NS filesystem ACL (gets applied only for new shares, not for already shared filesystems)
-	err = nsProvider.SetFilesystemACL(filesystem.Path, aclRuleSet)
+	_, err = r.withRetry(resolvePath, func(nsProvider ns.ProviderInterface) error {
+		return nsProvider.SetFilesystemACL(filesystem.Path, aclRuleSet)
+	})
 	if err != nil {
+		_, deleteErr := r.withRetry(resolvePath, func(nsProvider ns.ProviderInterface) error {
+			err := nsProvider.DeleteNfsShare(filesystem.Path)
+			if ns.IsNotExistNefError(err) {
+				return nil
+			}
+			return err
+		})
+		if deleteErr != nil {
+			r.log.Warnf("cannot delete NFS share of '%s' w/o ACL: %s", filesystem.Path, deleteErr)
+		}
 		return fmt.Errorf("InternalError: Cannot set filesystem ACL for '%s': %s", filesystem.Path, err)
 	}
 
 	return nil
 }
 
+// destroyFilesystem destroys filesystem created by a failed request, errors are logged only
+func (r *request) destroyFilesystem(resolvePath, filesystemPath string) {
+	_, err := r.withRetry(resolvePath, func(nsProvider ns.ProviderInterface) error {
+		err := nsProvider.DestroyFilesystem(filesystemPath, ns.DestroyFilesystemParams{})
+		if ns.IsNotExistNefError(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		r.log.Warnf("cannot destroy filesystem '%s' created by failed request: %s", filesystemPath, err)
+		return
+	}
+	r.log.Infof("filesystem '%s' created by failed request has been destroyed", filesystemPath)
+}
+
 // Unmount un-mounts container bind-mount and also un-mounts NS filesystem mount if no one is using it
-func (d *Driver) Unmount(req *volume.UnmountRequest) error {
-	l := d.log.WithField("func", "Unmount()")
+func (d *Driver) Unmount(req *volume.UnmountRequest) (err error) {
+	r := d.newRequest("Unmount()")
+	l := r.log
 	l.Infof("request: '%+v'", req)
 
+	auditEvent := &audit.Event{
+		Action:      audit.ActionUnmount,
+		RequestID:   r.id,
+		Volume:      req.Name,
+		ContainerID: req.ID,
+		Path:        filepath.Join(r.config.DefaultDataset, req.Name),
+	}
+	if mountedVolume, ok := r.state.GetVolume(req.Name); ok && mountedVolume.Filesystem != "" {
+		auditEvent.Path = mountedVolume.Filesystem // adopted filesystem of an alias volume
+	}
+	defer d.writeAudit(l, auditEvent, time.Now(), &err)
+	defer r.finish(&err)
+
+	if err := d.inFlight.enter(); err != nil {
+		return logError(l, err)
+	}
+	defer d.inFlight.leave()
+
 	volumeName := req.Name
 	if volumeName == "" {
 		return logError(l, fmt.Errorf("InvalidArgument: req.Name must be provided"))
@@ -532,39 +1066,55 @@ func (d *Driver) Unmount(req *volume.UnmountRequest) error {
 		return logError(l, fmt.Errorf("InvalidArgument: req.ID must be provided"))
 	}
 
-	if err := d.refreshConfig(); err != nil {
-		return logError(l, fmt.Errorf("FailedPrecondition: Cannot use config file: %s", err))
-	}
+	unlock := d.lockVolume(l, volumeName)
+	defer unlock()
 
-	containerBindMountPoint := getContainerBindMountPath(volumeName, containerID)
+	// bind mount path is taken from the state, it may be in the layout of a previous plugin version
+	containerBindMountPoint := getContainerBindMountPath(r.mountPointsRoot, volumeName, containerID)
+	if mountedVolume, ok := r.state.GetVolume(volumeName); ok {
+		if bind, ok := mountedVolume.Binds[containerID]; ok && bind.Path != "" {
+			containerBindMountPoint = bind.Path
+		}
+	}
 
 	// unmount volume to container bind-mount
-	err := d.mounter.Unmount(containerBindMountPoint)
+	err = r.mounter.Unmount(containerBindMountPoint)
 	if err != nil {
 		return logError(l, err)
 	}
 	l.Infof("container bind-mount '%s' has been unmounted", containerBindMountPoint)
 
+	// remove volume's bind mounts directory if it was the last one, it fails if directory is not empty
+	if bindsDir := filepath.Dir(containerBindMountPoint); bindsDir != getContainerBindMountsRoot(r.mountPointsRoot) {
+		os.Remove(bindsDir)
+	}
+
 	// check if any other containers use this volume mount point
-	volumeMountPoint := getVolumeMountPoint(volumeName) // path inside driver's container to mount NS filesystem
+	volumeMountPoint := getVolumeMountPoint(r.mountPointsRoot, volumeName) // path to mount NS filesystem
 
-	// check if volume bind mount(s) still exists, that means other container(s) use them
-	volumeBindMounts, err := d.mounter.FindMountByTargetPathHasPrefix(getContainerBindMountPath(volumeName, ""))
-	if err != nil {
-		return logError(l, err)
+	if _, ok := r.state.GetVolume(volumeName); !ok {
+		l.Warnf("done: volume '%s' is not in the state, keep '%s' as is", volumeName, volumeMountPoint)
+		return nil
 	}
 
-	bindVolumeMountCount := len(volumeBindMounts)
-	l.Infof("found %d bind mount(s) that mounted to '%s' source", bindVolumeMountCount, volumeMountPoint)
+	// check if volume bind mount(s) still exist in the state, that means other container(s) use them
+	bindVolumeMountCount, err := r.state.RemoveBind(volumeName, containerID)
+	if err != nil {
+		l.Warnf("cannot save container bind mount removal to the state: %s", err)
+	}
+	l.Infof("found %d bind mount(s) of '%s' in the state", bindVolumeMountCount, volumeMountPoint)
 
 	if bindVolumeMountCount == 0 {
 		// this is the last mount of this filesystem share, therefore no container uses it,
 		// filesystem can be finally unmounted
 		l.Infof("no containers use '%s' mount point, attempt to unmount it", volumeMountPoint)
-		err := d.mounter.Unmount(volumeMountPoint)
+		err := r.mounter.Unmount(volumeMountPoint)
 		if err != nil {
 			return logError(l, err)
 		}
+		if err := r.state.RemoveVolume(volumeName); err != nil {
+			l.Warnf("cannot save volume unmount to the state: %s", err)
+		}
 		l.Infof("done: volume '%s' has been unmounted", volumeMountPoint)
 	} else {
 		l.Infof(
@@ -577,17 +1127,87 @@ func (d *Driver) Unmount(req *volume.UnmountRequest) error {
 	return nil
 }
 
+// lockVolume acquires the volume lock, returns a function to release it
+func (d *Driver) lockVolume(l *logrus.Entry, volumeName string) func() {
+	startTime := time.Now()
+	d.volumeLocks.LockKey(volumeName)
+	if waitTime := time.Since(startTime); waitTime > time.Second {
+		l.Infof("volume '%s' lock acquired in %s", volumeName, waitTime)
+	}
+
+	return func() {
+		d.volumeLocks.UnlockKey(volumeName)
+	}
+}
+
+// tryLockVolume acquires the volume lock if it's released within the timeout, returns a function to release it
+// or nil if the lock is still held by another request
+func (d *Driver) tryLockVolume(volumeName string, timeout time.Duration) func() {
+	locked := make(chan struct{})
+	abandoned := make(chan struct{})
+	go func() {
+		d.volumeLocks.LockKey(volumeName)
+		select {
+		case locked <- struct{}{}:
+		case <-abandoned:
+			d.volumeLocks.UnlockKey(volumeName)
+		}
+	}()
+
+	select {
+	case <-locked:
+		return func() {
+			d.volumeLocks.UnlockKey(volumeName)
+		}
+	case <-time.After(timeout):
+		close(abandoned)
+		return nil
+	}
+}
+
+// writeAudit writes volume lifecycle event to the audit log, audit failures don't fail the request
+func (d *Driver) writeAudit(l *logrus.Entry, event *audit.Event, startTime time.Time, err *error) {
+	writeAudit(d.audit, l, event, startTime, err)
+}
+
+// writeAudit is also used by admin commands which run w/o driver
+func writeAudit(auditLog *audit.Logger, l *logrus.Entry, event *audit.Event, startTime time.Time, err *error) {
+	if auditErr := auditLog.Write(event, startTime, *err); auditErr != nil {
+		l.Warnf("cannot write audit event: %s", auditErr)
+	}
+}
+
+// collectMountedVolumes returns count of NS filesystems mounted on the host for metrics
+func (d *Driver) collectMountedVolumes() map[string]float64 {
+	return map[string]float64{metrics.Join(): float64(len(d.state.Volumes()))}
+}
+
+// collectBindMounts returns container bind mounts count by volume name for metrics
+func (d *Driver) collectBindMounts() map[string]float64 {
+	values := map[string]float64{}
+	for name, volume := range d.state.Volumes() {
+		values[metrics.Join(name)] = float64(len(volume.Binds))
+	}
+	return values
+}
+
 // getVolumeMountPoint is a path inside driver's container:
 // /mnt/nexentastor-docker-volume-plugin/volume/<VOLUME_NAME>
-func getVolumeMountPoint(volumeName string) string {
-	return filepath.Join(config.PluginMountPointsRoot, "volume", volumeName)
+func getVolumeMountPoint(mountPointsRoot, volumeName string) string {
+	return filepath.Join(mountPointsRoot, "volume", volumeName)
+}
+
+// getContainerBindMountsRoot is a path inside driver's container:
+// /mnt/nexentastor-docker-volume-plugin/bind
+func getContainerBindMountsRoot(mountPointsRoot string) string {
+	return filepath.Join(mountPointsRoot, "bind")
 }
 
 // getContainerBindMountPath is a path inside driver's container:
-// /mnt/nexentastor-docker-volume-plugin/bind/<CONTAINER_ID>-<VOLUME_NAME>
-func getContainerBindMountPath(volumeName, containerID string) string {
-	mountPointName := fmt.Sprintf("%s-%s", volumeName, containerID)
-	return filepath.Join(config.PluginMountPointsRoot, "bind", mountPointName)
+// /mnt/nexentastor-docker-volume-plugin/bind/<VOLUME_NAME>/<CONTAINER_ID>
+// volume directory makes bind mounts of volumes with common name prefix ("app" and "app-db") distinguishable
+func getContainerBindMountPath(mountPointsRoot, volumeName, containerID string) string {
+	return filepath.Join(getContainerBindMountsRoot(mountPointsRoot), volumeName, containerID)
 }
 
 // getNFSMountSource return NFS mount source to use in `mount` command
@@ -596,8 +1216,11 @@ func getNFSMountSource(address, path string) string {
 	return fmt.Sprintf("%s:/%s", address, strings.TrimPrefix(path, "/"))
 }
 
-// logError logs and returns the same error
+// logError logs the error and returns it with request ID if the logger is request scoped
 func logError(l *logrus.Entry, err error) error {
 	l.Error(err)
+	if id, ok := l.Data[requestIDField]; ok {
+		return withRequestID(err, id)
+	}
 	return err
 }
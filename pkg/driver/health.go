@@ -0,0 +1,326 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/metrics"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/state"
+)
+
+// volume mount health statuses
+const (
+	healthOK      = "ok"
+	healthStale   = "stale"   // ESTALE: filesystem was rolled back, re-shared or its mount point changed on NS
+	healthTimeout = "timeout" // NFS server doesn't respond
+	healthError   = "error"   // any other error
+)
+
+// config is re-read with this interval while health check is disabled
+const healthCheckDisabledPollInterval = 30 * time.Second
+
+// volumeHealth - last health check result of a volume mount
+type volumeHealth struct {
+	Status    string
+	Error     string
+	CheckedAt time.Time
+}
+
+// healthChecker keeps volume mounts health check results
+type healthChecker struct {
+	mu       sync.Mutex
+	results  map[string]volumeHealth // volume name -> last result
+	inFlight map[string]bool         // volumes with not finished (hung) check, it's not started again
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{
+		results:  map[string]volumeHealth{},
+		inFlight: map[string]bool{},
+	}
+}
+
+// get returns last health check result of the volume
+func (h *healthChecker) get(name string) (volumeHealth, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result, ok := h.results[name]
+	return result, ok
+}
+
+// set saves health check result, returns the previous one
+func (h *healthChecker) set(name string, result volumeHealth) volumeHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prev := h.results[name]
+	h.results[name] = result
+	return prev
+}
+
+// forget removes results of volumes which are not mounted anymore
+func (h *healthChecker) forget(volumes map[string]state.Volume) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for name := range h.results {
+		if _, ok := volumes[name]; !ok {
+			delete(h.results, name)
+		}
+	}
+}
+
+// check reads volume mount point with timeout, hung check is not repeated until it returns
+func (h *healthChecker) check(name, mountPoint string, timeout time.Duration) volumeHealth {
+	result := volumeHealth{CheckedAt: time.Now()}
+
+	h.mu.Lock()
+	if h.inFlight[name] {
+		h.mu.Unlock()
+		result.Status = healthTimeout
+		result.Error = "previous health check of the mount point is not finished yet"
+		return result
+	}
+	h.inFlight[name] = true
+	h.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := readMountPoint(mountPoint)
+		h.mu.Lock()
+		delete(h.inFlight, name)
+		h.mu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			result.Status = healthOK
+		} else if isStaleError(err) {
+			result.Status = healthStale
+			result.Error = err.Error()
+		} else {
+			result.Status = healthError
+			result.Error = err.Error()
+		}
+	case <-time.After(timeout):
+		result.Status = healthTimeout
+		result.Error = "mount point doesn't respond in " + timeout.String()
+	}
+
+	return result
+}
+
+// readMountPoint stats mount point and reads its first entry, both requests go to NFS server
+func readMountPoint(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+func isStaleError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err == syscall.ESTALE
+	case *os.SyscallError:
+		return e.Err == syscall.ESTALE
+	}
+	return err == syscall.ESTALE
+}
+
+// StartHealthCheck runs volume mounts health check in background until the stop channel is closed,
+// check interval and timeout are read from the current config before each check
+func (d *Driver) StartHealthCheck(stop <-chan struct{}) {
+	go func() {
+		for {
+			interval := time.Duration(d.snapshot().config.HealthCheckInterval) * time.Second
+			wait := interval
+			if interval == 0 {
+				wait = healthCheckDisabledPollInterval
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+
+			if interval > 0 {
+				d.checkVolumesHealth()
+			}
+		}
+	}()
+}
+
+// checkVolumesHealth checks all mounted volumes in parallel,
+// stale mount is remounted if no container uses it, otherwise the failure is reported
+func (d *Driver) checkVolumesHealth() {
+	l := d.log.WithField("func", "checkVolumesHealth()")
+
+	timeout := time.Duration(d.snapshot().config.HealthCheckTimeout) * time.Second
+	volumes := d.state.Volumes()
+	d.health.forget(volumes)
+
+	var wg sync.WaitGroup
+	for name, volume := range volumes {
+		wg.Add(1)
+		go func(name string, volume state.Volume) {
+			defer wg.Done()
+
+			result := d.health.check(name, volume.MountPoint, timeout)
+			prev := d.health.set(name, result)
+
+			if result.Status == healthOK {
+				if prev.Status != "" && prev.Status != healthOK {
+					l.Infof("volume '%s' mount '%s' is healthy again", name, volume.MountPoint)
+				}
+				return
+			}
+
+			if len(volume.Binds) == 0 {
+				l.Warnf(
+					"volume '%s' mount '%s' is %s (%s) and not used by containers, remount it",
+					name,
+					volume.MountPoint,
+					result.Status,
+					result.Error,
+				)
+				d.remountVolume(name)
+				return
+			}
+
+			containerIDs := []string{}
+			for containerID := range volume.Binds {
+				containerIDs = append(containerIDs, containerID)
+			}
+			logFunc := l.Debugf
+			if prev.Status != result.Status {
+				logFunc = l.Errorf
+			}
+			logFunc(
+				"volume '%s' mount '%s' is %s (%s), containers using it need to be restarted: %v",
+				name,
+				volume.MountPoint,
+				result.Status,
+				result.Error,
+				containerIDs,
+			)
+		}(name, volume)
+	}
+	wg.Wait()
+}
+
+// remountVolume unmounts not used volume mount and mounts it again with current NS filesystem mount point
+func (d *Driver) remountVolume(name string) {
+	r := d.newRequest("remountVolume()")
+	l := r.log
+	defer r.finish(nil)
+
+	if err := d.inFlight.enter(); err != nil {
+		l.Infof("skip remount of volume '%s': %s", name, err)
+		return
+	}
+	defer d.inFlight.leave()
+
+	unlock := d.lockVolume(l, name)
+	defer unlock()
+
+	volume, ok := r.state.GetVolume(name)
+	if !ok || len(volume.Binds) != 0 {
+		l.Infof("volume '%s' is unmounted or used by a container already, skip remount", name)
+		return
+	}
+
+	// filesystem mount point may be changed on NS, use the current one if NS is available,
+	// volume recovered from the mount table has no filesystem path in the state
+	source := volume.Source
+	filesystemPath, err := volume.Filesystem, error(nil)
+	if filesystemPath == "" {
+		filesystemPath, _, err = r.getVolumePath(name)
+	}
+	if err != nil {
+		l.Warnf("cannot get filesystem of volume '%s', remount with previous source '%s': %s", name, source, err)
+	} else if nsProvider, err := r.resolveNS(filesystemPath); err != nil {
+		l.Warnf("cannot resolve '%s', remount with previous source '%s': %s", filesystemPath, source, err)
+	} else if filesystem, err := nsProvider.GetFilesystem(filesystemPath); err != nil {
+		l.Warnf("cannot get filesystem '%s', remount with previous source '%s': %s", filesystemPath, source, err)
+	} else {
+		source = getNFSMountSource(r.config.DefaultDataIP, filesystem.MountPoint)
+		volume.Node = fmt.Sprint(nsProvider)
+		volume.Filesystem = filesystemPath
+	}
+
+	if err := r.mounter.Unmount(volume.MountPoint); err != nil {
+		metrics.VolumeRemounts.Inc("error")
+		l.Errorf("cannot unmount volume '%s' to remount it: %s", name, err)
+		return
+	}
+
+	if err := r.mounter.Mount(source, volume.MountPoint, config.FsTypeNFS, volume.Options); err != nil {
+		metrics.VolumeRemounts.Inc("error")
+		l.Errorf("cannot mount volume '%s' again, remove it from the state: %s", name, err)
+		if err := r.state.RemoveVolume(name); err != nil {
+			l.Warnf("cannot save volume unmount to the state: %s", err)
+		}
+		return
+	}
+
+	volume.Source = source
+	volume.MountedAt = time.Now()
+	if err := r.state.SetVolume(name, volume); err != nil {
+		l.Warnf("cannot save remounted volume to the state: %s", err)
+	}
+
+	d.health.set(name, volumeHealth{Status: healthOK, CheckedAt: time.Now()})
+	metrics.VolumeRemounts.Inc("ok")
+	l.Infof("volume '%s' has been remounted from '%s'", name, source)
+}
+
+// volumeStatus returns volume mount health for `docker volume inspect`, nil if volume is not mounted
+func (d *Driver) volumeStatus(name string) map[string]interface{} {
+	result, ok := d.health.get(name)
+	if !ok {
+		return nil
+	}
+
+	status := map[string]interface{}{
+		"mountHealth":          result.Status,
+		"mountHealthCheckedAt": result.CheckedAt.UTC().Format(time.RFC3339),
+	}
+	if result.Error != "" {
+		status["mountHealthError"] = result.Error
+	}
+	return status
+}
+
+// collectVolumeMountHealth returns last health check results by volume name for metrics
+func (d *Driver) collectVolumeMountHealth() map[string]float64 {
+	d.health.mu.Lock()
+	defer d.health.mu.Unlock()
+
+	values := map[string]float64{}
+	for name, result := range d.health.results {
+		value := 0.0
+		if result.Status == healthOK {
+			value = 1
+		}
+		values[metrics.Join(name)] = value
+	}
+	return values
+}
@@ -0,0 +1,247 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// filesystems count to fetch by one request of List, each page is retried separately
+const listPageSize = 500
+
+// config is re-read with this interval while volume list refresher is disabled
+const listRefreshDisabledPollInterval = 30 * time.Second
+
+// listedVolume - filesystem shared over NFS in plugin's dataset
+type listedVolume struct {
+	name    string
+	managed bool // filesystem is created or adopted by the plugin
+}
+
+// volumeListCache keeps the last fetched volume list of plugin's dataset.
+// Fresh list (younger than `listCacheTtl`) is returned w/o NS requests, the last list of any age
+// is returned if NS cannot be reached. Create and Remove make the list stale.
+type volumeListCache struct {
+	mu         sync.Mutex
+	dataset    string
+	volumes    []listedVolume
+	fetchedAt  time.Time
+	fresh      bool
+	generation int // incremented by invalidate(), list fetched before invalidation is not fresh
+
+	// fetchMu lets one request fetch the list, others wait for its result
+	fetchMu sync.Mutex
+}
+
+// get returns cached volumes of the dataset if the list is younger than ttl
+func (c *volumeListCache) get(dataset string, ttl time.Duration) ([]listedVolume, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fresh || c.dataset != dataset || time.Since(c.fetchedAt) > ttl {
+		return nil, false
+	}
+	return c.volumes, true
+}
+
+// getStale returns the last fetched volumes of the dataset of any age
+func (c *volumeListCache) getStale(dataset string) ([]listedVolume, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dataset != dataset || c.fetchedAt.IsZero() {
+		return nil, time.Time{}, false
+	}
+	return c.volumes, c.fetchedAt, true
+}
+
+// startFetch returns current generation to pass to set()
+func (c *volumeListCache) startFetch() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// set saves fetched list, it's fresh only if the cache hasn't been invalidated since the fetch start
+func (c *volumeListCache) set(dataset string, volumes []listedVolume, fetchedAt time.Time, generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dataset = dataset
+	c.volumes = volumes
+	c.fetchedAt = fetchedAt
+	c.fresh = generation == c.generation
+}
+
+// invalidate makes the list stale, it's still returned if NS cannot be reached
+func (c *volumeListCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fresh = false
+	c.generation++
+}
+
+// listVolumes returns volume names of plugin's dataset from the cache or from NS.
+// If NS cannot be reached, the last fetched list is returned with a warning.
+// Filesystems not managed by the plugin are skipped if `managedVolumesOnly` is set.
+func (d *Driver) listVolumes(r *request) ([]string, error) {
+	volumes, err := d.getVolumeList(r)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, v := range volumes {
+		if v.managed || !r.config.ManagedVolumesOnly {
+			names = append(names, v.name)
+		}
+	}
+	return names, nil
+}
+
+// getVolumeList returns all volumes of plugin's dataset from the cache or from NS
+func (d *Driver) getVolumeList(r *request) ([]listedVolume, error) {
+	datasetPath := r.config.DefaultDataset
+	ttl := time.Duration(r.config.ListCacheTTL) * time.Second
+
+	if volumes, ok := d.volumeList.get(datasetPath, ttl); ok {
+		r.log.Debugf("use cached volume list of '%s'", datasetPath)
+		return volumes, nil
+	}
+
+	d.volumeList.fetchMu.Lock()
+	defer d.volumeList.fetchMu.Unlock()
+
+	// list may be fetched by another request while this one was waiting
+	if volumes, ok := d.volumeList.get(datasetPath, ttl); ok {
+		r.log.Debugf("use volume list of '%s' fetched by another request", datasetPath)
+		return volumes, nil
+	}
+
+	volumes, err := d.fetchVolumes(r)
+	if err != nil {
+		if volumes, fetchedAt, ok := d.volumeList.getStale(datasetPath); ok {
+			r.log.Warnf(
+				"cannot get volume list from NexentaStor, return the list fetched at %s: %s",
+				fetchedAt.Format(time.RFC3339),
+				err,
+			)
+			return volumes, nil
+		}
+		return nil, err
+	}
+
+	return volumes, nil
+}
+
+// fetchVolumes gets volumes of plugin's dataset from NS and saves them to the cache
+func (d *Driver) fetchVolumes(r *request) ([]listedVolume, error) {
+	datasetPath := r.config.DefaultDataset
+	generation := d.volumeList.startFetch()
+	fetchedAt := time.Now()
+
+	volumes, err := r.fetchVolumes(datasetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	d.volumeList.set(datasetPath, volumes, fetchedAt, generation)
+
+	return volumes, nil
+}
+
+// fetchVolumes gets filesystems shared over NFS with their user properties page by page
+// and volume aliases of adopted filesystems, a page failed with transient error is retried
+// from the last fetched filesystem
+func (r *request) fetchVolumes(datasetPath string) ([]listedVolume, error) {
+	volumes := []listedVolume{}
+	startingToken := ""
+	for {
+		var filesystems []filesystemProperties
+		var nextToken string
+		nsProvider, err := r.withRetry(datasetPath, func(nsProvider ns.ProviderInterface) error {
+			provider, err := asPropertiesProvider(nsProvider)
+			if err != nil {
+				return err
+			}
+			filesystems, nextToken, err = provider.GetFilesystemsPropertiesWithStartingToken(
+				datasetPath,
+				startingToken,
+				listPageSize,
+			)
+			return err
+		})
+		if nsProvider == nil {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("InternalError: Cannot get filesystems: %s", err)
+		}
+
+		for _, fs := range filesystems {
+			if fs.SharedOverNfs {
+				volumes = append(volumes, listedVolume{
+					name:    strings.TrimPrefix(fs.Path, datasetPath+"/"),
+					managed: fs.isManaged(),
+				})
+			}
+		}
+
+		if nextToken == "" {
+			r.log.Debugf("%d volume(s) of '%s' fetched from %s NexentaStor", len(volumes), datasetPath, nsProvider)
+			break
+		}
+		startingToken = nextToken
+	}
+
+	// aliases of adopted filesystems outside of the dataset, adopted filesystems are managed
+	aliases, err := r.getAliases()
+	if err != nil {
+		return nil, err
+	}
+	for name := range aliases {
+		volumes = append(volumes, listedVolume{name: name, managed: true})
+	}
+
+	return volumes, nil
+}
+
+// StartListRefresher refreshes cached volume list in background until the stop channel is closed,
+// refresh interval is read from the current config before each refresh
+func (d *Driver) StartListRefresher(stop <-chan struct{}) {
+	go func() {
+		for {
+			interval := time.Duration(d.snapshot().config.ListRefreshInterval) * time.Second
+			wait := interval
+			if interval == 0 {
+				wait = listRefreshDisabledPollInterval
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+
+			if interval > 0 {
+				d.refreshVolumeList()
+			}
+		}
+	}()
+}
+
+// refreshVolumeList fetches volume list to the cache, errors are logged only
+func (d *Driver) refreshVolumeList() {
+	r := d.newRequest("refreshVolumeList()")
+	defer r.finish(nil)
+
+	d.volumeList.fetchMu.Lock()
+	defer d.volumeList.fetchMu.Unlock()
+
+	if _, err := d.fetchVolumes(r); err != nil {
+		r.log.Warnf("cannot refresh volume list: %s", err)
+	}
+}
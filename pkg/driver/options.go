@@ -0,0 +1,230 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+)
+
+// Create options (`docker volume create -o NAME=VALUE`), effective options are saved to the filesystem
+// user property, so Mount on any host uses the volume the same way; see createOptions for not saved ones
+const (
+	optionAdopt        = "adopt"        // take a foreign filesystem under plugin management
+	optionSize         = "size"         // filesystem referenced quota, existing volume is resized
+	optionAllowShrink  = "allowShrink"  // allow to resize existing volume to smaller size
+	optionProtocol     = "protocol"     // only NFS is supported
+	optionMountOptions = "mountOptions" // NFS mount options added to config ones
+	optionReadOnly     = "readonly"     // mount volume read-only
+	optionOwner        = "owner"        // "uid:gid" owner of volume root directory, set on mount
+)
+
+// options saved to the filesystem user property
+var savedOptionKeys = []string{optionProtocol, optionMountOptions, optionReadOnly, optionOwner}
+
+const protocolNFS = "nfs"
+
+var regexpOptionOwner = regexp.MustCompile("^[0-9]+:[0-9]+$")
+
+// volumeOptions - effective Create options of a volume
+type volumeOptions map[string]string
+
+// createOptions - Create options which apply to the Create request only and are not saved to the volume
+type createOptions struct {
+	adoptInPlace bool   // `adopt=true`: adopt foreign filesystem of plugin's dataset with the volume name
+	adoptPath    string // `adopt=pool/dataset/fs`: register the volume as an alias of the filesystem
+	size         int64  // `size=50G`: filesystem referenced quota in bytes, 0 - not set
+	allowShrink  bool   // `allowShrink=true`: existing filesystem may be resized to smaller size
+
+	// requested - volume options set in the request w/o default values, they must match options of existing volume
+	requested volumeOptions
+}
+
+// parseVolumeOptions validates Create options, returns effective volume options with default values set
+// and options of the Create request
+func parseVolumeOptions(options map[string]string) (volumeOptions, createOptions, error) {
+	result := volumeOptions{
+		optionProtocol: protocolNFS,
+		optionReadOnly: strconv.FormatBool(false),
+	}
+	create := createOptions{requested: volumeOptions{}}
+
+	for key, value := range options {
+		switch key {
+		case optionAdopt:
+			if inPlace, err := strconv.ParseBool(value); err == nil {
+				create.adoptInPlace = inPlace
+			} else if config.IsDatasetPath(value) {
+				create.adoptPath = value
+			} else {
+				return nil, create, fmt.Errorf(
+					"Option '%s' must be boolean or filesystem path 'pool/dataset/filesystem', got: '%s'",
+					key,
+					value,
+				)
+			}
+		case optionSize:
+			size, err := ParseSize(value)
+			if err != nil {
+				return nil, create, fmt.Errorf("Option '%s' is invalid: %s", key, err)
+			}
+			create.size = size
+		case optionAllowShrink:
+			allowShrink, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, create, fmt.Errorf("Option '%s' must be boolean, got: '%s'", key, value)
+			}
+			create.allowShrink = allowShrink
+		case optionProtocol:
+			if strings.ToLower(value) != protocolNFS {
+				return nil, create, fmt.Errorf("Option '%s' must be '%s', got: '%s'", key, protocolNFS, value)
+			}
+			create.requested[key] = protocolNFS
+		case optionMountOptions:
+			mountOptions := splitMountOptions(value)
+			if len(mountOptions) != 0 {
+				result[key] = strings.Join(mountOptions, ",")
+			}
+			create.requested[key] = result[key]
+		case optionReadOnly:
+			readOnly, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, create, fmt.Errorf("Option '%s' must be boolean, got: '%s'", key, value)
+			}
+			result[key] = strconv.FormatBool(readOnly)
+			create.requested[key] = result[key]
+		case optionOwner:
+			if !regexpOptionOwner.MatchString(value) {
+				return nil, create, fmt.Errorf("Option '%s' must be in 'uid:gid' format, got: '%s'", key, value)
+			}
+			result[key] = value
+			create.requested[key] = value
+		default:
+			return nil, create, fmt.Errorf(
+				"Unknown option '%s', supported options: %s, %s, %s, %s, %s, %s, %s",
+				key,
+				optionAdopt,
+				optionSize,
+				optionAllowShrink,
+				optionProtocol,
+				optionMountOptions,
+				optionReadOnly,
+				optionOwner,
+			)
+		}
+	}
+
+	return result, create, nil
+}
+
+// checkRequestedOptions returns an error if volume options set in Create request of existing volume differ
+// from the saved ones, options of existing volume are never changed
+func checkRequestedOptions(volumeName string, requested, saved volumeOptions) error {
+	changed := []string{}
+	for _, key := range savedOptionKeys {
+		if value, ok := requested[key]; ok && value != saved[key] {
+			changed = append(changed, fmt.Sprintf("%s: '%s' (saved: '%s')", key, value, saved[key]))
+		}
+	}
+	if len(changed) != 0 {
+		return fmt.Errorf(
+			"FailedPrecondition: Volume '%s' already exists with other options, %s; "+
+				"options of existing volume cannot be changed, remove the volume and create it again",
+			volumeName,
+			strings.Join(changed, ", "),
+		)
+	}
+	return nil
+}
+
+// loadVolumeOptions returns volume options saved to the filesystem user property,
+// default options are returned for a filesystem w/o saved options (e.g. not managed by the plugin)
+func loadVolumeOptions(filesystem filesystemProperties) (volumeOptions, error) {
+	saved := map[string]string{}
+	if value := filesystem.UserProperties[propertyOptions]; value != "" {
+		if err := json.Unmarshal([]byte(value), &saved); err != nil {
+			return nil, fmt.Errorf("Cannot parse '%s' user property value '%s': %s", propertyOptions, value, err)
+		}
+	}
+
+	// options saved by the previous plugin versions may be unknown now, they are ignored
+	known := map[string]string{}
+	for _, key := range savedOptionKeys {
+		if value, ok := saved[key]; ok {
+			known[key] = value
+		}
+	}
+
+	options, _, err := parseVolumeOptions(known)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid options saved in '%s' user property: %s", propertyOptions, err)
+	}
+	return options, nil
+}
+
+// readOnly returns true if the volume is mounted read-only
+func (o volumeOptions) readOnly() bool {
+	readOnly, _ := strconv.ParseBool(o[optionReadOnly])
+	return readOnly
+}
+
+// mountOptions returns NFS mount options of the volume
+func (o volumeOptions) mountOptions() []string {
+	mountOptions := splitMountOptions(o[optionMountOptions])
+	if o.readOnly() {
+		mountOptions = append(mountOptions, "ro")
+	}
+	return mountOptions
+}
+
+// owner returns uid and gid of volume root directory, ok is false if the owner is not set
+func (o volumeOptions) owner() (uid, gid int, ok bool) {
+	parts := strings.Split(o[optionOwner], ":")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	uid, uidErr := strconv.Atoi(parts[0])
+	gid, gidErr := strconv.Atoi(parts[1])
+	return uid, gid, uidErr == nil && gidErr == nil
+}
+
+// setVolumeOwner changes owner of mounted volume root directory if it's set by the options, errors are logged only:
+// NFS server may not allow to change it (e.g. root squash)
+func (r *request) setVolumeOwner(options volumeOptions, volumeMountPoint string) {
+	uid, gid, ok := options.owner()
+	if !ok || options.readOnly() {
+		return
+	}
+	if err := os.Chown(volumeMountPoint, uid, gid); err != nil {
+		r.log.Warnf("cannot change owner of '%s' to %d:%d: %s", volumeMountPoint, uid, gid, err)
+	}
+}
+
+// splitMountOptions splits comma separated mount options, empty ones are skipped
+func splitMountOptions(value string) []string {
+	mountOptions := []string{}
+	for _, option := range strings.Split(value, ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			mountOptions = append(mountOptions, option)
+		}
+	}
+	return mountOptions
+}
+
+// getVolumeOptions returns volume options saved to the filesystem user property on NS
+func (r *request) getVolumeOptions(filesystemPath string) (volumeOptions, error) {
+	_, filesystem, err := r.getFilesystemProperties(filesystemPath, filesystemPath)
+	if err != nil {
+		return nil, fmt.Errorf("InternalError: Cannot get user properties of filesystem '%s': %s", filesystemPath, err)
+	}
+
+	options, err := loadVolumeOptions(filesystem)
+	if err != nil {
+		return nil, fmt.Errorf("FailedPrecondition: Cannot load options of filesystem '%s': %s", filesystemPath, err)
+	}
+	return options, nil
+}
@@ -0,0 +1,288 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+)
+
+// NS user properties set on filesystems created or adopted by the plugin
+const (
+	userPropertyPrefix = "com.nexenta.docker:"
+
+	propertyManagedBy = userPropertyPrefix + "managed-by" // managedByPlugin
+	propertyVersion   = userPropertyPrefix + "version"    // plugin version
+	propertyHost      = userPropertyPrefix + "host"       // Docker host which created or adopted the filesystem
+	propertyOptions   = userPropertyPrefix + "options"    // effective Create options as JSON object
+)
+
+// managedByPlugin - value of the managed-by property
+const managedByPlugin = "nexentastor-docker-volume-plugin"
+
+// filesystemProperties - filesystem with user properties and quota, the vendored provider doesn't request them
+type filesystemProperties struct {
+	Path                string            `json:"path"`
+	SharedOverNfs       bool              `json:"sharedOverNfs"`
+	BytesUsed           int64             `json:"bytesUsed"`
+	ReferencedQuotaSize int64             `json:"referencedQuotaSize"` // 0 - no quota
+	UserProperties      map[string]string `json:"userProperties"`
+}
+
+// isManaged returns true if the filesystem is created or adopted by the plugin
+func (fs filesystemProperties) isManaged() bool {
+	return fs.UserProperties[propertyManagedBy] == managedByPlugin
+}
+
+// propertiesProvider - NS node which can request filesystem user properties
+type propertiesProvider interface {
+	GetFilesystemProperties(path string) (filesystemProperties, error)
+	GetFilesystemsPropertiesWithStartingToken(parent, startingToken string, limit int) (
+		[]filesystemProperties,
+		string,
+		error,
+	)
+	SetFilesystemProperties(path string, properties map[string]string) error
+	SetFilesystemQuota(path string, size int64) error
+}
+
+// newManagedProperties returns user properties to mark a filesystem as managed by the plugin
+func newManagedProperties(options volumeOptions) (map[string]string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get host name: %s", err)
+	}
+
+	optionsJSON, err := json.Marshal(options)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot encode options '%+v': %s", options, err)
+	}
+
+	return map[string]string{
+		propertyManagedBy: managedByPlugin,
+		propertyVersion:   config.Version,
+		propertyHost:      host,
+		propertyOptions:   string(optionsJSON),
+	}, nil
+}
+
+// getFilesystemProperties returns filesystem with user properties from NS node resolved by the path,
+// the node is nil if the path cannot be resolved (see withRetry())
+func (r *request) getFilesystemProperties(resolvePath, filesystemPath string) (
+	nsProvider ns.ProviderInterface,
+	filesystem filesystemProperties,
+	err error,
+) {
+	nsProvider, err = r.withRetry(resolvePath, func(nsProvider ns.ProviderInterface) error {
+		provider, err := asPropertiesProvider(nsProvider)
+		if err != nil {
+			return err
+		}
+		filesystem, err = provider.GetFilesystemProperties(filesystemPath)
+		return err
+	})
+	return nsProvider, filesystem, err
+}
+
+// setFilesystemProperties sets filesystem user properties on NS node resolved by the path
+func (r *request) setFilesystemProperties(resolvePath, filesystemPath string, properties map[string]string) error {
+	_, err := r.withRetry(resolvePath, func(nsProvider ns.ProviderInterface) error {
+		provider, err := asPropertiesProvider(nsProvider)
+		if err != nil {
+			return err
+		}
+		return provider.SetFilesystemProperties(filesystemPath, properties)
+	})
+	if err != nil {
+		return fmt.Errorf("InternalError: Cannot set user properties of filesystem '%s': %s", filesystemPath, err)
+	}
+	return nil
+}
+
+func asPropertiesProvider(nsProvider ns.ProviderInterface) (propertiesProvider, error) {
+	provider, ok := nsProvider.(propertiesProvider)
+	if !ok {
+		return nil, fmt.Errorf("NexentaStor provider %s doesn't support user properties requests", nsProvider)
+	}
+	return provider, nil
+}
+
+// getFilesystemsProperties returns filesystems by parent filesystem or by path with user properties, limit and offset
+// select a page if limit is set. NS returns the parent filesystem itself as the first one, it's counted by the offset.
+func getFilesystemsProperties(nsProvider ns.ProviderInterface, parent, path string, limit, offset int) (
+	[]filesystemProperties,
+	error,
+) {
+	provider, ok := nsProvider.(*ns.Provider)
+	if !ok {
+		return nil, fmt.Errorf("NexentaStor provider %s doesn't support REST requests", nsProvider)
+	}
+
+	params := map[string]string{
+		"parent": parent,
+		"path":   path,
+		"fields": "path,sharedOverNfs,bytesUsed,referencedQuotaSize,userProperties",
+	}
+	if limit > 0 {
+		params["limit"] = fmt.Sprint(limit)
+		params["offset"] = fmt.Sprint(offset)
+	}
+
+	uri := provider.RestClient.BuildURI("/storage/filesystems", params)
+	bodyBytes, err := sendRequest(provider, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response := struct {
+		Data []filesystemProperties `json:"data"`
+	}{}
+	if err := json.Unmarshal(bodyBytes, &response); err != nil {
+		return nil, fmt.Errorf("Cannot parse NS response '%s': %s", bodyBytes, err)
+	}
+	return response.Data, nil
+}
+
+// getFilesystemsPropertiesWithStartingToken returns up to limit filesystems by parent filesystem with user properties
+// after the starting token, parent filesystem is excluded. nextToken is returned if there are more filesystems,
+// it keeps path and offset of the last returned filesystem. NS lists filesystems sorted by path, so the next page
+// starts after the largest path which is not greater than the token's path, even if the token's filesystem or
+// others are created or destroyed meanwhile. The offset is a hint where to start, it's moved back if filesystems
+// before it are destroyed.
+func getFilesystemsPropertiesWithStartingToken(
+	nsProvider ns.ProviderInterface,
+	parent, startingToken string,
+	limit int,
+) (filesystems []filesystemProperties, nextToken string, err error) {
+	offset, tokenPath := parseListToken(startingToken)
+	anchored := tokenPath == ""
+	lastOffset := 0
+	for {
+		slice, err := getFilesystemsProperties(nsProvider, parent, "", limit, offset)
+		if err != nil {
+			return nil, "", err
+		}
+
+		// the first slice must start at or before the token's path, otherwise filesystems are skipped
+		if !anchored && offset > 0 && (len(slice) == 0 || slice[0].Path > tokenPath) {
+			offset -= limit
+			if offset < 0 {
+				offset = 0
+			}
+			continue
+		}
+		anchored = true
+
+		for i, fs := range slice {
+			if fs.Path == parent || fs.Path <= tokenPath {
+				continue
+			} else if len(filesystems) == limit {
+				return filesystems, formatListToken(lastOffset, filesystems[limit-1].Path), nil
+			}
+			filesystems = append(filesystems, fs)
+			lastOffset = offset + i
+		}
+		if len(slice) < limit {
+			return filesystems, "", nil
+		}
+		offset += len(slice)
+	}
+}
+
+// formatListToken returns token of filesystems list page: "<OFFSET>:<PATH>" of the last listed filesystem
+func formatListToken(offset int, path string) string {
+	return fmt.Sprintf("%d:%s", offset, path)
+}
+
+// parseListToken returns offset and path of the last listed filesystem, token w/o offset is a path
+func parseListToken(token string) (offset int, path string) {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) == 2 {
+		if n, err := strconv.Atoi(parts[0]); err == nil && n >= 0 {
+			return n, parts[1]
+		}
+	}
+	return 0, token
+}
+
+// getFilesystemProperties returns filesystem by its path with user properties
+func getFilesystemProperties(nsProvider ns.ProviderInterface, path string) (filesystemProperties, error) {
+	filesystems, err := getFilesystemsProperties(nsProvider, "", path, 0, 0)
+	if err != nil {
+		return filesystemProperties{}, err
+	}
+	for _, fs := range filesystems {
+		if fs.Path == path {
+			return fs, nil
+		}
+	}
+	return filesystemProperties{}, &ns.NefError{
+		Err:  fmt.Errorf("Filesystem '%s' not found", path),
+		Code: "ENOENT",
+	}
+}
+
+// setFilesystemProperties sets user properties of the filesystem, other properties are kept
+func setFilesystemProperties(nsProvider ns.ProviderInterface, path string, properties map[string]string) error {
+	return updateFilesystem(nsProvider, path, map[string]interface{}{"userProperties": properties})
+}
+
+// setFilesystemQuota sets referenced quota size of the filesystem in bytes
+func setFilesystemQuota(nsProvider ns.ProviderInterface, path string, size int64) error {
+	return updateFilesystem(nsProvider, path, map[string]interface{}{"referencedQuotaSize": size})
+}
+
+// updateFilesystem changes filesystem properties passed in the data, other properties are kept
+func updateFilesystem(nsProvider ns.ProviderInterface, path string, data map[string]interface{}) error {
+	provider, ok := nsProvider.(*ns.Provider)
+	if !ok {
+		return fmt.Errorf("NexentaStor provider %s doesn't support REST requests", nsProvider)
+	}
+
+	uri := fmt.Sprintf("/storage/filesystems/%s", url.PathEscape(path))
+	_, err := sendRequest(provider, http.MethodPut, uri, data)
+	return err
+}
+
+// sendRequest sends NS request which is not implemented by the vendored provider,
+// logs in again on HTTP 401 like the provider does, returns NS error response as NefError
+func sendRequest(provider *ns.Provider, method, path string, data interface{}) ([]byte, error) {
+	statusCode, bodyBytes, err := provider.RestClient.Send(method, path, data)
+	if err == nil && statusCode == http.StatusUnauthorized {
+		if err := provider.LogIn(); err != nil {
+			return nil, err
+		}
+		statusCode, bodyBytes, err = provider.RestClient.Send(method, path, data)
+	}
+	if err != nil {
+		return bodyBytes, err
+	}
+
+	if statusCode >= 300 {
+		response := struct {
+			Name    string `json:"name"`
+			Message string `json:"message"`
+			Code    string `json:"code"`
+		}{}
+		if json.Unmarshal(bodyBytes, &response) != nil || (response.Message == "" && response.Code == "") {
+			return bodyBytes, fmt.Errorf("Request returned %d code: %s", statusCode, bodyBytes)
+		}
+		message := response.Message
+		if response.Name != "" {
+			message = fmt.Sprintf("%s: %s", response.Name, message)
+		}
+		return bodyBytes, &ns.NefError{
+			Err:  fmt.Errorf("request error: %s", message),
+			Code: response.Code,
+		}
+	}
+
+	return bodyBytes, nil
+}
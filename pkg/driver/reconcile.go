@@ -0,0 +1,299 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/state"
+)
+
+// reconcileSummary - counters of startup reconciliation actions
+type reconcileSummary struct {
+	removedRecords       int // state records of mounts which are gone
+	adoptedMounts        int // mounts added to the state on the first start with the state
+	unmountedBinds       int // orphaned container bind mounts
+	unmountedVolumes     int // NFS mounts with no bind mounts
+	removedDirs          int // empty mount point directories
+	failures             int
+	volumesLeftMounted   int
+	bindsLeftMounted     int
+	dryRunSkippedActions int
+}
+
+// reconcile syncs the state with the mount table on plugin start and cleans up mounts left after
+// plugin crash, `docker plugin disable` or host reboot:
+//   - state records of mounts which are gone are removed,
+//   - bind mounts and NFS mounts missed in the state are orphaned (plugin failed before saving the state,
+//     so Docker didn't get successful response) and unmounted; if there is no state file yet
+//     (upgrade from a stateless plugin version) all found mounts are adopted,
+//   - bind mounts of not mounted volumes are unmounted,
+//   - NFS mounts which are not used by any container bind mount are unmounted,
+//   - empty mount point directories are removed.
+//
+// In dry run mode actions are only logged, the state is not changed either.
+func (d *Driver) reconcile(dryRun bool) error {
+	l := d.log.WithField("func", "reconcile()")
+	if dryRun {
+		l.Info("dry run mode: stale mounts and directories are reported only")
+	}
+
+	mountedVolumes, mountedBinds, err := d.findPluginMounts(l)
+	if err != nil {
+		return err
+	}
+
+	summary := reconcileSummary{}
+	trustState := d.state.FileExists()
+	now := time.Now()
+
+	// all plugin mount points, directories which are still mounted are never touched
+	mountedPaths := map[string]bool{}
+	for _, mount := range mountedVolumes {
+		mountedPaths[mount.MountPoint] = true
+	}
+	for _, binds := range mountedBinds {
+		for _, path := range binds {
+			mountedPaths[path] = true
+		}
+	}
+
+	// build state records from existing mounts
+	volumes := map[string]state.Volume{}
+	for name, volume := range d.state.Volumes() {
+		if _, ok := mountedVolumes[name]; !ok {
+			l.Infof("volume '%s' is not mounted anymore, remove it from the state", name)
+			summary.removedRecords++
+			continue
+		}
+		for containerID := range volume.Binds {
+			if _, ok := mountedBinds[name][containerID]; !ok {
+				l.Infof("container '%s' bind mount of '%s' is gone, remove it from the state", containerID, name)
+				delete(volume.Binds, containerID)
+				summary.removedRecords++
+			}
+		}
+		volumes[name] = volume
+	}
+	if !trustState {
+		for name, mount := range mountedVolumes {
+			if _, ok := volumes[name]; !ok {
+				l.Infof("no state file, adopt mounted volume '%s': %+v", name, mount)
+				mount.MountedAt = now
+				mount.Binds = map[string]state.Bind{}
+				volumes[name] = mount
+				summary.adoptedMounts++
+			}
+			for containerID, path := range mountedBinds[name] {
+				if _, ok := volumes[name].Binds[containerID]; !ok {
+					l.Infof("no state file, adopt container '%s' bind mount of '%s'", containerID, name)
+					volumes[name].Binds[containerID] = state.Bind{Path: path, MountedAt: now}
+					summary.adoptedMounts++
+				}
+			}
+		}
+	}
+
+	// unmount bind mounts which are not in the state
+	for name, binds := range mountedBinds {
+		for containerID, path := range binds {
+			if _, ok := volumes[name].Binds[containerID]; ok {
+				continue
+			}
+			l.Infof("orphaned container '%s' bind mount of '%s' found: '%s'", containerID, name, path)
+			if d.reconcileUnmount(l, dryRun, path, &summary) {
+				delete(mountedPaths, path)
+				summary.unmountedBinds++
+			} else {
+				summary.bindsLeftMounted++
+			}
+		}
+	}
+
+	// unmount NFS mounts which are not in the state or not used by any container
+	for name, mount := range mountedVolumes {
+		volume, ok := volumes[name]
+		if ok && len(volume.Binds) > 0 {
+			continue
+		}
+		if ok {
+			l.Infof("volume '%s' is not used by any container: '%s'", name, mount.MountPoint)
+		} else {
+			l.Infof("orphaned volume '%s' mount found: '%s'", name, mount.MountPoint)
+		}
+		if d.reconcileUnmount(l, dryRun, mount.MountPoint, &summary) {
+			delete(mountedPaths, mount.MountPoint)
+			delete(volumes, name)
+			summary.unmountedVolumes++
+		} else if !ok {
+			summary.volumesLeftMounted++
+		}
+	}
+
+	if dryRun {
+		l.Infof("dry run: would save reconciled state: %d volume(s)", len(volumes))
+	} else if err := d.state.Replace(volumes); err != nil {
+		l.Warnf("cannot save reconciled state: %s", err)
+	}
+
+	removeEmptyMountPointDirs(l, d.mountPointsRoot, dryRun, mountedPaths, &summary)
+
+	l.WithFields(logrus.Fields{
+		"removedRecords":   summary.removedRecords,
+		"adoptedMounts":    summary.adoptedMounts,
+		"unmountedBinds":   summary.unmountedBinds,
+		"unmountedVolumes": summary.unmountedVolumes,
+		"removedDirs":      summary.removedDirs,
+		"failures":         summary.failures,
+		"dryRunSkipped":    summary.dryRunSkippedActions,
+	}).Infof(
+		"done: %d volume(s) mounted; %d orphaned volume(s) and %d orphaned bind(s) left mounted",
+		len(volumes),
+		summary.volumesLeftMounted,
+		summary.bindsLeftMounted,
+	)
+
+	return nil
+}
+
+// reconcileUnmount unmounts the path unless it's a dry run, returns true if path has been unmounted
+func (d *Driver) reconcileUnmount(l *logrus.Entry, dryRun bool, path string, summary *reconcileSummary) bool {
+	if dryRun {
+		l.Infof("dry run: would unmount '%s'", path)
+		summary.dryRunSkippedActions++
+		return false
+	}
+
+	if err := d.mounter.Unmount(path); err != nil {
+		l.Warnf("cannot unmount '%s': %s", path, err)
+		summary.failures++
+		return false
+	}
+
+	l.Infof("'%s' has been unmounted", path)
+	return true
+}
+
+// removeEmptyMountPointDirs removes empty directories in volume and bind mounts roots which are not mount points
+func removeEmptyMountPointDirs(
+	l *logrus.Entry,
+	mountPointsRoot string,
+	dryRun bool,
+	mountedPaths map[string]bool,
+	summary *reconcileSummary,
+) {
+	removeIfEmpty := func(path string) {
+		if mountedPaths[path] {
+			return
+		}
+		files, err := ioutil.ReadDir(path)
+		if err != nil || len(files) != 0 {
+			return
+		}
+		if dryRun {
+			l.Infof("dry run: would remove empty directory '%s'", path)
+			summary.dryRunSkippedActions++
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			l.Warnf("cannot remove empty directory '%s': %s", path, err)
+			summary.failures++
+			return
+		}
+		l.Infof("empty directory '%s' has been removed", path)
+		summary.removedDirs++
+	}
+
+	for _, dir := range listDirs(getVolumeMountPoint(mountPointsRoot, "")) {
+		removeIfEmpty(dir)
+	}
+	for _, dir := range listDirs(getContainerBindMountsRoot(mountPointsRoot)) {
+		// bind/<VOLUME_NAME>/<CONTAINER_ID> or legacy bind/<VOLUME_NAME>-<CONTAINER_ID>
+		for _, containerDir := range listDirs(dir) {
+			removeIfEmpty(containerDir)
+		}
+		removeIfEmpty(dir)
+	}
+}
+
+// findPluginMounts returns volume NFS mounts (volume name -> mount)
+// and container bind mounts (volume name -> container ID -> path) from the mount table
+func (d *Driver) findPluginMounts(l *logrus.Entry) (map[string]state.Volume, map[string]map[string]string, error) {
+	volumesRoot := getVolumeMountPoint(d.mountPointsRoot, "")
+	volumeMounts, err := d.mounter.FindMountByTargetPathHasPrefix(volumesRoot + "/")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bindMounts, err := d.mounter.FindMountByTargetPathHasPrefix(getContainerBindMountsRoot(d.mountPointsRoot) + "/")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mountedVolumes := map[string]state.Volume{}
+	for _, mount := range volumeMounts {
+		if filepath.Dir(mount.Path) == volumesRoot {
+			mountedVolumes[filepath.Base(mount.Path)] = state.Volume{
+				Source:     mount.Device,
+				Options:    mount.Opts,
+				MountPoint: mount.Path,
+			}
+		}
+	}
+
+	mountedBinds := map[string]map[string]string{}
+	for _, mount := range bindMounts {
+		volumeName, containerID, ok := ParseContainerBindMountPath(d.mountPointsRoot, mount.Path)
+		if !ok {
+			l.Warnf("unknown mount '%s' in bind mounts directory, skip it", mount.Path)
+			continue
+		}
+		if _, ok := mountedBinds[volumeName]; !ok {
+			mountedBinds[volumeName] = map[string]string{}
+		}
+		mountedBinds[volumeName][containerID] = mount.Path
+	}
+
+	return mountedVolumes, mountedBinds, nil
+}
+
+// listDirs returns full paths of subdirectories, nothing if directory doesn't exist
+func listDirs(path string) []string {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+
+	dirs := []string{}
+	for _, file := range files {
+		if file.IsDir() {
+			dirs = append(dirs, filepath.Join(path, file.Name()))
+		}
+	}
+	return dirs
+}
+
+// ParseContainerBindMountPath returns volume name and container ID of the bind mount path under the mount points
+// root, both current (bind/<VOLUME_NAME>/<CONTAINER_ID>) and legacy (bind/<VOLUME_NAME>-<CONTAINER_ID>) layouts
+// are supported.
+// Legacy bind mounts are used by running containers, so they are not moved, but kept in the state as is
+// and unmounted by their path.
+func ParseContainerBindMountPath(mountPointsRoot, path string) (volumeName, containerID string, ok bool) {
+	bindsRoot := getContainerBindMountsRoot(mountPointsRoot)
+	dir := filepath.Dir(path)
+
+	if filepath.Dir(dir) == bindsRoot {
+		return filepath.Base(dir), filepath.Base(path), true
+	}
+
+	if dir == bindsRoot {
+		if m := regexpLegacyContainerBindMountName.FindStringSubmatch(filepath.Base(path)); m != nil {
+			return m[1], m[2], true
+		}
+	}
+
+	return "", "", false
+}
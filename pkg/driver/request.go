@@ -0,0 +1,120 @@
+package driver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/mounter"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/state"
+)
+
+// log field name of the plugin request ID
+const requestIDField = "rid"
+
+// request - scope of a single plugin API call,
+// request ID is added to all log lines of the driver, NS resolver, NS providers, REST clients and mounter,
+// and to all returned errors.
+// Config and NS resolver are taken once at request start, so config reload doesn't affect the request.
+// Request context has `requestTimeout` deadline, it stops NS requests, retries and mount commands.
+type request struct {
+	id       string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	log      *logrus.Entry
+	config   *config.Config
+	resolver *resolver
+	mounter  *mounter.Mounter
+	state    *state.Store
+
+	mountPointsRoot string
+}
+
+// newRequest creates request scope with a new request ID for a driver method,
+// request.finish() must be called when the method returns
+func (d *Driver) newRequest(funcName string) *request {
+	current := d.snapshot()
+
+	r := newCommandRequest(d.log, funcName, current.config, current.resolver)
+	r.mounter = withMountTimeouts(d.mounter.WithLog(r.log), current.config).WithContext(r.ctx)
+	r.state = d.state
+	r.mountPointsRoot = d.mountPointsRoot
+
+	return r
+}
+
+// newCommandRequest creates request scope w/o mounter and mounts state, admin commands use it as is
+// since they only send requests to NS, request.finish() must be called when the command returns
+func newCommandRequest(log *logrus.Entry, funcName string, cfg *config.Config, nsResolver *resolver) *request {
+	id := newRequestID()
+	l := log.WithFields(logrus.Fields{
+		"func":         funcName,
+		requestIDField: id,
+	})
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if cfg.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(cfg.RequestTimeout)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	return &request{
+		id:       id,
+		ctx:      ctx,
+		cancel:   cancel,
+		log:      l,
+		config:   cfg,
+		resolver: nsResolver.withContext(ctx, l),
+	}
+}
+
+// finish releases request context. If the request has failed after its deadline is exceeded,
+// the error is replaced by the deadline error, so the caller gets the same error wherever the request stopped.
+func (r *request) finish(err *error) {
+	deadlineErr := r.contextError()
+	r.cancel()
+
+	if err != nil && *err != nil && deadlineErr != nil {
+		*err = logError(r.log, deadlineErr)
+	}
+}
+
+// contextError returns an error if request context is done, nil otherwise
+func (r *request) contextError() error {
+	switch r.ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return fmt.Errorf("DeadlineExceeded: Request is not finished in %ds (requestTimeout)", r.config.RequestTimeout)
+	default:
+		return fmt.Errorf("Canceled: Request is canceled")
+	}
+}
+
+// newRequestID returns a short random ID, it's easy to grep in logs and user's error messages
+func newRequestID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// withRequestID adds request ID to the error message, NefError keeps its code
+func withRequestID(err error, id interface{}) error {
+	if nefErr, ok := err.(*ns.NefError); ok {
+		return &ns.NefError{
+			Err:  fmt.Errorf("%s [%s: %s]", nefErr.Err, requestIDField, id),
+			Code: nefErr.Code,
+		}
+	}
+	return fmt.Errorf("%s [%s: %s]", err, requestIDField, id)
+}
@@ -0,0 +1,171 @@
+package driver
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/audit"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+)
+
+// size units, 1024 based: "50G" is the same as "50GiB" and "50GB"
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+	"P": 1 << 50,
+}
+
+var regexpSize = regexp.MustCompile("^([0-9]+(?:\\.[0-9]+)?)\\s*([KMGTP]?)(?:I?B)?$")
+
+// ParseSize parses volume size in bytes, value may have a unit: "1073741824", "512M", "50G", "1.5T", "2GiB"
+func ParseSize(value string) (int64, error) {
+	matches := regexpSize.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if matches == nil {
+		return 0, fmt.Errorf("size must be a number of bytes with optional K, M, G, T or P unit, got: '%s'", value)
+	}
+
+	number, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse size '%s': %s", value, err)
+	}
+	size := number * float64(sizeUnits[matches[2]])
+	if size < 1 || size >= math.MaxInt64 {
+		return 0, fmt.Errorf("size must be from 1 byte to 8E, got: '%s'", value)
+	}
+
+	return int64(size), nil
+}
+
+// formatSize returns size with the largest unit which keeps it an integer, "unlimited" for 0
+func formatSize(size int64) string {
+	if size == 0 {
+		return "unlimited"
+	}
+	for _, unit := range []string{"P", "T", "G", "M", "K"} {
+		if size%sizeUnits[unit] == 0 {
+			return fmt.Sprintf("%d%s", size/sizeUnits[unit], unit)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// resizeFilesystem sets referenced quota of existing filesystem to the size. Unlimited filesystem is the largest one,
+// so setting a quota on it or lowering the quota is a shrink, it's done only if allowed and never below the used space.
+// Mounted volumes see the new size w/o remount.
+func (r *request) resizeFilesystem(resolvePath, filesystemPath string, size int64, allowShrink bool) error {
+	_, filesystem, err := r.getFilesystemProperties(resolvePath, filesystemPath)
+	if ns.IsNotExistNefError(err) {
+		return fmt.Errorf("NotFound: Cannot resize NexentaStor filesystem '%s', it doesn't exist", filesystemPath)
+	} else if err != nil {
+		return fmt.Errorf("InternalError: Cannot get filesystem '%s': %s", filesystemPath, err)
+	}
+
+	currentSize := filesystem.ReferencedQuotaSize
+	if currentSize == size {
+		r.log.Infof("filesystem '%s' already has %s size", filesystemPath, formatSize(size))
+		return nil
+	} else if (currentSize == 0 || size < currentSize) && !allowShrink {
+		return fmt.Errorf(
+			"FailedPrecondition: Cannot shrink filesystem '%s' from %s to %s, use '%s' option to allow it",
+			filesystemPath,
+			formatSize(currentSize),
+			formatSize(size),
+			optionAllowShrink,
+		)
+	} else if size < filesystem.BytesUsed {
+		return fmt.Errorf(
+			"FailedPrecondition: Cannot resize filesystem '%s' to %s, it's less than used space %s",
+			filesystemPath,
+			formatSize(size),
+			formatSize(filesystem.BytesUsed),
+		)
+	}
+
+	_, err = r.withRetry(resolvePath, func(nsProvider ns.ProviderInterface) error {
+		provider, err := asPropertiesProvider(nsProvider)
+		if err != nil {
+			return err
+		}
+		return provider.SetFilesystemQuota(filesystemPath, size)
+	})
+	if err != nil {
+		return fmt.Errorf("InternalError: Cannot set size of filesystem '%s': %s", filesystemPath, err)
+	}
+
+	r.log.Infof(
+		"filesystem '%s' has been resized from %s to %s",
+		filesystemPath,
+		formatSize(currentSize),
+		formatSize(size),
+	)
+	return nil
+}
+
+// ResizeArgs - params to resize a volume w/o running driver
+type ResizeArgs struct {
+	Config *config.Config
+	Log    *logrus.Entry
+
+	// Audit - volume lifecycle audit log, optional
+	Audit *audit.Logger
+
+	Volume      string
+	Size        int64 // bytes
+	AllowShrink bool
+}
+
+// ResizeVolume changes size of existing volume (or adopted filesystem of an alias), it's used by admin command.
+// Driver is not started: mounts state is not loaded and not reconciled.
+func ResizeVolume(args ResizeArgs) (err error) {
+	l := args.Log.WithField("cmp", "Driver")
+
+	nsResolver, err := newResolver(args.Config, l)
+	if err != nil {
+		return err
+	}
+
+	r := newCommandRequest(l, "Resize()", args.Config, nsResolver)
+	l = r.log
+	l.Infof("request: volume '%s', size %s, allow shrink: %t", args.Volume, formatSize(args.Size), args.AllowShrink)
+
+	auditEvent := &audit.Event{
+		Action:    audit.ActionResize,
+		RequestID: r.id,
+		Volume:    args.Volume,
+		Options: map[string]string{
+			optionSize:        fmt.Sprint(args.Size),
+			optionAllowShrink: strconv.FormatBool(args.AllowShrink),
+		},
+	}
+	defer writeAudit(args.Audit, l, auditEvent, time.Now(), &err)
+	defer r.finish(&err)
+
+	if args.Volume == "" {
+		return logError(l, fmt.Errorf("InvalidArgument: volume name must be provided"))
+	} else if args.Size <= 0 {
+		return logError(l, fmt.Errorf("InvalidArgument: volume size must be positive, got: %d", args.Size))
+	}
+
+	filesystemPath, _, err := r.getVolumePath(args.Volume)
+	if err != nil {
+		return logError(l, err)
+	}
+	auditEvent.Path = filesystemPath
+
+	if err := r.resizeFilesystem(filesystemPath, filesystemPath, args.Size, args.AllowShrink); err != nil {
+		return logError(l, err)
+	}
+
+	l.Infof("done: volume '%s' has %s size", args.Volume, formatSize(args.Size))
+	return nil
+}
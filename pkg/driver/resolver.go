@@ -0,0 +1,359 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+const (
+	// resolved path is not probed again for this time
+	resolveCacheTTL = time.Minute
+
+	// node is skipped by resolver after this count of consecutive failures...
+	nodeFailuresThreshold = 3
+
+	// ...for this time, then it's probed again
+	nodeSkipInterval = 30 * time.Second
+)
+
+// resolver finds NS node which owns a path, it replaces ns.Resolver.Resolve() which probes nodes one by one:
+//   - all nodes are probed in parallel, the first node which has the path is used,
+//   - path owners are cached for resolveCacheTTL, cache entry is dropped on any error of the node's request,
+//   - node failed nodeFailuresThreshold times in a row (not a NefError or EBUSY) is skipped for nodeSkipInterval.
+//
+// Copies created by withContext() share the cache.
+type resolver struct {
+	nodes []ns.ProviderInterface
+	ctx   context.Context
+	log   *logrus.Entry
+	cache *resolverCache
+}
+
+// resolverCache - path owners and nodes' failures, shared between resolver copies
+type resolverCache struct {
+	mu    sync.Mutex
+	paths map[string]resolvedPath // path -> owner node
+	nodes []nodeHealth            // by node index
+}
+
+type resolvedPath struct {
+	index     int
+	expiresAt time.Time
+}
+
+// nodeHealth - circuit breaker state of a node
+type nodeHealth struct {
+	failures  int       // consecutive failures
+	skipUntil time.Time // node is not probed until this time
+}
+
+func newNodeResolver(nsResolver *ns.Resolver) *resolver {
+	return &resolver{
+		nodes: nsResolver.Nodes,
+		ctx:   context.Background(),
+		log:   nsResolver.Log,
+		cache: &resolverCache{
+			paths: map[string]resolvedPath{},
+			nodes: make([]nodeHealth, len(nsResolver.Nodes)),
+		},
+	}
+}
+
+// withContext returns a copy of the resolver which nodes' requests are stopped when the request context is done
+// and log to the request logger, copies share REST clients' connections, auth tokens and the cache
+// with the original resolver
+func (r *resolver) withContext(ctx context.Context, l *logrus.Entry) *resolver {
+	nodes := make([]ns.ProviderInterface, len(r.nodes))
+	for i, node := range r.nodes {
+		nodes[i] = node
+		if provider, ok := node.(*ns.Provider); ok {
+			providerLog := l.WithFields(logrus.Fields{
+				"cmp": "NSProvider",
+				"ns":  provider.Address,
+			})
+			providerCopy := *provider
+			providerCopy.Log = providerLog
+			if client, ok := provider.RestClient.(*restClient); ok {
+				providerCopy.RestClient = client.withContext(ctx, providerLog)
+			}
+			nodes[i] = &providerCopy
+		}
+	}
+
+	return &resolver{
+		nodes: nodes,
+		ctx:   ctx,
+		log:   l.WithField("cmp", "NSResolver"),
+		cache: r.cache,
+	}
+}
+
+// resolve returns NS node which has the pool/dataset/filesystem path.
+// If no node has the path, NefError (e.g. ENOENT) of a responded node is preferred to connection errors.
+func (r *resolver) resolve(path string) (ns.ProviderInterface, error) {
+	l := r.log.WithField("func", "resolve()")
+
+	if path == "" {
+		return nil, fmt.Errorf("Resolved was called with empty pool/dataset path")
+	}
+
+	if index, ok := r.cache.getPath(path); ok {
+		l.Debugf("resolve '%s' to '%s' (cached)", path, r.nodes[index])
+		return r.resolvedNode(index, path), nil
+	}
+
+	type probeResult struct {
+		index int
+		err   error
+	}
+
+	indexes := r.cache.nodesToProbe()
+	results := make(chan probeResult, len(indexes))
+	for _, index := range indexes {
+		go func(index int) {
+			_, err := r.nodes[index].GetFilesystem(path)
+			r.report(index, err)
+			results <- probeResult{index, err}
+		}(index)
+	}
+
+	var nefErr, lastErr error
+	for range indexes {
+		result := <-results
+		if result.err == nil {
+			r.cache.setPath(path, result.index)
+			l.Debugf("resolve '%s' to '%s'", path, r.nodes[result.index])
+			return r.resolvedNode(result.index, path), nil
+		}
+		if ns.GetNefErrorCode(result.err) != "" {
+			nefErr = result.err
+		}
+		lastErr = result.err
+	}
+
+	if nefErr != nil {
+		lastErr = nefErr
+	}
+	l.Debugf("error while resolving '%s': %s", path, lastErr)
+	return nil, lastErr
+}
+
+// resolvedNode wraps the node to drop the path from the cache on request errors
+func (r *resolver) resolvedNode(index int, path string) ns.ProviderInterface {
+	return &resolvedNode{
+		ProviderInterface: r.nodes[index],
+		resolver:          r,
+		index:             index,
+		path:              path,
+	}
+}
+
+// report updates node's circuit breaker by the request result, connection errors, timeouts (errors
+// w/o NefError code) and EBUSY are node failures: the node is going down or its pool is moving to another node
+func (r *resolver) report(index int, err error) {
+	node := r.nodes[index]
+	if r.ctx.Err() != nil { // request is stopped by its deadline, not by the node
+		return
+	}
+	if err == nil || (ns.GetNefErrorCode(err) != "" && !ns.IsBusyNefError(err)) {
+		if r.cache.nodeSucceeded(index) {
+			r.log.Infof("NexentaStor '%s' responds again, use it for resolving", node)
+		}
+		return
+	}
+
+	if r.cache.nodeFailed(index) {
+		r.log.Warnf(
+			"NexentaStor '%s' failed %d times in a row, skip it for %s: %s",
+			node,
+			nodeFailuresThreshold,
+			nodeSkipInterval,
+			err,
+		)
+	}
+}
+
+func (c *resolverCache) getPath(path string) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resolved, ok := c.paths[path]
+	if !ok {
+		return 0, false
+	}
+	if time.Now().After(resolved.expiresAt) || c.isSkipped(resolved.index) {
+		delete(c.paths, path)
+		return 0, false
+	}
+	return resolved.index, true
+}
+
+func (c *resolverCache) setPath(path string, index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths[path] = resolvedPath{index: index, expiresAt: time.Now().Add(resolveCacheTTL)}
+}
+
+func (c *resolverCache) forgetPath(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.paths, path)
+}
+
+// nodesToProbe returns indexes of nodes which are not skipped, all nodes if all of them are skipped
+func (c *resolverCache) nodesToProbe() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	indexes := []int{}
+	for index := range c.nodes {
+		if !c.isSkipped(index) {
+			indexes = append(indexes, index)
+		}
+	}
+
+	if len(indexes) == 0 {
+		for index := range c.nodes {
+			indexes = append(indexes, index)
+		}
+	}
+
+	return indexes
+}
+
+func (c *resolverCache) isSkipped(index int) bool {
+	return time.Now().Before(c.nodes[index].skipUntil)
+}
+
+// nodeSucceeded resets node failures, returns true if the node was skipped
+func (c *resolverCache) nodeSucceeded(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wasSkipped := c.nodes[index].failures >= nodeFailuresThreshold
+	c.nodes[index] = nodeHealth{}
+	return wasSkipped
+}
+
+// nodeFailed counts node failure, returns true if the node has just started to be skipped
+func (c *resolverCache) nodeFailed(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node := &c.nodes[index]
+	node.failures++
+	if node.failures < nodeFailuresThreshold || c.isSkipped(index) {
+		return false
+	}
+
+	node.skipUntil = time.Now().Add(nodeSkipInterval)
+
+	// drop all paths of the node, they will be resolved on other nodes
+	for path, resolved := range c.paths {
+		if resolved.index == index {
+			delete(c.paths, path)
+		}
+	}
+
+	return node.failures == nodeFailuresThreshold
+}
+
+// resolvedNode - NS node returned by the resolver, its request errors drop resolved path from the cache
+// and are counted by the node's circuit breaker. Only methods used by the driver are wrapped.
+type resolvedNode struct {
+	ns.ProviderInterface
+	resolver *resolver
+	index    int
+	path     string
+}
+
+func (n *resolvedNode) String() string {
+	return fmt.Sprint(n.ProviderInterface)
+}
+
+func (n *resolvedNode) done(err error) error {
+	if err != nil {
+		n.resolver.cache.forgetPath(n.path)
+	}
+	n.resolver.report(n.index, err)
+	return err
+}
+
+// GetFilesystem returns filesystem by its path
+func (n *resolvedNode) GetFilesystem(path string) (ns.Filesystem, error) {
+	filesystem, err := n.ProviderInterface.GetFilesystem(path)
+	return filesystem, n.done(err)
+}
+
+// GetFilesystems returns all filesystems by parent filesystem
+func (n *resolvedNode) GetFilesystems(parent string) ([]ns.Filesystem, error) {
+	filesystems, err := n.ProviderInterface.GetFilesystems(parent)
+	return filesystems, n.done(err)
+}
+
+// CreateFilesystem creates filesystem, existing filesystem is not an error of the node
+func (n *resolvedNode) CreateFilesystem(params ns.CreateFilesystemParams) error {
+	err := n.ProviderInterface.CreateFilesystem(params)
+	if ns.IsAlreadyExistNefError(err) {
+		return err
+	}
+	return n.done(err)
+}
+
+// CreateNfsShare shares filesystem over NFS
+func (n *resolvedNode) CreateNfsShare(params ns.CreateNfsShareParams) error {
+	return n.done(n.ProviderInterface.CreateNfsShare(params))
+}
+
+// SetFilesystemACL sets filesystem ACL
+func (n *resolvedNode) SetFilesystemACL(path string, aclRuleSet ns.ACLRuleSet) error {
+	return n.done(n.ProviderInterface.SetFilesystemACL(path, aclRuleSet))
+}
+
+// DeleteNfsShare deletes filesystem NFS share
+func (n *resolvedNode) DeleteNfsShare(path string) error {
+	return n.done(n.ProviderInterface.DeleteNfsShare(path))
+}
+
+// DestroyFilesystem destroys filesystem
+func (n *resolvedNode) DestroyFilesystem(path string, params ns.DestroyFilesystemParams) error {
+	return n.done(n.ProviderInterface.DestroyFilesystem(path, params))
+}
+
+// GetFilesystemProperties returns filesystem by its path with user properties
+func (n *resolvedNode) GetFilesystemProperties(path string) (filesystemProperties, error) {
+	filesystem, err := getFilesystemProperties(n.ProviderInterface, path)
+	return filesystem, n.done(err)
+}
+
+// GetFilesystemsPropertiesWithStartingToken returns a page of filesystems by parent filesystem with user properties
+// after specified starting token
+func (n *resolvedNode) GetFilesystemsPropertiesWithStartingToken(parent, startingToken string, limit int) (
+	[]filesystemProperties,
+	string,
+	error,
+) {
+	filesystems, nextToken, err := getFilesystemsPropertiesWithStartingToken(
+		n.ProviderInterface,
+		parent,
+		startingToken,
+		limit,
+	)
+	return filesystems, nextToken, n.done(err)
+}
+
+// SetFilesystemProperties sets filesystem user properties
+func (n *resolvedNode) SetFilesystemProperties(path string, properties map[string]string) error {
+	return n.done(setFilesystemProperties(n.ProviderInterface, path, properties))
+}
+
+// SetFilesystemQuota sets referenced quota size of the filesystem
+func (n *resolvedNode) SetFilesystemQuota(path string, size int64) error {
+	return n.done(setFilesystemQuota(n.ProviderInterface, path, size))
+}
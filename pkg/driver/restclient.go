@@ -0,0 +1,294 @@
+package driver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/metrics"
+)
+
+// NS async job status path prefix, see ns.Provider.IsJobDone()
+const jobStatusPathPrefix = "/jobStatus/"
+
+// forget async jobs which status was not requested for this time (job wait timeout exceeded)
+const jobTrackingTimeout = time.Hour
+
+// serverError - HTTP 5xx response of NS, such requests may succeed on retry
+type serverError struct {
+	statusCode int
+	message    string
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("request error (HTTP %d): %s", e.statusCode, e.message)
+}
+
+// isServerError returns true if the error is HTTP 5xx response of NS
+func isServerError(err error) bool {
+	if nefErr, ok := err.(*ns.NefError); ok {
+		err = nefErr.Err
+	}
+	_, ok := err.(*serverError)
+	return ok
+}
+
+// restClient - NS REST API client, it replaces the vendored one to log with request scoped logger,
+// to stop requests when plugin request deadline is exceeded and to collect metrics for each appliance node.
+// Copies created by withContext() share HTTP connections, auth token and async jobs tracking.
+type restClient struct {
+	address    string
+	httpClient *http.Client
+	jobTimeout time.Duration
+	ctx        context.Context
+	log        *logrus.Entry
+	state      *restClientState
+}
+
+// restClientState - state shared between all copies of the REST client
+type restClientState struct {
+	mu        sync.Mutex
+	authToken string
+	jobs      map[string]time.Time // job ID -> job start time
+}
+
+func newRestClient(address string, log *logrus.Entry, timeout, jobTimeout time.Duration) *restClient {
+	return &restClient{
+		address:    address,
+		jobTimeout: jobTimeout,
+		ctx:        context.Background(),
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				IdleConnTimeout: 60 * time.Second,
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true, //TODO move to config
+				},
+			},
+			Timeout: timeout,
+		},
+		log: log.WithField("cmp", "RestClient"),
+		state: &restClientState{
+			jobs: map[string]time.Time{},
+		},
+	}
+}
+
+// withContext returns a copy of the client which requests are stopped when the context is done
+// and which logs to the given logger
+func (c *restClient) withContext(ctx context.Context, log *logrus.Entry) *restClient {
+	clientCopy := *c
+	clientCopy.ctx = ctx
+	clientCopy.log = log.WithField("cmp", "RestClient")
+	return &clientCopy
+}
+
+// setRestClients replaces REST clients of all resolver's nodes
+func setRestClients(nsResolver *ns.Resolver, log *logrus.Entry, timeout, jobTimeout time.Duration) {
+	for _, node := range nsResolver.Nodes {
+		if provider, ok := node.(*ns.Provider); ok {
+			provider.RestClient = newRestClient(
+				provider.Address,
+				log.WithField("ns", provider.Address),
+				timeout,
+				jobTimeout,
+			)
+		}
+	}
+}
+
+// BuildURI builds request URI using [path?params...] format
+func (c *restClient) BuildURI(uri string, params map[string]string) string {
+	paramValues := url.Values{}
+	for key, val := range params {
+		if len(val) != 0 {
+			paramValues.Set(key, val)
+		}
+	}
+
+	if paramsStr := paramValues.Encode(); len(paramsStr) != 0 {
+		uri = fmt.Sprintf("%s?%s", uri, paramsStr)
+	}
+
+	return uri
+}
+
+// SetAuthToken sets Bearer auth token for all requests of all client copies
+func (c *restClient) SetAuthToken(token string) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+	c.state.authToken = token
+}
+
+// Send sends request to REST server, collects request duration, errors and async job wait time.
+// Status request of an async job started more than jobTimeout ago fails, so the provider stops waiting for it.
+func (c *restClient) Send(method, path string, data interface{}) (int, []byte, error) {
+	startTime := time.Now()
+
+	var statusCode int
+	var bodyBytes []byte
+	err := c.checkJobTimeout(path)
+	if err == nil {
+		statusCode, bodyBytes, err = c.send(method, path, data)
+	}
+
+	metrics.RestRequestDuration.Observe(time.Since(startTime).Seconds(), c.address, method)
+	if err != nil || (statusCode >= 400 && statusCode != http.StatusUnauthorized) { // 401 leads to re-login
+		metrics.RestErrors.Inc(c.address, method)
+	}
+
+	c.trackJob(path, statusCode, bodyBytes, err, startTime)
+
+	return statusCode, bodyBytes, err
+}
+
+func (c *restClient) send(method, path string, data interface{}) (int, []byte, error) {
+	l := c.log.WithFields(logrus.Fields{
+		"func": "Send()",
+		"req":  fmt.Sprintf("%s %s", method, path),
+	})
+
+	uri := fmt.Sprintf("%s/%s", c.address, path)
+
+	l.Debug("send request")
+
+	// send request data as json
+	var jsonDataReader io.Reader
+	if data != nil {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		jsonDataReader = strings.NewReader(string(jsonData))
+		if path != "auth/login" { // don't log passwords
+			l.Debugf("data: %+v", data)
+		}
+	}
+
+	req, err := http.NewRequest(method, uri, jsonDataReader)
+	if err != nil {
+		l.Errorf("request creation error: %s", err)
+		return 0, nil, err
+	}
+
+	req = req.WithContext(c.ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	c.state.mu.Lock()
+	authToken := c.state.authToken
+	c.state.mu.Unlock()
+	if len(authToken) != 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", authToken))
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		l.Debugf("request error: %s", err)
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+
+	l.Debugf("response status code: %d", res.StatusCode)
+
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return res.StatusCode, nil, fmt.Errorf("Cannot read body of request '%s %s': '%s'", method, uri, err)
+	}
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return res.StatusCode, bodyBytes, newServerError(res.StatusCode, bodyBytes)
+	}
+
+	return res.StatusCode, bodyBytes, nil
+}
+
+// newServerError returns HTTP 5xx response as an error, so the vendored provider doesn't parse it,
+// NefError code of the response is kept (e.g. EBUSY)
+func newServerError(statusCode int, bodyBytes []byte) error {
+	response := struct {
+		Name    string `json:"name"`
+		Message string `json:"message"`
+		Code    string `json:"code"`
+	}{}
+	if json.Unmarshal(bodyBytes, &response) != nil || (response.Message == "" && response.Code == "") {
+		return &serverError{statusCode: statusCode, message: string(bodyBytes)}
+	}
+
+	message := response.Message
+	if response.Name != "" {
+		message = fmt.Sprintf("%s: %s", response.Name, message)
+	}
+	return &ns.NefError{
+		Err:  &serverError{statusCode: statusCode, message: message},
+		Code: response.Code,
+	}
+}
+
+// checkJobTimeout returns an error for status request of a job which is not finished in jobTimeout
+func (c *restClient) checkJobTimeout(path string) error {
+	if !strings.HasPrefix(path, jobStatusPathPrefix) || c.jobTimeout <= 0 {
+		return nil
+	}
+
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	jobID := strings.TrimPrefix(path, jobStatusPathPrefix)
+	if jobStartTime, ok := c.state.jobs[jobID]; ok && time.Since(jobStartTime) > c.jobTimeout {
+		return fmt.Errorf("DeadlineExceeded: NexentaStor job '%s' is not finished in %s", jobID, c.jobTimeout)
+	}
+
+	return nil
+}
+
+// trackJob memorizes async job start time and observes job wait time when job status request says it's done
+func (c *restClient) trackJob(path string, statusCode int, bodyBytes []byte, err error, startTime time.Time) {
+	c.state.mu.Lock()
+	defer c.state.mu.Unlock()
+
+	if strings.HasPrefix(path, jobStatusPathPrefix) {
+		jobID := strings.TrimPrefix(path, jobStatusPathPrefix)
+		if jobStartTime, ok := c.state.jobs[jobID]; ok && (err != nil || statusCode != http.StatusAccepted) {
+			metrics.JobWaitDuration.Observe(time.Since(jobStartTime).Seconds(), c.address)
+			delete(c.state.jobs, jobID)
+		}
+		return
+	}
+
+	if err != nil || statusCode != http.StatusAccepted {
+		return
+	}
+
+	response := struct {
+		Links []struct {
+			Rel  string `json:"rel"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}{}
+	if json.Unmarshal(bodyBytes, &response) != nil {
+		return
+	}
+
+	for jobID, jobStartTime := range c.state.jobs {
+		if time.Since(jobStartTime) > jobTrackingTimeout {
+			delete(c.state.jobs, jobID)
+		}
+	}
+
+	for _, link := range response.Links {
+		if link.Rel == "monitor" && link.Href != "" {
+			c.state.jobs[strings.TrimPrefix(link.Href, jobStatusPathPrefix)] = startTime
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// withRetry resolves NS node by the path and runs fn on it (fn may be nil to resolve the path only).
+// Transient errors are retried up to `retryAttempts` times with exponential backoff and jitter,
+// the path is resolved again before each retry, so the request goes to the node which owns the pool
+// after HA failover. fn must be idempotent. Retries are stopped when the request deadline is exceeded.
+//
+// Returned node is nil if the path cannot be resolved, otherwise the error is the last fn error.
+func (r *request) withRetry(path string, fn func(nsProvider ns.ProviderInterface) error) (
+	ns.ProviderInterface,
+	error,
+) {
+	l := r.log.WithField("func", "withRetry()")
+
+	delay := time.Duration(r.config.RetryDelay) * time.Millisecond
+	maxDelay := time.Duration(r.config.RetryMaxDelay) * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		nsProvider, err := r.resolver.resolve(path)
+		if err == nil {
+			if fn == nil {
+				return nsProvider, nil
+			}
+			if err = fn(nsProvider); err == nil {
+				return nsProvider, nil
+			}
+		}
+
+		if ctxErr := r.contextError(); ctxErr != nil {
+			return nsProvider, ctxErr
+		}
+
+		if attempt >= r.config.RetryAttempts || !r.isTransientError(path, nsProvider == nil, err) {
+			if nsProvider == nil {
+				err = humanizeResolveError(path, err)
+			}
+			return nsProvider, err
+		}
+
+		wait := withJitter(delay, r.config.RetryJitter)
+		l.Warnf(
+			"request to NexentaStor failed, retry in %s (attempt %d of %d): %s",
+			wait,
+			attempt,
+			r.config.RetryAttempts,
+			err,
+		)
+		select {
+		case <-time.After(wait):
+		case <-r.ctx.Done():
+			return nsProvider, r.contextError()
+		}
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// isTransientError returns true if the request may succeed on retry:
+//   - network error, async job timeout (not a NefError),
+//   - HTTP 5xx response,
+//   - EBUSY: the pool is being exported or imported during HA failover,
+//   - ENOENT while resolving plugin's dataset: the pool is not imported on any node yet.
+//
+// ENOENT of a volume filesystem is a regular error, such requests are not retried.
+func (r *request) isTransientError(path string, resolveFailed bool, err error) bool {
+	if !ns.IsNefError(err) || isServerError(err) || ns.IsBusyNefError(err) {
+		return true
+	}
+	return resolveFailed && ns.IsNotExistNefError(err) && path == r.config.DefaultDataset
+}
+
+// withJitter randomly changes the delay by up to jitter percent in both directions,
+// so requests failed at the same time are not retried at the same time
+func withJitter(delay time.Duration, jitter int) time.Duration {
+	if jitter == 0 {
+		return delay
+	}
+	factor := 1 + float64(jitter)/100*(2*rand.Float64()-1)
+	return time.Duration(float64(delay) * factor)
+}
@@ -0,0 +1,121 @@
+package driver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// minimal time to wait for a volume lock on shutdown, even if shutdown timeout is over: free lock is acquired at once
+const shutdownMinLockTimeout = 100 * time.Millisecond
+
+// inFlight tracks requests which change NS filesystems or mounts, so shutdown can wait for them
+type inFlight struct {
+	mu       sync.Mutex
+	closed   bool
+	requests sync.WaitGroup
+}
+
+// enter registers a new request, it fails if the plugin is shutting down
+func (f *inFlight) enter() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return fmt.Errorf("Unavailable: Plugin is shutting down, retry the request after plugin restart")
+	}
+	f.requests.Add(1)
+
+	return nil
+}
+
+// leave marks registered request as finished
+func (f *inFlight) leave() {
+	f.requests.Done()
+}
+
+// close rejects new requests and waits for registered ones, returns false on timeout
+func (f *inFlight) close(timeout time.Duration) bool {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		f.requests.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Shutdown drains the driver before the plugin exits: new Create, Remove, Mount and Unmount requests are
+// rejected, in-flight ones are waited for up to `shutdownTimeout` seconds. Then the state is written to the file
+// and, if `unmountOnShutdown` is set, volumes not used by any container are unmounted.
+// Health check must be stopped before.
+func (d *Driver) Shutdown() error {
+	l := d.log.WithField("func", "Shutdown()")
+	cfg := d.snapshot().config
+
+	timeout := time.Duration(cfg.ShutdownTimeout) * time.Second
+	deadline := time.Now().Add(timeout)
+	l.Infof("stop accepting requests, wait up to %s for in-flight ones...", timeout)
+	if d.inFlight.close(timeout) {
+		l.Info("all in-flight requests are finished")
+	} else {
+		l.Warnf("some requests are not finished in %s, they will be interrupted", timeout)
+	}
+
+	if cfg.UnmountOnShutdown {
+		d.unmountUnusedVolumes(deadline)
+	}
+
+	if err := d.state.Flush(); err != nil {
+		return fmt.Errorf("Cannot write state on shutdown: %s", err)
+	}
+
+	l.Info("done")
+	return nil
+}
+
+// unmountUnusedVolumes unmounts volumes which have no container bind mounts. Volume locked by a request
+// which is not finished by the shutdown deadline is skipped, the request may still mount it.
+func (d *Driver) unmountUnusedVolumes(deadline time.Time) {
+	r := d.newRequest("unmountUnusedVolumes()")
+	l := r.log
+	defer r.finish(nil)
+
+	for name, volume := range r.state.Volumes() {
+		if len(volume.Binds) != 0 {
+			continue
+		}
+
+		// request not finished in time may still mount the volume
+		lockTimeout := time.Until(deadline)
+		if lockTimeout < shutdownMinLockTimeout {
+			lockTimeout = shutdownMinLockTimeout
+		}
+		unlock := d.tryLockVolume(name, lockTimeout)
+		if unlock == nil {
+			l.Warnf("volume '%s' is locked by not finished request, skip unmount", name)
+			continue
+		}
+		if volume, ok := r.state.GetVolume(name); !ok || len(volume.Binds) != 0 {
+			unlock()
+			continue
+		}
+		if err := r.mounter.Unmount(volume.MountPoint); err != nil {
+			l.Warnf("cannot unmount not used volume '%s': %s", name, err)
+		} else if err := r.state.RemoveVolume(name); err != nil {
+			l.Warnf("cannot save volume unmount to the state: %s", err)
+		} else {
+			l.Infof("not used volume '%s' has been unmounted", name)
+		}
+		unlock()
+	}
+}
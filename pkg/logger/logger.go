@@ -0,0 +1,124 @@
+// Logger creates plugin logger: text or JSON format, per-component log levels, log file rotation
+
+package logger
+
+import (
+	"io"
+	"os"
+
+	nestedLogrusFormatter "github.com/antonfisher/nested-logrus-formatter"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+)
+
+// fields order for text format
+var textFieldsOrder = []string{"driver", "cmp", "ns", "func", "rid", "req", "job"}
+
+// Logger - plugin logger writes to stdout and to the log file
+type Logger struct {
+	entry *logrus.Entry
+	file  *RotatingFile
+}
+
+// New creates a new logger with text format and info level, use Configure() to apply config options
+func New(fields logrus.Fields, logFilePath string) *Logger {
+	l := logrus.New().WithFields(fields)
+
+	l.Logger.SetFormatter(newTextFormatter())
+
+	file, err := NewRotatingFile(logFilePath)
+	if err != nil {
+		l.Logger.SetOutput(os.Stdout)
+		l.Warnf("failed to create log file '%s' inside the container: %s", logFilePath, err)
+		return &Logger{entry: l}
+	}
+
+	l.Logger.SetOutput(io.MultiWriter(os.Stdout, file))
+
+	return &Logger{entry: l, file: file}
+}
+
+// Entry returns logger entry to create component loggers from
+func (l *Logger) Entry() *logrus.Entry {
+	return l.entry
+}
+
+// Close writes log file to disk and closes it, logger writes to stdout only after that
+func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	l.entry.Logger.SetOutput(os.Stdout)
+	return l.file.Close()
+}
+
+// Configure applies log format, levels and log file limits from the config, it's safe to call on config reload
+func (l *Logger) Configure(cfg *config.Config) {
+	defaultLevel := logrus.InfoLevel
+	if cfg.Debug {
+		defaultLevel = logrus.DebugLevel
+	}
+
+	// logger level should allow the most verbose component level, formatter filters the rest
+	maxLevel := defaultLevel
+	levels := map[string]logrus.Level{}
+	for component, levelName := range cfg.LogLevels {
+		level, err := logrus.ParseLevel(levelName)
+		if err != nil { // config is validated already
+			continue
+		}
+		levels[component] = level
+		if level > maxLevel {
+			maxLevel = level
+		}
+	}
+
+	var formatter logrus.Formatter
+	if cfg.LogFormat == config.LogFormatJSON {
+		formatter = &logrus.JSONFormatter{}
+	} else {
+		formatter = newTextFormatter()
+	}
+
+	l.entry.Logger.SetFormatter(&componentLevelFormatter{
+		Formatter:    formatter,
+		defaultLevel: defaultLevel,
+		levels:       levels,
+	})
+	l.entry.Logger.SetLevel(maxLevel)
+
+	if l.file != nil {
+		l.file.SetLimits(int64(cfg.LogMaxSize)*1024*1024, cfg.LogMaxFiles)
+	}
+}
+
+func newTextFormatter() logrus.Formatter {
+	return &nestedLogrusFormatter.Formatter{
+		HideKeys:    true,
+		FieldsOrder: textFieldsOrder,
+	}
+}
+
+// componentLevelFormatter skips entries which level is higher than the level set for entry's component ("cmp")
+type componentLevelFormatter struct {
+	logrus.Formatter
+	defaultLevel logrus.Level
+	levels       map[string]logrus.Level
+}
+
+// Format returns empty output for skipped entries
+func (f *componentLevelFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	level := f.defaultLevel
+	if component, ok := entry.Data["cmp"].(string); ok {
+		if componentLevel, ok := f.levels[component]; ok {
+			level = componentLevel
+		}
+	}
+
+	if entry.Level > level {
+		return nil, nil
+	}
+
+	return f.Formatter.Format(entry)
+}
@@ -0,0 +1,128 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RotatingFile - log file writer that rotates the file by size and keeps limited number of old files:
+// file.log -> file.log.1 -> file.log.2 ... -> file.log.<maxFiles>
+type RotatingFile struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	maxSize  int64
+	maxFiles int
+
+	// rotateFailed - last rotation has failed, the failure is reported to stderr once until rotation succeeds
+	rotateFailed bool
+}
+
+// NewRotatingFile opens log file for appending, file is created if it doesn't exist
+func NewRotatingFile(path string) (*RotatingFile, error) {
+	f := &RotatingFile{path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SetLimits sets max file size in bytes (0 - no rotation) and count of rotated files to keep
+func (f *RotatingFile) SetLimits(maxSize int64, maxFiles int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxSize = maxSize
+	f.maxFiles = maxFiles
+}
+
+// Write writes data to the log file, rotates the file if it exceeds max size.
+// If the file cannot be rotated, data is appended to the current file, rotation is tried again on next write.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err := f.rotate()
+		if err != nil && !f.rotateFailed {
+			fmt.Fprintf(os.Stderr, "%s, keep writing to the current file\n", err)
+		}
+		f.rotateFailed = err != nil
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// Close writes the log file to disk and closes it
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	// remove files over the limit, the limit may have been decreased
+	oldFiles, _ := filepath.Glob(f.path + ".*")
+	for _, oldFile := range oldFiles {
+		if n, err := strconv.Atoi(strings.TrimPrefix(oldFile, f.path+".")); err == nil && n >= f.maxFiles {
+			os.Remove(oldFile)
+		}
+	}
+
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+
+	// current file stays open, it's still written if rename fails or a new file cannot be opened
+	var err error
+	if f.maxFiles > 0 {
+		err = os.Rename(f.path, f.path+".1")
+	} else {
+		err = os.Remove(f.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Cannot rotate log file '%s': %s", f.path, err)
+	}
+
+	current := f.file
+	if err := f.open(); err != nil {
+		return fmt.Errorf("Cannot open log file '%s' after rotation: %s", f.path, err)
+	}
+	current.Close()
+
+	return nil
+}
@@ -0,0 +1,287 @@
+// Metrics collects plugin metrics and exposes them in Prometheus text format
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// default histogram buckets in seconds, NS async jobs and NFS mounts may take up to minutes
+var defaultBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Collector writes its metrics in Prometheus text format
+type Collector interface {
+	Write(w io.Writer)
+}
+
+// Registry - list of collectors to expose
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry creates a new empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds collectors to the registry
+func (r *Registry) Register(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Write writes all registered metrics in Prometheus text format
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]Collector{}, r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.Write(w)
+	}
+}
+
+// ServeHTTP implements http.Handler to serve metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	r.Write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// metric - common metric description
+type metric struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (m *metric) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, metricType)
+}
+
+// key joins label values to use as a map key
+func (m *metric) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric '%s' expects %d label(s), got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// formatLabels returns labels string: {a="1",b="2"}
+func (m *metric) formatLabels(key string, extra ...string) string {
+	pairs := []string{}
+	if len(m.labels) != 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", m.labels[i], escapeLabelValue(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], escapeLabelValue(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CounterVec - counters partitioned by labels
+type CounterVec struct {
+	metric
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec creates a new counter
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		metric: metric{name: name, help: help, labels: labels},
+		values: map[string]float64{},
+	}
+}
+
+// Inc increments counter for label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+// Get returns counter value for label values
+func (c *CounterVec) Get(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// Write writes counter in Prometheus text format
+func (c *CounterVec) Write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHeader(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.formatLabels(key), formatFloat(c.values[key]))
+	}
+}
+
+// GaugeFunc - gauges which values are collected on each metrics request
+type GaugeFunc struct {
+	metric
+	mu      sync.Mutex
+	collect func() map[string]float64
+}
+
+// NewGaugeFunc creates a new gauge, values are collected by a function set by SetCollectFunc()
+func NewGaugeFunc(name, help string, labels ...string) *GaugeFunc {
+	return &GaugeFunc{
+		metric: metric{name: name, help: help, labels: labels},
+	}
+}
+
+// SetCollectFunc sets function to collect values on each metrics request,
+// returned map keys are label values joined by Join()
+func (g *GaugeFunc) SetCollectFunc(collect func() map[string]float64) {
+	g.mu.Lock()
+	g.collect = collect
+	g.mu.Unlock()
+}
+
+// Write writes gauge in Prometheus text format
+func (g *GaugeFunc) Write(w io.Writer) {
+	g.mu.Lock()
+	collect := g.collect
+	g.mu.Unlock()
+
+	g.writeHeader(w, "gauge")
+	if collect == nil {
+		return
+	}
+
+	values := collect()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.formatLabels(key), formatFloat(values[key]))
+	}
+}
+
+// Join joins label values to use as GaugeFunc collect function's map key
+func Join(labelValues ...string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// HistogramVec - histograms partitioned by labels
+type HistogramVec struct {
+	metric
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec creates a new histogram with default buckets (seconds)
+func NewHistogramVec(name, help string, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		metric:  metric{name: name, help: help, labels: labels},
+		buckets: defaultBuckets,
+		values:  map[string]*histogramValue{},
+	}
+}
+
+// Observe adds an observation for label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+			break
+		}
+	}
+	v.sum += value
+	v.count++
+}
+
+// Count returns observations count for label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if v, ok := h.values[key]; ok {
+		return v.count
+	}
+	return 0
+}
+
+// Write writes histogram in Prometheus text format
+func (h *HistogramVec) Write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w, "histogram")
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += v.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(key, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.formatLabels(key), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.formatLabels(key), v.count)
+	}
+}
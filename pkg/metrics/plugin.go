@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+)
+
+// metrics name prefix
+const prefix = "nsdvp_"
+
+// plugin metrics
+var (
+	// DriverRequests - volume.Driver method calls by method and status ("ok", "error")
+	DriverRequests = NewCounterVec(
+		prefix+"driver_requests_total",
+		"Docker volume driver requests.",
+		"method", "status",
+	)
+
+	// DriverRequestDuration - volume.Driver method call durations
+	DriverRequestDuration = NewHistogramVec(
+		prefix+"driver_request_duration_seconds",
+		"Docker volume driver request duration in seconds.",
+		"method",
+	)
+
+	// Errors - errors returned to Docker by code (InvalidArgument, InternalError, NEF codes...)
+	Errors = NewCounterVec(
+		prefix+"errors_total",
+		"Errors returned to Docker by error code.",
+		"code",
+	)
+
+	// RestRequestDuration - NexentaStor REST API call durations by appliance node
+	RestRequestDuration = NewHistogramVec(
+		prefix+"rest_request_duration_seconds",
+		"NexentaStor REST API request duration in seconds.",
+		"node", "method",
+	)
+
+	// RestErrors - failed NexentaStor REST API calls (network errors and 4xx/5xx responses) by appliance node
+	RestErrors = NewCounterVec(
+		prefix+"rest_errors_total",
+		"NexentaStor REST API request errors.",
+		"node", "method",
+	)
+
+	// JobWaitDuration - NexentaStor async job wait durations by appliance node
+	JobWaitDuration = NewHistogramVec(
+		prefix+"job_wait_duration_seconds",
+		"NexentaStor async job wait duration in seconds.",
+		"node",
+	)
+
+	// MountedVolumes - NS filesystems currently mounted on the host
+	MountedVolumes = NewGaugeFunc(
+		prefix+"mounted_volumes",
+		"Volumes currently mounted on the host.",
+	)
+
+	// BindMounts - container bind mounts by volume
+	BindMounts = NewGaugeFunc(
+		prefix+"bind_mounts",
+		"Container bind mounts by volume.",
+		"volume",
+	)
+
+	// VolumeMountHealthy - volume NFS mount health check result by volume: 1 - healthy, 0 - stale or not responding
+	VolumeMountHealthy = NewGaugeFunc(
+		prefix+"volume_mount_healthy",
+		"Volume mount health check result (1 - healthy, 0 - failed).",
+		"volume",
+	)
+
+	// VolumeRemounts - automatic remounts of unhealthy volume mounts by status ("ok", "error")
+	VolumeRemounts = NewCounterVec(
+		prefix+"volume_remounts_total",
+		"Automatic remounts of unhealthy volume mounts.",
+		"status",
+	)
+)
+
+// Default - registry with all plugin metrics
+var Default = NewRegistry()
+
+func init() {
+	Default.Register(
+		DriverRequests,
+		DriverRequestDuration,
+		Errors,
+		RestRequestDuration,
+		RestErrors,
+		JobWaitDuration,
+		MountedVolumes,
+		BindMounts,
+		VolumeMountHealthy,
+		VolumeRemounts,
+	)
+}
+
+// plugin errors start with a code, NEF errors end with "[code: CODE]"
+var regexpErrorCode = regexp.MustCompile(`^([A-Z][A-Za-z]+): `)
+var regexpNefErrorCode = regexp.MustCompile(`\[code: ([A-Z]+)\]`)
+
+// ErrorCode returns error code to use as a label: NEF code if presented, then plugin code, "Unknown" otherwise
+func ErrorCode(err error) string {
+	if code := ns.GetNefErrorCode(err); code != "" {
+		return code
+	}
+
+	message := err.Error()
+	if m := regexpNefErrorCode.FindStringSubmatch(message); m != nil {
+		return m[1]
+	} else if m := regexpErrorCode.FindStringSubmatch(message); m != nil {
+		return m[1]
+	}
+
+	return "Unknown"
+}
+
+// instrumentedDriver counts and times volume.Driver calls
+type instrumentedDriver struct {
+	driver volume.Driver
+}
+
+// InstrumentDriver returns volume.Driver that collects metrics for each call of the given driver
+func InstrumentDriver(driver volume.Driver) volume.Driver {
+	return &instrumentedDriver{driver: driver}
+}
+
+func observe(method string, startTime time.Time, err error) {
+	DriverRequestDuration.Observe(time.Since(startTime).Seconds(), method)
+	if err != nil {
+		DriverRequests.Inc(method, "error")
+		Errors.Inc(ErrorCode(err))
+	} else {
+		DriverRequests.Inc(method, "ok")
+	}
+}
+
+func (d *instrumentedDriver) Create(req *volume.CreateRequest) error {
+	startTime := time.Now()
+	err := d.driver.Create(req)
+	observe("Create", startTime, err)
+	return err
+}
+
+func (d *instrumentedDriver) List() (*volume.ListResponse, error) {
+	startTime := time.Now()
+	res, err := d.driver.List()
+	observe("List", startTime, err)
+	return res, err
+}
+
+func (d *instrumentedDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
+	startTime := time.Now()
+	res, err := d.driver.Get(req)
+	observe("Get", startTime, err)
+	return res, err
+}
+
+func (d *instrumentedDriver) Remove(req *volume.RemoveRequest) error {
+	startTime := time.Now()
+	err := d.driver.Remove(req)
+	observe("Remove", startTime, err)
+	return err
+}
+
+func (d *instrumentedDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
+	startTime := time.Now()
+	res, err := d.driver.Path(req)
+	observe("Path", startTime, err)
+	return res, err
+}
+
+func (d *instrumentedDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
+	startTime := time.Now()
+	res, err := d.driver.Mount(req)
+	observe("Mount", startTime, err)
+	return res, err
+}
+
+func (d *instrumentedDriver) Unmount(req *volume.UnmountRequest) error {
+	startTime := time.Now()
+	err := d.driver.Unmount(req)
+	observe("Unmount", startTime, err)
+	return err
+}
+
+func (d *instrumentedDriver) Capabilities() *volume.CapabilitiesResponse {
+	startTime := time.Now()
+	res := d.driver.Capabilities()
+	observe("Capabilities", startTime, nil)
+	return res
+}
@@ -3,27 +3,86 @@
 package mounter
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"                //TODO use interface?
 	k8sMount "k8s.io/kubernetes/pkg/util/mount" //TODO use interface?
 )
 
+// errTimeout is returned by a command killed by timeout
+var errTimeout = errors.New("timed out")
+
+// errCanceled is returned by a command killed because Mounter's context is done
+var errCanceled = errors.New("canceled")
+
 // Mounter executes mount/umount commands, finds out mount list
 type Mounter struct {
 	log   *logrus.Entry
 	mount k8sMount.Interface
+
+	// command timeouts, 0 - no timeout
+	mountTimeout   time.Duration
+	unmountTimeout time.Duration
+
+	// commands are killed when the context is done, e.g. plugin request deadline is exceeded
+	ctx context.Context
 }
 
 // New creates a new Mounter
 func New(log *logrus.Entry) *Mounter {
+	return NewWithInterface(log, k8sMount.New(""))
+}
+
+// NewWithInterface creates a new Mounter which gets mount list and checks mount points by the given interface,
+// e.g. fake mount table in tests; mount/umount commands are executed as usual
+func NewWithInterface(log *logrus.Entry, mount k8sMount.Interface) *Mounter {
 	l := log.WithField("cmp", "Mounter")
 
 	return &Mounter{
 		log:   l,
-		mount: k8sMount.New(""),
+		mount: mount,
+		ctx:   context.Background(),
+	}
+}
+
+// WithLog returns a copy of the Mounter which logs to the given logger, e.g. with request scoped fields
+func (m *Mounter) WithLog(log *logrus.Entry) *Mounter {
+	return &Mounter{
+		log:            log.WithField("cmp", "Mounter"),
+		mount:          m.mount,
+		mountTimeout:   m.mountTimeout,
+		unmountTimeout: m.unmountTimeout,
+		ctx:            m.ctx,
+	}
+}
+
+// WithTimeouts returns a copy of the Mounter with mount and umount commands timeouts
+func (m *Mounter) WithTimeouts(mountTimeout, unmountTimeout time.Duration) *Mounter {
+	return &Mounter{
+		log:            m.log,
+		mount:          m.mount,
+		mountTimeout:   mountTimeout,
+		unmountTimeout: unmountTimeout,
+		ctx:            m.ctx,
+	}
+}
+
+// WithContext returns a copy of the Mounter which commands are killed when the context is done
+func (m *Mounter) WithContext(ctx context.Context) *Mounter {
+	return &Mounter{
+		log:            m.log,
+		mount:          m.mount,
+		mountTimeout:   m.mountTimeout,
+		unmountTimeout: m.unmountTimeout,
+		ctx:            ctx,
 	}
 }
 
@@ -63,14 +122,24 @@ func (m *Mounter) FindMountByTargetPathHasPrefix(targetPath string) ([]k8sMount.
 
 // BindMount prepares and executes bind mount command
 func (m *Mounter) BindMount(mountSource, targetPath string) error {
-	return m.Mount(mountSource, targetPath, "", []string{"bind", "remount"})
+	return m.Mount(mountSource, targetPath, "", []string{"bind"})
 }
 
-// Mount prepares and executes mount command
+// Mount prepares and executes mount command.
+// Mount command which is not finished in time or when the context is done is killed, the target path
+// is lazily unmounted in case it has been mounted meanwhile.
 func (m *Mounter) Mount(mountSource, targetPath, fsType string, mountOptions []string) error {
 	// check if mountpoint exists, create if there is no such directory
-	notMountPoint, err := m.mount.IsLikelyNotMountPoint(targetPath)
-	if err != nil {
+	notMountPoint, err := m.isLikelyNotMountPoint(targetPath, m.mountTimeout)
+	if err == errCanceled {
+		return fmt.Errorf("Canceled: Check of target path '%s' is interrupted: %s", targetPath, m.ctx.Err())
+	} else if err == errTimeout {
+		return fmt.Errorf(
+			"DeadlineExceeded: Target path '%s' doesn't respond in %s, it may be a hung mount",
+			targetPath,
+			m.mountTimeout,
+		)
+	} else if err != nil {
 		if os.IsNotExist(err) {
 			if err := os.MkdirAll(targetPath, 0750); err != nil {
 				return fmt.Errorf(
@@ -93,49 +162,109 @@ func (m *Mounter) Mount(mountSource, targetPath, fsType string, mountOptions []s
 		return fmt.Errorf("InternalError: Target path '%s' is already a mount point", targetPath)
 	}
 
-	o := strings.Join(mountOptions, ",")
-	if fsType == "" {
-		m.log.Infof("mount -o %s %s %s", o, mountSource, targetPath)
-	} else {
-		m.log.Infof("mount -t %s -o %s %s %s", fsType, o, mountSource, targetPath)
+	args := []string{}
+	if fsType != "" {
+		args = append(args, "-t", fsType)
 	}
+	if len(mountOptions) != 0 {
+		args = append(args, "-o", strings.Join(mountOptions, ","))
+	}
+	args = append(args, mountSource, targetPath)
 
-	err = m.mount.Mount(mountSource, targetPath, fsType, mountOptions)
-	if err != nil {
-		if os.IsPermission(err) {
+	m.log.Infof("mount %s", strings.Join(args, " "))
+
+	output, err := m.run(m.ctx, m.mountTimeout, "mount", args...)
+	if err == errTimeout || err == errCanceled {
+		m.log.Warnf("mount of '%s' is not finished (%s), killed, detach '%s'", mountSource, err, targetPath)
+
+		// lazy unmount is not bound to the context, the target path must be released anyway
+		if output, err := m.run(context.Background(), m.unmountTimeout, "umount", "-l", targetPath); err != nil {
+			m.log.Debugf("lazy unmount of '%s' after mount timeout: %s, output: %s", targetPath, err, output)
+		}
+		if err == errCanceled {
+			return fmt.Errorf("Canceled: Mount '%s' to '%s' is interrupted: %s", mountSource, targetPath, m.ctx.Err())
+		}
+		return fmt.Errorf(
+			"DeadlineExceeded: Mount '%s' to '%s' is not finished in %s, check that '%s' is available",
+			mountSource,
+			targetPath,
+			m.mountTimeout,
+			mountSource,
+		)
+	} else if err != nil {
+		if os.IsPermission(err) || strings.Contains(output, "Permission denied") {
 			return fmt.Errorf(
-				"PermissionDenied: Permission denied to mount '%s' to '%s': %s",
+				"PermissionDenied: Permission denied to mount '%s' to '%s': %s, output: %s",
 				mountSource,
 				targetPath,
 				err,
+				output,
 			)
-		} else if strings.Contains(err.Error(), "invalid argument") {
+		} else if strings.Contains(output, "invalid argument") {
 			return fmt.Errorf(
-				"InvalidArgument: Cannot mount '%s' to '%s', invalid argument: %s",
+				"InvalidArgument: Cannot mount '%s' to '%s', invalid argument: %s, output: %s",
 				mountSource,
 				targetPath,
 				err,
+				output,
 			)
 		}
 		return fmt.Errorf(
-			"InternalError: Failed to mount '%s' to '%s': %s",
+			"InternalError: Failed to mount '%s' to '%s': %s, output: %s",
 			mountSource,
 			targetPath,
 			err,
+			output,
 		)
 	}
 
 	return nil
 }
 
-// Unmount prepares end executes umount command and removes mount point
+// Unmount prepares end executes umount command and removes mount point.
+// Umount command which is not finished in time is killed and retried as forced (umount -f),
+// then as lazy (umount -l) unmount. Commands are killed w/o retries when the context is done.
 func (m *Mounter) Unmount(targetPath string) error {
-	if err := m.mount.Unmount(targetPath); err != nil {
-		return fmt.Errorf("InternalError: Failed to unmount target path '%s': %s", targetPath, err)
+	output, err := m.run(m.ctx, m.unmountTimeout, "umount", targetPath)
+	if err == errTimeout {
+		m.log.Warnf("umount of '%s' is not finished in %s, killed, try forced unmount", targetPath, m.unmountTimeout)
+		output, err = m.run(m.ctx, m.unmountTimeout, "umount", "-f", targetPath)
+		if err != nil && err != errCanceled {
+			m.log.Warnf("forced unmount of '%s' failed: %s, try lazy unmount", targetPath, err)
+			output, err = m.run(m.ctx, m.unmountTimeout, "umount", "-l", targetPath)
+			if err != nil && err != errCanceled {
+				return fmt.Errorf(
+					"DeadlineExceeded: Unmount of target path '%s' is not finished in %s, "+
+						"forced and lazy unmount failed: %s, output: %s",
+					targetPath,
+					m.unmountTimeout,
+					err,
+					output,
+				)
+			} else if err == nil {
+				m.log.Warnf("target path '%s' has been lazily unmounted", targetPath)
+			}
+		} else if err == nil {
+			m.log.Warnf("target path '%s' has been forcibly unmounted", targetPath)
+		}
+	}
+	if err == errCanceled {
+		return fmt.Errorf("Canceled: Unmount of target path '%s' is interrupted: %s", targetPath, m.ctx.Err())
+	} else if err != nil {
+		return fmt.Errorf(
+			"InternalError: Failed to unmount target path '%s': %s, output: %s",
+			targetPath,
+			err,
+			output,
+		)
 	}
 
-	notMountPoint, err := m.mount.IsLikelyNotMountPoint(targetPath)
-	if err != nil {
+	notMountPoint, err := m.isLikelyNotMountPoint(targetPath, m.unmountTimeout)
+	if err == errCanceled {
+		return fmt.Errorf("Canceled: Check of target path '%s' is interrupted: %s", targetPath, m.ctx.Err())
+	} else if err == errTimeout {
+		return fmt.Errorf("DeadlineExceeded: Target path '%s' doesn't respond in %s", targetPath, m.unmountTimeout)
+	} else if err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
@@ -154,3 +283,70 @@ func (m *Mounter) Unmount(targetPath string) error {
 
 	return nil
 }
+
+// isLikelyNotMountPoint checks the path with timeout, stat of a hung NFS mount may never return
+func (m *Mounter) isLikelyNotMountPoint(path string, timeout time.Duration) (bool, error) {
+	type result struct {
+		notMountPoint bool
+		err           error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		notMountPoint, err := m.mount.IsLikelyNotMountPoint(path)
+		done <- result{notMountPoint, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.notMountPoint, r.err
+	case <-after(timeout):
+		return false, errTimeout
+	case <-m.ctx.Done():
+		return false, errCanceled
+	}
+}
+
+// after returns a channel which receives the time after the timeout, nil channel for 0 timeout
+func after(timeout time.Duration) <-chan time.Time {
+	if timeout <= 0 {
+		return nil
+	}
+	return time.After(timeout)
+}
+
+// run executes the command and returns its combined output.
+// Command is started in its own process group, so the whole group (e.g. `mount` and `mount.nfs`)
+// is killed on timeout or when the context is done.
+// The process in uninterruptible sleep can't be killed, it's left behind.
+func (m *Mounter) run(ctx context.Context, timeout time.Duration, name string, args ...string) (string, error) {
+	var output bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err := <-done:
+		return strings.TrimSpace(output.String()), err
+	case <-after(timeout):
+		err = errTimeout
+	case <-ctx.Done():
+		err = errCanceled
+	}
+
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		m.log.Warnf("cannot kill '%s' command: %s", name, err)
+	}
+	return "", err
+}
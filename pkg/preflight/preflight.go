@@ -0,0 +1,172 @@
+// Preflight checks plugin config against live NexentaStor appliance(s)
+
+package preflight
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+)
+
+// NFS server port to check data IP availability
+const defaultNfsPort = "2049"
+
+// timeout to connect to NFS server on data IP
+const nfsDialTimeout = 10 * time.Second
+
+// Check - result of a single preflight check
+type Check struct {
+	Name    string
+	Passed  bool
+	Message string
+}
+
+// Report - preflight checks results
+type Report struct {
+	Checks []Check
+}
+
+func (r *Report) add(name string, err error, message string) {
+	check := Check{Name: name, Passed: err == nil, Message: message}
+	if err != nil {
+		check.Message = err.Error()
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// Failed returns true if at least one check has failed
+func (r *Report) Failed() bool {
+	return r.FailedCount() != 0
+}
+
+// FailedCount returns failed checks count
+func (r *Report) FailedCount() int {
+	count := 0
+	for _, check := range r.Checks {
+		if !check.Passed {
+			count++
+		}
+	}
+	return count
+}
+
+// ExitCode returns `--validate` command exit code: 0 if all checks have passed, 1 otherwise
+func (r *Report) ExitCode() int {
+	if r.Failed() {
+		return 1
+	}
+	return 0
+}
+
+// Print writes human readable report
+func (r *Report) Print(w io.Writer) {
+	for _, check := range r.Checks {
+		status := "PASS"
+		if !check.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, check.Name, check.Message)
+	}
+
+	if r.Failed() {
+		fmt.Fprintf(w, "Result: FAILED (%d of %d checks failed)\n", r.FailedCount(), len(r.Checks))
+	} else {
+		fmt.Fprintf(w, "Result: OK (%d checks passed)\n", len(r.Checks))
+	}
+}
+
+// Args - params to run preflight checks
+type Args struct {
+	Config *config.Config
+	Log    *logrus.Entry
+
+	// NfsPort - NFS server port on default data IP, 2049 if not set
+	NfsPort string
+}
+
+// Run runs all checks against NexentaStor appliance(s) set in the config
+func Run(args Args) *Report {
+	l := args.Log.WithField("cmp", "Preflight")
+	cfg := args.Config
+	report := &Report{}
+
+	nsResolver, err := ns.NewResolver(ns.ResolverArgs{
+		Address:            cfg.Address,
+		Username:           cfg.Username,
+		Password:           cfg.Password,
+		Log:                l,
+		InsecureSkipVerify: true, //TODO move to config
+	})
+	if err != nil {
+		report.add("create NexentaStor resolver", err, "")
+		return report
+	}
+
+	// login and license checks for each node
+	loggedInCount := 0
+	for _, node := range nsResolver.Nodes {
+		if err := node.LogIn(); err != nil {
+			report.add(fmt.Sprintf("login to %s", node), err, "")
+			continue
+		}
+		loggedInCount++
+		report.add(fmt.Sprintf("login to %s", node), nil, fmt.Sprintf("logged in as '%s'", cfg.Username))
+
+		license, err := node.GetLicense()
+		if err == nil && !license.Valid {
+			err = fmt.Errorf("license is not valid (expires: %s)", license.Expires)
+		}
+		report.add(fmt.Sprintf("license on %s", node), err, fmt.Sprintf("valid (expires: %s)", license.Expires))
+	}
+
+	if loggedInCount == 0 {
+		return report
+	}
+
+	// default dataset should exist on one of the nodes
+	nsProvider, err := nsResolver.Resolve(cfg.DefaultDataset)
+	if err == nil && nsProvider == nil {
+		err = fmt.Errorf("not found on any NexentaStor")
+	}
+	report.add(
+		fmt.Sprintf("default dataset '%s'", cfg.DefaultDataset),
+		err,
+		fmt.Sprintf("found on %s", nsProvider),
+	)
+
+	// multiple addresses should be nodes of one RSF cluster
+	if len(nsResolver.Nodes) > 1 {
+		isCluster, err := nsResolver.IsCluster()
+		if err == nil && !isCluster {
+			err = fmt.Errorf("NexentaStor(s) %s do not belong to the same RSF cluster", cfg.Address)
+		}
+		report.add("RSF cluster", err, fmt.Sprintf("all %d nodes belong to the same cluster", len(nsResolver.Nodes)))
+	} else {
+		report.add("RSF cluster", nil, "single NexentaStor, clustering is not checked")
+	}
+
+	// data IP should accept NFS connections
+	nfsPort := args.NfsPort
+	if nfsPort == "" {
+		nfsPort = defaultNfsPort
+	}
+	nfsAddress := net.JoinHostPort(strings.TrimSpace(cfg.DefaultDataIP), nfsPort)
+	conn, err := net.DialTimeout("tcp", nfsAddress, nfsDialTimeout)
+	if err == nil {
+		conn.Close()
+	}
+	report.add(
+		fmt.Sprintf("NFS on default data IP '%s'", cfg.DefaultDataIP),
+		err,
+		fmt.Sprintf("%s accepts connections", nfsAddress),
+	)
+
+	return report
+}
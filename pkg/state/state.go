@@ -0,0 +1,274 @@
+// State persists plugin mounts on disk: NFS mounts of volumes and container bind mounts
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// state file format version
+const formatVersion = 1
+
+// Bind - container bind mount of a volume
+type Bind struct {
+	Path      string    `json:"path"`
+	MountedAt time.Time `json:"mountedAt"`
+}
+
+// Volume - NFS mount of a volume on the Docker host
+type Volume struct {
+	Filesystem string          `json:"filesystem"` // NexentaStor filesystem path, may be empty if recovered
+	Source     string          `json:"source"`     // NFS mount source, e.g. "10.3.3.4:/pool/dataset/volume"
+	Options    []string        `json:"options"`    // effective mount options
+	Node       string          `json:"node"`       // NexentaStor REST API address, empty if recovered from mount table
+	MountPoint string          `json:"mountPoint"` // path inside the plugin's container
+	MountedAt  time.Time       `json:"mountedAt"`
+	Binds      map[string]Bind `json:"binds"` // container ID -> bind mount
+
+	// VolumeOptions - mount options saved on NexentaStor for the volume, they are added to the config ones
+	VolumeOptions []string `json:"volumeOptions,omitempty"`
+}
+
+// copy returns a deep copy of the volume, so callers can't change the store without saving it
+func (v *Volume) copy() Volume {
+	c := *v
+	c.Options = append([]string{}, v.Options...)
+	c.VolumeOptions = append([]string{}, v.VolumeOptions...)
+	c.Binds = make(map[string]Bind, len(v.Binds))
+	for id, bind := range v.Binds {
+		c.Binds[id] = bind
+	}
+	return c
+}
+
+// file - state file content
+type file struct {
+	Version int                `json:"version"`
+	Volumes map[string]*Volume `json:"volumes"`
+}
+
+// Store - plugin state stored in a JSON file, each change is written atomically (temp file + rename)
+type Store struct {
+	path       string
+	log        *logrus.Entry
+	fileExists bool
+
+	mu      sync.Mutex
+	volumes map[string]*Volume
+}
+
+// New loads the state from the file, empty state is used if the file doesn't exist.
+// Broken file is moved to "<path>.broken", so the state can be recovered from the mount table.
+func New(path string, log *logrus.Entry) (*Store, error) {
+	l := log.WithField("cmp", "State")
+
+	s := &Store{
+		path:    path,
+		log:     l,
+		volumes: map[string]*Volume{},
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			l.Infof("state file '%s' not found, start with empty state", path)
+			return s, nil
+		}
+		return nil, fmt.Errorf("Cannot read state file '%s': %s", path, err)
+	}
+
+	var f file
+	if err := json.Unmarshal(content, &f); err != nil || f.Version != formatVersion {
+		brokenPath := path + ".broken"
+		l.Warnf(
+			"cannot use state file '%s' (version: %d, error: %v), move it to '%s' and start with empty state",
+			path,
+			f.Version,
+			err,
+			brokenPath,
+		)
+		if err := os.Rename(path, brokenPath); err != nil {
+			return nil, fmt.Errorf("Cannot move broken state file '%s': %s", path, err)
+		}
+		return s, nil
+	}
+
+	for name, volume := range f.Volumes {
+		if volume == nil {
+			continue
+		}
+		if volume.Binds == nil {
+			volume.Binds = map[string]Bind{}
+		}
+		s.volumes[name] = volume
+	}
+
+	s.fileExists = true
+
+	l.Infof("state loaded from '%s': %d volume(s)", path, len(s.volumes))
+	return s, nil
+}
+
+// FileExists returns true if the state was loaded from a valid file,
+// otherwise it's the first start of the plugin with the state or the file was broken
+func (s *Store) FileExists() bool {
+	return s.fileExists
+}
+
+// GetVolume returns a copy of the volume state, false if the volume is not mounted
+func (s *Store) GetVolume(name string) (Volume, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volume, ok := s.volumes[name]
+	if !ok {
+		return Volume{}, false
+	}
+	return volume.copy(), true
+}
+
+// Volumes returns a copy of all volumes state
+func (s *Store) Volumes() map[string]Volume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volumes := make(map[string]Volume, len(s.volumes))
+	for name, volume := range s.volumes {
+		volumes[name] = volume.copy()
+	}
+	return volumes
+}
+
+// SetVolume adds or updates volume NFS mount, binds are managed by AddBind/RemoveBind only
+func (s *Store) SetVolume(name string, volume Volume) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := volume.copy()
+	v.Binds = map[string]Bind{}
+	if existing, ok := s.volumes[name]; ok {
+		v.Binds = existing.copy().Binds
+	}
+	s.volumes[name] = &v
+
+	return s.save()
+}
+
+// RemoveVolume removes volume with all its binds
+func (s *Store) RemoveVolume(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.volumes[name]; !ok {
+		return nil
+	}
+	delete(s.volumes, name)
+
+	return s.save()
+}
+
+// AddBind adds container bind mount to the volume, volume must be in the state
+func (s *Store) AddBind(name, containerID string, bind Bind) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volume, ok := s.volumes[name]
+	if !ok {
+		return fmt.Errorf("Cannot add bind mount for container '%s': volume '%s' is not in state", containerID, name)
+	}
+	volume.Binds[containerID] = bind
+
+	return s.save()
+}
+
+// RemoveBind removes container bind mount of the volume, returns number of volume's binds left
+func (s *Store) RemoveBind(name, containerID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volume, ok := s.volumes[name]
+	if !ok {
+		return 0, nil
+	}
+	if _, ok := volume.Binds[containerID]; !ok {
+		return len(volume.Binds), nil
+	}
+	delete(volume.Binds, containerID)
+
+	return len(volume.Binds), s.save()
+}
+
+// Replace replaces the whole state, used by recovery
+func (s *Store) Replace(volumes map[string]Volume) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.volumes = make(map[string]*Volume, len(volumes))
+	for name, volume := range volumes {
+		v := volume.copy()
+		s.volumes[name] = &v
+	}
+
+	return s.save()
+}
+
+// Flush writes the whole state to the file, e.g. on plugin shutdown,
+// so the file is up to date even if some of previous saves failed
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.save()
+}
+
+// save writes state to a temp file and renames it, so the file is never partially written
+func (s *Store) save() error {
+	content, err := json.MarshalIndent(file{Version: formatVersion, Volumes: s.volumes}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot marshal state: %s", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("Cannot create state directory '%s': %s", dir, err)
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("Cannot create temp state file in '%s': %s", dir, err)
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Cannot write temp state file '%s': %s", tmpPath, err)
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Cannot replace state file '%s': %s", s.path, err)
+	}
+
+	// sync directory to persist the rename
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
@@ -285,6 +285,62 @@ func TestPlugin_deploy(t *testing.T) {
 		l.Info("OK: All default mount options are presented")
 	})
 
+	// Test scenario:
+	//  - containers of two volumes with common name prefix start and stop at the same time in several rounds,
+	//    so Mount and Unmount calls of the same volume interleave
+	//  - all containers succeed and no volume NFS mounts are left when containers are exited
+	t.Run("should run many containers starting and stopping together", func(t *testing.T) {
+		prefixedVolumeName := fmt.Sprintf("%s-db", volumeName)
+		dockerPlugin.RemoveVolume(prefixedVolumeName)
+		if err := dockerPlugin.CreateVolume(prefixedVolumeName); err != nil {
+			t.Fatal(err)
+		}
+		defer dockerPlugin.RemoveVolume(prefixedVolumeName)
+
+		rounds := 5
+		containersPerVolume := 10
+		volumes := []string{volumeName, prefixedVolumeName}
+
+		for round := 1; round <= rounds; round++ {
+			l.Infof("Round #%d: run %d containers for each of %v volumes...", round, containersPerVolume, volumes)
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			errors := []string{}
+			for _, v := range volumes {
+				for i := 0; i < containersPerVolume; i++ {
+					wg.Add(1)
+					go func(v string, i int) {
+						defer wg.Done()
+						// different container lifetimes make mounts and unmounts interleave
+						_, err := dockerPlugin.RunVolumeContainerCommand(v, fmt.Sprintf("sleep %d", i%3))
+						if err != nil {
+							mu.Lock()
+							errors = append(errors, fmt.Sprintf("volume '%s', container #%d: %s", v, i, err))
+							mu.Unlock()
+						}
+					}(v, i)
+				}
+			}
+			wg.Wait()
+
+			if len(errors) > 0 {
+				t.Fatalf("round #%d: failed to run containers, errors:\n%s", round, strings.Join(errors, "\n"))
+			}
+
+			for _, v := range volumes {
+				// trailing space to not match volumes with common prefix
+				mountSource := fmt.Sprintf("%s:/%s/%s ", pc.DefaultDataIP, pc.DefaultDataset, v)
+				out, err := rc.Exec(fmt.Sprintf("cat /proc/mounts | grep '%s'", mountSource))
+				if err == nil {
+					t.Fatalf("round #%d: mount is left for source '%s': %s", round, mountSource, out)
+				}
+			}
+		}
+
+		l.Info("OK: All containers were run, no mounts are left")
+	})
+
 	t.Run(fmt.Sprintf("remove volume: %s", volumeName), func(t *testing.T) {
 		if err := dockerPlugin.RemoveVolume(volumeName); err != nil {
 			t.Fatal(err)
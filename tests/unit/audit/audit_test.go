@@ -0,0 +1,105 @@
+package audit_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/audit"
+)
+
+func readEvents(t *testing.T, path string) []audit.Event {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("cannot open audit log: %s", err)
+	}
+	defer file.Close()
+
+	events := []audit.Event{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event audit.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("audit log line is not valid JSON: '%s': %s", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	a, err := audit.New(path)
+	if err != nil {
+		t.Fatalf("cannot create audit logger: %s", err)
+	}
+	defer a.Close()
+
+	t.Run("success and failure events", func(t *testing.T) {
+		err := a.Write(&audit.Event{
+			Action:      audit.ActionMount,
+			Volume:      "vol1",
+			ContainerID: "c1",
+			Node:        "https://10.3.3.4:8443",
+			Path:        "pool/dataset/vol1",
+			Options:     map[string]string{"mountOptions": "vers=3,timeo=100"},
+		}, time.Now(), nil)
+		if err != nil {
+			t.Fatalf("cannot write event: %s", err)
+		}
+		err = a.Write(&audit.Event{Action: audit.ActionRemove, Volume: "vol2"}, time.Now(), errors.New("NotFound"))
+		if err != nil {
+			t.Fatalf("cannot write event: %s", err)
+		}
+
+		events := readEvents(t, path)
+		if len(events) != 2 {
+			t.Fatalf("expected 2 events, got: %+v", events)
+		}
+		if events[0].Outcome != audit.OutcomeSuccess || events[0].Error != "" {
+			t.Errorf("expected success event, got: %+v", events[0])
+		}
+		if events[0].Host == "" || events[0].Options["mountOptions"] != "vers=3,timeo=100" {
+			t.Errorf("event fields are not written: %+v", events[0])
+		}
+		if events[1].Outcome != audit.OutcomeFailure || events[1].Error != "NotFound" {
+			t.Errorf("expected failure event, got: %+v", events[1])
+		}
+	})
+
+	t.Run("file is re-opened after external rotation", func(t *testing.T) {
+		if err := os.Rename(path, path+".1"); err != nil {
+			t.Fatal(err)
+		}
+		err := a.Write(&audit.Event{Action: audit.ActionCreate, Volume: "vol3"}, time.Now(), nil)
+		if err != nil {
+			t.Fatalf("cannot write event: %s", err)
+		}
+
+		events := readEvents(t, path)
+		if len(events) != 1 || events[0].Volume != "vol3" {
+			t.Errorf("expected only new event in the new file, got: %+v", events)
+		}
+		if rotated := readEvents(t, path+".1"); len(rotated) != 2 {
+			t.Errorf("expected 2 events in the rotated file, got: %+v", rotated)
+		}
+	})
+
+	t.Run("nil logger does nothing", func(t *testing.T) {
+		var nilLogger *audit.Logger
+		if err := nilLogger.Write(&audit.Event{}, time.Now(), nil); err != nil {
+			t.Errorf("nil logger returned error: %s", err)
+		}
+	})
+}
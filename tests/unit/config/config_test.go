@@ -157,3 +157,277 @@ func TestConfig_Refresh(t *testing.T) {
 		}
 	})
 }
+
+func TestConfig_Env(t *testing.T) {
+	envs := map[string]string{
+		"REST_IP":         "https://10.2.2.2:8443",
+		"DEFAULT_DATASET": "poolB/datasetB",
+		"DEBUG":           "true",
+	}
+	for name, value := range envs {
+		os.Setenv(name, value)
+	}
+	defer func() {
+		for name := range envs {
+			os.Unsetenv(name)
+		}
+	}()
+
+	t.Run("should override config file parameters by environment variables", func(t *testing.T) {
+		path := "./_fixtures/test-config-full.yaml"
+
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("cannot read config file '%s': %s", path, err)
+		}
+
+		testParam(t, "Address", envs["REST_IP"], c.Address)
+		testParam(t, "Username", testConfigParams["Username"], c.Username)
+		testParam(t, "DefaultDataset", envs["DEFAULT_DATASET"], c.DefaultDataset)
+		if !c.Debug {
+			t.Errorf("Param 'Debug' expected to be 'true', but got 'false' instead")
+		}
+
+		testParam(t, "restIp source", config.SourceEnv, c.GetSource("restIp"))
+		testParam(t, "username source", config.SourceFile, c.GetSource("username"))
+		testParam(t, "defaultMountOptions source", config.SourceFile, c.GetSource("defaultMountOptions"))
+	})
+
+	t.Run("should use environment variables only if config file doesn't exist", func(t *testing.T) {
+		os.Setenv("USERNAME", "usrEnv")
+		os.Setenv("PASSWORD", "pwdEnv")
+		os.Setenv("DEFAULT_DATA_IP", "30.1.1.1")
+		defer func() {
+			os.Unsetenv("USERNAME")
+			os.Unsetenv("PASSWORD")
+			os.Unsetenv("DEFAULT_DATA_IP")
+		}()
+
+		path := "./_fixtures/no-exists.yaml"
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("config should be built from environment variables, but got an error: %s", err)
+		} else if c.FileExists() {
+			t.Fatalf("Config.FileExists() should return false for not existing file '%s'", path)
+		}
+
+		testParam(t, "Username", "usrEnv", c.Username)
+		testParam(t, "DefaultDataIp", "30.1.1.1", c.DefaultDataIP)
+		testParam(t, "defaultMountOptions source", config.SourceDefault, c.GetSource("defaultMountOptions"))
+	})
+
+	t.Run("should return an error if boolean environment variable is not valid", func(t *testing.T) {
+		os.Setenv("DEBUG", "maybe")
+		defer os.Setenv("DEBUG", envs["DEBUG"])
+
+		path := "./_fixtures/test-config-full.yaml"
+		c, err := config.New(path)
+		if err == nil {
+			t.Fatalf("should return an error for DEBUG=maybe, but returns config: %+v", c)
+		} else if !strings.Contains(err.Error(), "DEBUG") {
+			t.Fatalf("should return an error with 'DEBUG' text, but returns this: %s", err)
+		}
+	})
+}
+
+func TestConfig_Logging(t *testing.T) {
+	path := "./_fixtures/test-config-full.yaml"
+
+	t.Run("should set default logging options", func(t *testing.T) {
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("cannot read config file '%s': %s", path, err)
+		}
+		testParam(t, "LogFormat", config.LogFormatText, c.LogFormat)
+		if c.LogMaxSize <= 0 || c.LogMaxFiles <= 0 {
+			t.Errorf("LogMaxSize and LogMaxFiles should have default values, got: %d, %d", c.LogMaxSize, c.LogMaxFiles)
+		}
+	})
+
+	t.Run("should read component log levels from environment variable", func(t *testing.T) {
+		os.Setenv("LOG_LEVELS", "Driver=debug, RestClient=warn")
+		defer os.Unsetenv("LOG_LEVELS")
+
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("cannot read config file '%s': %s", path, err)
+		}
+		testParam(t, "LogLevels[Driver]", "debug", c.LogLevels["Driver"])
+		testParam(t, "LogLevels[RestClient]", "warn", c.LogLevels["RestClient"])
+	})
+
+	t.Run("should return an error if log level is not valid", func(t *testing.T) {
+		os.Setenv("LOG_LEVELS", "Driver=loud")
+		defer os.Unsetenv("LOG_LEVELS")
+
+		if _, err := config.New(path); err == nil || !strings.Contains(err.Error(), "logLevels") {
+			t.Fatalf("should return an error with 'logLevels' text, but got: %v", err)
+		}
+	})
+}
+
+func TestConfig_HealthCheck(t *testing.T) {
+	path := "./_fixtures/test-config-full.yaml"
+
+	t.Run("should set default health check options", func(t *testing.T) {
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("cannot read config file '%s': %s", path, err)
+		}
+		if c.HealthCheckInterval <= 0 || c.HealthCheckTimeout <= 0 {
+			t.Errorf(
+				"HealthCheckInterval and HealthCheckTimeout should have default values, got: %d, %d",
+				c.HealthCheckInterval,
+				c.HealthCheckTimeout,
+			)
+		}
+	})
+
+	t.Run("should allow to disable health check", func(t *testing.T) {
+		os.Setenv("HEALTH_CHECK_INTERVAL", "0")
+		defer os.Unsetenv("HEALTH_CHECK_INTERVAL")
+
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("cannot read config file '%s': %s", path, err)
+		}
+		if c.HealthCheckInterval != 0 {
+			t.Errorf("HealthCheckInterval expected to be 0, got: %d", c.HealthCheckInterval)
+		}
+	})
+
+	t.Run("should return an error if health check timeout is not positive", func(t *testing.T) {
+		os.Setenv("HEALTH_CHECK_TIMEOUT", "-1")
+		defer os.Unsetenv("HEALTH_CHECK_TIMEOUT")
+
+		if _, err := config.New(path); err == nil || !strings.Contains(err.Error(), "healthCheckTimeout") {
+			t.Fatalf("should return an error with 'healthCheckTimeout' text, but got: %v", err)
+		}
+	})
+}
+
+func TestConfig_MountTimeouts(t *testing.T) {
+	path := "./_fixtures/test-config-full.yaml"
+
+	t.Run("should set default mount timeouts", func(t *testing.T) {
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("cannot read config file '%s': %s", path, err)
+		}
+		if c.MountTimeout <= 0 || c.UnmountTimeout <= 0 {
+			t.Errorf(
+				"MountTimeout and UnmountTimeout should have default values, got: %d, %d",
+				c.MountTimeout,
+				c.UnmountTimeout,
+			)
+		}
+	})
+
+	t.Run("should return an error if unmount timeout is not positive", func(t *testing.T) {
+		os.Setenv("UNMOUNT_TIMEOUT", "0")
+		defer os.Unsetenv("UNMOUNT_TIMEOUT")
+
+		if _, err := config.New(path); err == nil || !strings.Contains(err.Error(), "unmountTimeout") {
+			t.Fatalf("should return an error with 'unmountTimeout' text, but got: %v", err)
+		}
+	})
+}
+
+func TestConfig_Retries(t *testing.T) {
+	path := "./_fixtures/test-config-full.yaml"
+
+	t.Run("should set default retry options", func(t *testing.T) {
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("cannot read config file '%s': %s", path, err)
+		}
+		if c.RetryAttempts <= 0 || c.RetryDelay <= 0 || c.RetryMaxDelay < c.RetryDelay {
+			t.Errorf(
+				"retry options should have default values, got: attempts %d, delay %d, max delay %d",
+				c.RetryAttempts,
+				c.RetryDelay,
+				c.RetryMaxDelay,
+			)
+		}
+	})
+
+	t.Run("should return an error if max retry delay is less than retry delay", func(t *testing.T) {
+		os.Setenv("RETRY_MAX_DELAY", "100")
+		defer os.Unsetenv("RETRY_MAX_DELAY")
+
+		if _, err := config.New(path); err == nil || !strings.Contains(err.Error(), "retryMaxDelay") {
+			t.Fatalf("should return an error with 'retryMaxDelay' text, but got: %v", err)
+		}
+	})
+
+	t.Run("should return an error if retry jitter is out of range", func(t *testing.T) {
+		os.Setenv("RETRY_JITTER", "150")
+		defer os.Unsetenv("RETRY_JITTER")
+
+		if _, err := config.New(path); err == nil || !strings.Contains(err.Error(), "retryJitter") {
+			t.Fatalf("should return an error with 'retryJitter' text, but got: %v", err)
+		}
+	})
+}
+
+func TestConfig_Deadlines(t *testing.T) {
+	path := "./_fixtures/test-config-full.yaml"
+
+	t.Run("should set default deadlines", func(t *testing.T) {
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("cannot read config file '%s': %s", path, err)
+		}
+		if c.RestTimeout <= 0 || c.JobTimeout <= 0 || c.RequestTimeout <= 0 {
+			t.Errorf(
+				"deadlines should have default values, got: REST %d, job %d, request %d",
+				c.RestTimeout,
+				c.JobTimeout,
+				c.RequestTimeout,
+			)
+		}
+	})
+
+	t.Run("should return an error if job timeout is greater than provider's limit", func(t *testing.T) {
+		os.Setenv("JOB_TIMEOUT", "120")
+		defer os.Unsetenv("JOB_TIMEOUT")
+
+		if _, err := config.New(path); err == nil || !strings.Contains(err.Error(), "jobTimeout") {
+			t.Fatalf("should return an error with 'jobTimeout' text, but got: %v", err)
+		}
+	})
+}
+
+func TestConfig_AdoptableRoots(t *testing.T) {
+	path := "./_fixtures/test-config-full.yaml"
+
+	t.Run("should split adoptable roots", func(t *testing.T) {
+		os.Setenv("ADOPTABLE_ROOTS", "pool/legacy, pool2/data/")
+		defer os.Unsetenv("ADOPTABLE_ROOTS")
+
+		_, err := config.New(path)
+		if err == nil || !strings.Contains(err.Error(), "pool2/data/") {
+			t.Fatalf("should return an error with 'pool2/data/' text, but got: %v", err)
+		}
+
+		os.Setenv("ADOPTABLE_ROOTS", "pool/legacy, pool2/data")
+		c, err := config.New(path)
+		if err != nil {
+			t.Fatalf("cannot read config file '%s': %s", path, err)
+		}
+		if roots := c.GetAdoptableRoots(); len(roots) != 2 || roots[0] != "pool/legacy" || roots[1] != "pool2/data" {
+			t.Errorf("adoptable roots expected to be [pool/legacy pool2/data], got: %v", roots)
+		}
+	})
+
+	t.Run("should return an error if adoptable root is not a dataset path", func(t *testing.T) {
+		for _, root := range []string{"/pool/legacy", "pool/../legacy", "pool//legacy"} {
+			os.Setenv("ADOPTABLE_ROOTS", root)
+			_, err := config.New(path)
+			os.Unsetenv("ADOPTABLE_ROOTS")
+			if err == nil || !strings.Contains(err.Error(), "adoptableRoots") {
+				t.Errorf("should return an error with 'adoptableRoots' text for '%s', but got: %v", root, err)
+			}
+		}
+	})
+}
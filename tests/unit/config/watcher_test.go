@@ -0,0 +1,148 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+)
+
+const testValidConfig = `
+restIp: https://10.1.1.1:8443
+username: usr
+password: pwd
+defaultDataset: poolA/datasetA
+defaultDataIp: 20.1.1.1
+`
+
+func writeTestConfig(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("cannot write config file '%s': %s", path, err)
+	}
+}
+
+func TestConfig_Refresh_Transactional(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	writeTestConfig(t, path, testValidConfig)
+
+	c, err := config.New(path)
+	if err != nil {
+		t.Fatalf("cannot read config file '%s': %s", path, err)
+	}
+
+	t.Run("should keep current values if new config is not valid", func(t *testing.T) {
+		writeTestConfig(t, path, strings.Replace(testValidConfig, "username: usr", "username: ''", 1))
+		os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+
+		if _, err := c.Refresh(); err == nil {
+			t.Fatal("Config.Refresh() should return an error for config w/o username")
+		}
+		testParam(t, "Username", "usr", c.Username)
+	})
+
+	t.Run("should apply fixed config on the next refresh", func(t *testing.T) {
+		writeTestConfig(t, path, strings.Replace(testValidConfig, "username: usr", "username: usr2", 1))
+		os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+
+		changed, err := c.Refresh()
+		if err != nil {
+			t.Fatalf("cannot refresh config file '%s': %s", path, err)
+		} else if !changed {
+			t.Fatal("Config.Refresh() does not indicate that config was changed")
+		}
+		testParam(t, "Username", "usr2", c.Username)
+	})
+
+	t.Run("should reset parameters removed from config file", func(t *testing.T) {
+		writeTestConfig(t, path, testValidConfig+"defaultMountOptions: noatime\n")
+		os.Chtimes(path, time.Now(), time.Now().Add(3*time.Second))
+		c.Refresh()
+		testParam(t, "DefaultMountOptions", "noatime", c.DefaultMountOptions)
+
+		writeTestConfig(t, path, testValidConfig)
+		os.Chtimes(path, time.Now(), time.Now().Add(4*time.Second))
+		c.Refresh()
+		testParam(t, "DefaultMountOptions", "", c.DefaultMountOptions)
+	})
+}
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	writeTestConfig(t, path, testValidConfig)
+
+	c, err := config.New(path)
+	if err != nil {
+		t.Fatalf("cannot read config file '%s': %s", path, err)
+	}
+
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	changes := make(chan *config.Config, 10)
+	w := config.NewWatcher(config.WatcherArgs{
+		Config: c,
+		OnChange: func(newConfig *config.Config) error {
+			changes <- newConfig
+			return nil
+		},
+		Log: logrus.NewEntry(log),
+	})
+
+	t.Run("should not call OnChange if config is the same", func(t *testing.T) {
+		changed, err := w.Reload()
+		if err != nil {
+			t.Fatalf("cannot reload config: %s", err)
+		} else if changed || len(changes) != 0 {
+			t.Fatal("Watcher.Reload() should not apply the same config")
+		}
+	})
+
+	t.Run("should keep the last valid config if new one is broken", func(t *testing.T) {
+		writeTestConfig(t, path, "restIp: [")
+
+		if _, err := w.Reload(); err == nil {
+			t.Fatal("Watcher.Reload() should return an error for broken config")
+		} else if w.Config() != c {
+			t.Fatal("Watcher.Config() should return the last valid config")
+		}
+	})
+
+	t.Run("should reload config on file change", func(t *testing.T) {
+		stop := make(chan struct{})
+		defer close(stop)
+
+		if err := w.Start(stop); err != nil {
+			t.Fatalf("cannot start watcher: %s", err)
+		}
+
+		writeTestConfig(t, path, strings.Replace(testValidConfig, "username: usr", "username: usr2", 1))
+
+		select {
+		case newConfig := <-changes:
+			testParam(t, "Username", "usr2", newConfig.Username)
+			if w.Config() != newConfig {
+				t.Fatal("Watcher.Config() should return the new config")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("config change was not detected")
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package driver_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestDriver_Aliases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := newFakeNS("poolA/datasetA", "poolA/datasetA/vol", "legacy/data/fs", "legacy/data/db", "other/fs")
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	d := newTestDriver(t, dir, newTestConfig(
+		t,
+		dir,
+		server.URL,
+		"poolA/datasetA",
+		"listCacheTtl: 0",
+		"adoptableRoots: legacy/data, legacy/more",
+	))
+
+	adopt := func(name, path string) error {
+		return d.Create(&volume.CreateRequest{Name: name, Options: map[string]string{"adopt": path}})
+	}
+
+	t.Run("should register volume as an alias of adopted filesystem", func(t *testing.T) {
+		if err := adopt("legacy", "legacy/data/fs"); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+
+		properties := fake.getUserProperties("legacy/data/fs")
+		if value := properties["com.nexenta.docker:managed-by"]; value != "nexentastor-docker-volume-plugin" {
+			t.Errorf("adopted filesystem expected to be marked as managed, got: %+v", properties)
+		}
+
+		res, err := d.List()
+		if err != nil || !hasVolume(res.Volumes, "legacy") || !hasVolume(res.Volumes, "vol") {
+			t.Errorf("List() expected to return alias 'legacy' and volume 'vol', got: %+v, %v", res, err)
+		}
+
+		getRes, err := d.Get(&volume.GetRequest{Name: "legacy"})
+		if err != nil || getRes == nil {
+			t.Fatalf("Get() expected to return alias 'legacy', got: %+v, %v", getRes, err)
+		}
+		if path := getRes.Volume.Status["adoptedFilesystem"]; path != "legacy/data/fs" {
+			t.Errorf("alias status expected to have adopted filesystem 'legacy/data/fs', got: %+v", getRes.Volume.Status)
+		}
+	})
+
+	t.Run("should not create filesystem for existing alias", func(t *testing.T) {
+		if err := adopt("legacy", "legacy/data/fs"); err != nil {
+			t.Errorf("Create() of the same alias expected to succeed, got: %s", err)
+		}
+		if err := d.Create(&volume.CreateRequest{Name: "legacy"}); err != nil {
+			t.Errorf("Create() of existing alias expected to succeed, got: %s", err)
+		}
+		for _, path := range fake.getCreated() {
+			if path == "poolA/datasetA/legacy" {
+				t.Errorf("filesystem must not be created for alias")
+			}
+		}
+	})
+
+	t.Run("should not change options of existing alias", func(t *testing.T) {
+		for _, options := range []map[string]string{
+			{"readonly": "true"},
+			{"adopt": "legacy/data/fs", "readonly": "true"},
+		} {
+			err := d.Create(&volume.CreateRequest{Name: "legacy", Options: options})
+			if err == nil || !strings.HasPrefix(err.Error(), "FailedPrecondition:") {
+				t.Errorf("Create() with options %+v expected to fail with FailedPrecondition error, got: %v", options, err)
+			}
+		}
+	})
+
+	t.Run("should fail to register taken volume name", func(t *testing.T) {
+		if err := adopt("vol", "legacy/data/fs"); err == nil || !strings.HasPrefix(err.Error(), "AlreadyExists:") {
+			t.Errorf("Create() expected to fail with AlreadyExists error for existing volume, got: %v", err)
+		}
+		if err := adopt("legacy", "legacy/more/fs"); err == nil || !strings.HasPrefix(err.Error(), "AlreadyExists:") {
+			t.Errorf("Create() expected to fail with AlreadyExists error for existing alias, got: %v", err)
+		}
+	})
+
+	t.Run("should fail to adopt filesystem out of adoptable roots", func(t *testing.T) {
+		for _, path := range []string{"other/fs", "legacy/database", "poolA/datasetA/vol"} {
+			if err := adopt("new", path); err == nil {
+				t.Errorf("Create() expected to fail to adopt '%s'", path)
+			}
+		}
+	})
+
+	t.Run("should fail to adopt not existing filesystem", func(t *testing.T) {
+		if err := adopt("new", "legacy/more/missing"); err == nil || !strings.HasPrefix(err.Error(), "NotFound:") {
+			t.Errorf("Create() expected to fail with NotFound error, got: %v", err)
+		}
+	})
+
+	t.Run("should keep aliases registered on other hosts", func(t *testing.T) {
+		other := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA", "adoptableRoots: legacy/data"))
+		err := other.Create(&volume.CreateRequest{Name: "Legacy_DB", Options: map[string]string{"adopt": "legacy/data/db"}})
+		if err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+
+		properties := fake.getUserProperties("poolA/datasetA")
+		if properties["com.nexenta.docker:alias.legacy"] != "legacy/data/fs" ||
+			properties["com.nexenta.docker:alias._legacy___d_b"] != "legacy/data/db" {
+			t.Errorf("each alias expected to be saved to its own dataset user property, got: %+v", properties)
+		}
+
+		res, err := d.List()
+		if err != nil || !hasVolume(res.Volumes, "legacy") || !hasVolume(res.Volumes, "Legacy_DB") {
+			t.Errorf("List() expected to return aliases 'legacy' and 'Legacy_DB', got: %+v, %v", res, err)
+		}
+	})
+
+	t.Run("should not read aliases for volumes of plugin's dataset", func(t *testing.T) {
+		count := fake.getCount("poolA/datasetA")
+		if res, err := d.Get(&volume.GetRequest{Name: "vol"}); err != nil || res == nil {
+			t.Fatalf("Get() expected to return volume 'vol', got: %+v, %v", res, err)
+		}
+		if newCount := fake.getCount("poolA/datasetA"); newCount != count {
+			t.Errorf("plugin's dataset expected not to be requested, got %d request(s)", newCount-count)
+		}
+	})
+
+	t.Run("should remove alias and keep adopted filesystem", func(t *testing.T) {
+		if err := d.Remove(&volume.RemoveRequest{Name: "legacy"}); err != nil {
+			t.Fatalf("Remove(): %s", err)
+		}
+		if destroyed := fake.getDestroyed(); len(destroyed) != 0 {
+			t.Errorf("adopted filesystem must not be destroyed, destroyed: %v", destroyed)
+		}
+
+		res, err := d.List()
+		if err != nil || hasVolume(res.Volumes, "legacy") {
+			t.Errorf("List() expected not to return removed alias 'legacy', got: %+v, %v", res, err)
+		}
+		if getRes, err := d.Get(&volume.GetRequest{Name: "legacy"}); err != nil || getRes != nil {
+			t.Errorf("Get() expected to return empty response for removed alias, got: %+v, %v", getRes, err)
+		}
+	})
+
+	t.Run("should not adopt filesystems if adoptable roots are not set", func(t *testing.T) {
+		other := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+		err := other.Create(&volume.CreateRequest{Name: "new", Options: map[string]string{"adopt": "legacy/data/fs"}})
+		if err == nil || !strings.HasPrefix(err.Error(), "FailedPrecondition:") {
+			t.Errorf("Create() expected to fail with FailedPrecondition error, got: %v", err)
+		}
+	})
+}
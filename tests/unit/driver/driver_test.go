@@ -0,0 +1,461 @@
+package driver_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/driver"
+)
+
+// fakeNS - minimal NexentaStor REST API keeping filesystems in memory
+type fakeNS struct {
+	mu          sync.Mutex
+	filesystems map[string]*fakeFilesystem // path -> filesystem
+	created     []string                   // paths of created filesystems
+	gets        map[string]int             // filesystem path -> count of GET requests
+	busy        int                        // count of next requests to fail with EBUSY, like during HA failover
+	unavailable int                        // count of next requests to fail with HTTP 503 w/o error details
+	aclFails    bool                       // fail all filesystem ACL requests
+	destroyed   []string                   // paths of destroyed filesystems
+
+	// createStarted and createRelease, if set, hold filesystem creation until the release is closed
+	createStarted chan struct{}
+	createRelease chan struct{}
+
+	// listed, if set, is called before each filesystems list request with its offset, the fake is locked
+	listed func(offset int)
+}
+
+// fakeFilesystem - NS filesystem with user properties and quota
+type fakeFilesystem struct {
+	ns.Filesystem
+	ReferencedQuotaSize int64             `json:"referencedQuotaSize"`
+	UserProperties      map[string]string `json:"userProperties"`
+}
+
+// newFakeNS creates fake NS with filesystems shared over NFS and not managed by the plugin
+func newFakeNS(filesystems ...string) *fakeNS {
+	f := &fakeNS{filesystems: map[string]*fakeFilesystem{}, gets: map[string]int{}}
+	for _, path := range filesystems {
+		f.filesystems[path] = &fakeFilesystem{
+			Filesystem:     ns.Filesystem{Path: path, MountPoint: "/" + path, SharedOverNfs: true},
+			UserProperties: map[string]string{},
+		}
+	}
+	return f
+}
+
+func (f *fakeNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimLeft(r.URL.Path, "/")
+
+	if r.Method == http.MethodPost && path == "storage/filesystems" && f.createRelease != nil {
+		f.createStarted <- struct{}{}
+		<-f.createRelease
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.busy > 0 && path != "auth/login" {
+		f.busy--
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "pool is busy", "code": "EBUSY"})
+		return
+	}
+	if f.unavailable > 0 && path != "auth/login" {
+		f.unavailable--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && path == "auth/login":
+		writeJSON(w, http.StatusOK, map[string]string{"token": "token"})
+	case r.Method == http.MethodGet && path == "storage/filesystems":
+		query := r.URL.Query()
+		f.gets[query.Get("path")]++
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		if f.listed != nil && query.Get("parent") != "" {
+			f.listed(offset)
+		}
+		paths := []string{}
+		for fsPath := range f.filesystems {
+			if fsPath == query.Get("path") || fsPath == query.Get("parent") || filepath.Dir(fsPath) == query.Get("parent") {
+				paths = append(paths, fsPath)
+			}
+		}
+		sort.Strings(paths) // parent goes first
+
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			limit = len(paths)
+		}
+		data := []fakeFilesystem{}
+		for i := offset; i < len(paths) && i < offset+limit; i++ {
+			data = append(data, *f.filesystems[paths[i]])
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+	case r.Method == http.MethodPost && path == "storage/filesystems":
+		params := ns.CreateFilesystemParams{}
+		json.NewDecoder(r.Body).Decode(&params)
+		if _, ok := f.filesystems[params.Path]; ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "exists", "code": "EEXIST"})
+			return
+		}
+		f.filesystems[params.Path] = &fakeFilesystem{
+			Filesystem:          ns.Filesystem{Path: params.Path, MountPoint: "/" + params.Path},
+			ReferencedQuotaSize: params.ReferencedQuotaSize,
+			UserProperties:      map[string]string{},
+		}
+		f.created = append(f.created, params.Path)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && path == "nas/nfs":
+		params := ns.CreateNfsShareParams{}
+		json.NewDecoder(r.Body).Decode(&params)
+		if fs, ok := f.filesystems[params.Filesystem]; ok {
+			fs.SharedOverNfs = true
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/acl"):
+		if f.aclFails {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "bad ACL", "code": "EINVAL"})
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "storage/filesystems/"):
+		fs, ok := f.filesystems[strings.TrimPrefix(path, "storage/filesystems/")]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found", "code": "ENOENT"})
+			return
+		}
+		params := struct {
+			UserProperties      map[string]string `json:"userProperties"`
+			ReferencedQuotaSize *int64            `json:"referencedQuotaSize"`
+		}{}
+		json.NewDecoder(r.Body).Decode(&params)
+		for key, value := range params.UserProperties {
+			fs.UserProperties[key] = value
+		}
+		if params.ReferencedQuotaSize != nil {
+			fs.ReferencedQuotaSize = *params.ReferencedQuotaSize
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "nas/nfs/"):
+		if fs, ok := f.filesystems[strings.TrimPrefix(path, "nas/nfs/")]; ok {
+			fs.SharedOverNfs = false
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "storage/filesystems/"):
+		fsPath := strings.TrimPrefix(path, "storage/filesystems/")
+		delete(f.filesystems, fsPath)
+		f.destroyed = append(f.destroyed, fsPath)
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found", "code": "ENOENT"})
+	}
+}
+
+func (f *fakeNS) getCreated() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.created...)
+}
+
+func (f *fakeNS) setBusy(count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.busy = count
+}
+
+func (f *fakeNS) setUnavailable(count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unavailable = count
+}
+
+func (f *fakeNS) getDestroyed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.destroyed...)
+}
+
+func (f *fakeNS) getUserProperties(path string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	properties := map[string]string{}
+	if fs, ok := f.filesystems[path]; ok {
+		for key, value := range fs.UserProperties {
+			properties[key] = value
+		}
+	}
+	return properties
+}
+
+// getQuota returns referenced quota size of the filesystem
+func (f *fakeNS) getQuota(path string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fs, ok := f.filesystems[path]; ok {
+		return fs.ReferencedQuotaSize
+	}
+	return 0
+}
+
+// setUsed sets used space of the filesystem
+func (f *fakeNS) setUsed(path string, bytesUsed int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fs, ok := f.filesystems[path]; ok {
+		fs.BytesUsed = bytesUsed
+	}
+}
+
+func (f *fakeNS) getCount(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gets[path]
+}
+
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data)
+}
+
+func hasVolume(volumes []*volume.Volume, name string) bool {
+	for _, v := range volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newTestConfig writes and reads config file, options are additional yaml lines
+func newTestConfig(t *testing.T, dir, address, dataset string, options ...string) *config.Config {
+	path := filepath.Join(dir, strings.Replace(dataset, "/", "-", -1)+".yaml")
+	content := fmt.Sprintf(
+		"restIp: %s\nusername: usr\npassword: pwd\ndefaultDataset: %s\ndefaultDataIp: 20.1.1.1\n"+
+			"retryDelay: 10\nretryMaxDelay: 50\n%s",
+		address,
+		dataset,
+		strings.Join(append(options, ""), "\n"),
+	)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("cannot write config file '%s': %s", path, err)
+	}
+
+	c, err := config.New(path)
+	if err != nil {
+		t.Fatalf("cannot read config file '%s': %s", path, err)
+	}
+	return c
+}
+
+func newTestLog() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return logrus.NewEntry(logger)
+}
+
+func newTestDriver(t *testing.T, dir string, cfg *config.Config) *driver.Driver {
+	d, err := driver.New(driver.Args{
+		Config:    cfg,
+		Log:       newTestLog(),
+		StateFile: filepath.Join(dir, "state.json"),
+	})
+	if err != nil {
+		t.Fatalf("cannot create driver: %s", err)
+	}
+	return d
+}
+
+func TestDriver_Reload_Concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := newFakeNS("poolA/datasetA", "poolA/datasetA/vol", "poolB/datasetB", "poolB/datasetB/vol")
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	configA := newTestConfig(t, dir, server.URL, "poolA/datasetA")
+	configB := newTestConfig(t, dir, server.URL, "poolB/datasetB")
+
+	d := newTestDriver(t, dir, configA)
+
+	t.Run("should serve requests while config is reloaded", func(t *testing.T) {
+		const workers = 8
+		const iterations = 10
+
+		var wg sync.WaitGroup
+		errs := make(chan error, workers*iterations*3+1)
+
+		// reload config until all requests are done
+		stop := make(chan struct{})
+		reloaded := make(chan int)
+		go func() {
+			count := 0
+			defer func() { reloaded <- count }()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(5 * time.Millisecond):
+				}
+				cfg := configA
+				if count%2 == 0 {
+					cfg = configB
+				}
+				if err := d.Reload(cfg); err != nil {
+					errs <- fmt.Errorf("Reload(): %s", err)
+					return
+				}
+				count++
+			}
+		}()
+
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					res, err := d.Get(&volume.GetRequest{Name: "vol"})
+					if err != nil {
+						errs <- fmt.Errorf("Get(): %s", err)
+					} else if res == nil || res.Volume.Name != "vol" {
+						errs <- fmt.Errorf("Get(): volume 'vol' expected, got: %+v", res)
+					}
+
+					list, err := d.List()
+					if err != nil {
+						errs <- fmt.Errorf("List(): %s", err)
+					} else if !hasVolume(list.Volumes, "vol") {
+						errs <- fmt.Errorf("List(): volume 'vol' expected, got: %+v", list.Volumes)
+					}
+
+					name := fmt.Sprintf("vol-%d-%d", w, i)
+					if err := d.Create(&volume.CreateRequest{Name: name}); err != nil {
+						errs <- fmt.Errorf("Create(): %s", err)
+					}
+				}
+			}(w)
+		}
+
+		wg.Wait()
+		close(stop)
+		if count := <-reloaded; count < 2 {
+			t.Errorf("config expected to be reloaded while requests are served, reloaded %d time(s)", count)
+		}
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+
+		created := fake.getCreated()
+		if len(created) != workers*iterations {
+			t.Errorf("%d filesystems expected to be created, got: %d", workers*iterations, len(created))
+		}
+		for _, path := range created {
+			if !strings.HasPrefix(path, "poolA/datasetA/") && !strings.HasPrefix(path, "poolB/datasetB/") {
+				t.Errorf("filesystem created in unknown dataset: '%s'", path)
+			}
+		}
+	})
+
+	t.Run("should use new config after reload", func(t *testing.T) {
+		if err := d.Reload(configB); err != nil {
+			t.Fatalf("Reload(): %s", err)
+		}
+		if err := d.Create(&volume.CreateRequest{Name: "after-reload"}); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+
+		created := fake.getCreated()
+		if last := created[len(created)-1]; last != "poolB/datasetB/after-reload" {
+			t.Errorf("filesystem expected to be created in the new dataset, got: '%s'", last)
+		}
+	})
+}
+
+func TestDriver_Shutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := newFakeNS("poolA/datasetA")
+	fake.createStarted = make(chan struct{}, 1)
+	fake.createRelease = make(chan struct{})
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	d := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+
+	// start a request and shut down the driver while it's in progress
+	createErr := make(chan error, 1)
+	go func() {
+		createErr <- d.Create(&volume.CreateRequest{Name: "in-flight"})
+	}()
+	<-fake.createStarted
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- d.Shutdown()
+	}()
+
+	t.Run("should reject new requests while shutting down", func(t *testing.T) {
+		// shutdown flag is set asynchronously, wait for the first rejected request
+		var err error
+		for i := 0; i < 100; i++ {
+			if err = d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), "Unavailable:") {
+			t.Fatalf("Unavailable error expected, got: %v", err)
+		}
+	})
+
+	t.Run("should wait for in-flight request", func(t *testing.T) {
+		select {
+		case err := <-shutdownErr:
+			t.Fatalf("Shutdown() returned before in-flight request is finished: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(fake.createRelease)
+
+		if err := <-createErr; err != nil {
+			t.Errorf("in-flight Create() expected to succeed, got: %s", err)
+		}
+		if err := <-shutdownErr; err != nil {
+			t.Errorf("Shutdown() expected to succeed, got: %s", err)
+		}
+	})
+
+	t.Run("should write the state file", func(t *testing.T) {
+		if _, err := os.Stat(filepath.Join(dir, "state.json")); err != nil {
+			t.Errorf("state file expected to be written on shutdown: %s", err)
+		}
+	})
+}
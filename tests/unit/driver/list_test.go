@@ -0,0 +1,149 @@
+package driver_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestDriver_List(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("should fetch all volumes page by page", func(t *testing.T) {
+		paths := []string{"poolA/datasetA"}
+		for i := 0; i < 1234; i++ {
+			paths = append(paths, fmt.Sprintf("poolA/datasetA/vol-%04d", i))
+		}
+		fake := newFakeNS(paths...)
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+
+		res, err := d.List()
+		if err != nil {
+			t.Fatalf("List(): %s", err)
+		}
+		if len(res.Volumes) != 1234 {
+			t.Errorf("1234 volumes expected, got: %d", len(res.Volumes))
+		}
+		// 3 pages of 500 volumes, each page starts at the offset of the previous one's last filesystem
+		if count := fake.getCount(""); count != 5 {
+			t.Errorf("filesystems expected to be listed by 5 requests, got: %d", count)
+		}
+	})
+
+	t.Run("should not skip volumes if a filesystem is destroyed between pages", func(t *testing.T) {
+		paths := []string{"poolA/datasetA"}
+		for i := 0; i < 1234; i++ {
+			paths = append(paths, fmt.Sprintf("poolA/datasetA/vol-%04d", i))
+		}
+		fake := newFakeNS(paths...)
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		// destroy a filesystem of the first page after filesystems from offset 500 are listed
+		lastOffset := -1
+		fake.listed = func(offset int) {
+			if lastOffset == 500 {
+				delete(fake.filesystems, "poolA/datasetA/vol-0000")
+			}
+			lastOffset = offset
+		}
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+
+		res, err := d.List()
+		if err != nil {
+			t.Fatalf("List(): %s", err)
+		}
+		// destroyed filesystem is returned by the first page
+		names := map[string]bool{}
+		for _, v := range res.Volumes {
+			names[v.Name] = true
+		}
+		if len(res.Volumes) != 1234 || len(names) != 1234 {
+			t.Errorf("1234 volumes expected w/o gaps and duplicates between pages, got: %d", len(res.Volumes))
+		}
+	})
+
+	t.Run("should not stop if the last filesystem of a page is destroyed before the next page", func(t *testing.T) {
+		paths := []string{"poolA/datasetA"}
+		for i := 0; i < 1234; i++ {
+			paths = append(paths, fmt.Sprintf("poolA/datasetA/vol-%04d", i))
+		}
+		fake := newFakeNS(paths...)
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		// the first page is fetched by 2 requests and ends with vol-0499, destroy it before the second page
+		requests := 0
+		fake.listed = func(offset int) {
+			if requests++; requests == 3 {
+				delete(fake.filesystems, "poolA/datasetA/vol-0499")
+			}
+		}
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+
+		res, err := d.List()
+		if err != nil {
+			t.Fatalf("List(): %s", err)
+		}
+		names := map[string]bool{}
+		for _, v := range res.Volumes {
+			names[v.Name] = true
+		}
+		if len(res.Volumes) != 1234 || len(names) != 1234 {
+			t.Errorf("1234 volumes expected w/o gaps and duplicates between pages, got: %d", len(res.Volumes))
+		}
+	})
+
+	fake := newFakeNS("poolA/datasetA", "poolA/datasetA/vol")
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	d := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA", "listCacheTtl: 60"))
+
+	t.Run("should return cached volume list", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if res, err := d.List(); err != nil || !hasVolume(res.Volumes, "vol") {
+				t.Fatalf("List() expected to return volume 'vol', got: %+v, %v", res, err)
+			}
+		}
+		if count := fake.getCount(""); count != 1 {
+			t.Errorf("volume list expected to be fetched once, fetched %d time(s)", count)
+		}
+	})
+
+	t.Run("should fetch volume list again after Create", func(t *testing.T) {
+		if err := d.Create(&volume.CreateRequest{Name: "new"}); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+		if res, err := d.List(); err != nil || !hasVolume(res.Volumes, "new") {
+			t.Fatalf("List() expected to return created volume 'new', got: %+v, %v", res, err)
+		}
+	})
+
+	t.Run("should return the last fetched list if NS cannot be reached", func(t *testing.T) {
+		if err := d.Remove(&volume.RemoveRequest{Name: "vol"}); err != nil {
+			t.Fatalf("Remove(): %s", err)
+		}
+
+		fake.setUnavailable(1000)
+		defer fake.setUnavailable(0)
+
+		res, err := d.List()
+		if err != nil || !hasVolume(res.Volumes, "vol") || !hasVolume(res.Volumes, "new") {
+			t.Fatalf("List() expected to return the last fetched list, got: %+v, %v", res, err)
+		}
+	})
+}
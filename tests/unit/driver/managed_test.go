@@ -0,0 +1,131 @@
+package driver_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestDriver_ManagedVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := newFakeNS("poolA/datasetA", "poolA/datasetA/foreign", "poolA/datasetA/other")
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	d := newTestDriver(t, dir, newTestConfig(
+		t,
+		dir,
+		server.URL,
+		"poolA/datasetA",
+		"listCacheTtl: 0",
+		"managedVolumesOnly: true",
+	))
+
+	t.Run("should mark created filesystem as managed", func(t *testing.T) {
+		err := d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"mountOptions": "noatime"}})
+		if err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+
+		properties := fake.getUserProperties("poolA/datasetA/vol")
+		if value := properties["com.nexenta.docker:managed-by"]; value != "nexentastor-docker-volume-plugin" {
+			t.Errorf("managed-by property expected to be set, got: %+v", properties)
+		}
+		expected := `{"mountOptions":"noatime","protocol":"nfs","readonly":"false"}`
+		if value := properties["com.nexenta.docker:options"]; value != expected {
+			t.Errorf("options property expected to be '%s', got: '%s'", expected, value)
+		}
+		if value := properties["com.nexenta.docker:host"]; value == "" {
+			t.Errorf("host property expected to be set, got: %+v", properties)
+		}
+	})
+
+	t.Run("should list managed filesystems only", func(t *testing.T) {
+		res, err := d.List()
+		if err != nil {
+			t.Fatalf("List(): %s", err)
+		}
+		if len(res.Volumes) != 1 || !hasVolume(res.Volumes, "vol") {
+			t.Errorf("List() expected to return volume 'vol' only, got: %+v", res.Volumes)
+		}
+	})
+
+	t.Run("should not get foreign filesystem", func(t *testing.T) {
+		if res, err := d.Get(&volume.GetRequest{Name: "foreign"}); err != nil || res != nil {
+			t.Errorf("Get() expected to return empty response for foreign filesystem, got: %+v, %v", res, err)
+		}
+		if res, err := d.Get(&volume.GetRequest{Name: "vol"}); err != nil || res == nil {
+			t.Errorf("Get() expected to return managed volume 'vol', got: %+v, %v", res, err)
+		}
+	})
+
+	t.Run("should not use foreign filesystem w/o adopt option", func(t *testing.T) {
+		err := d.Create(&volume.CreateRequest{Name: "foreign"})
+		if err == nil || !strings.HasPrefix(err.Error(), "AlreadyExists:") {
+			t.Errorf("Create() expected to fail with AlreadyExists error, got: %v", err)
+		}
+		if len(fake.getDestroyed()) != 0 {
+			t.Errorf("foreign filesystem must not be destroyed, destroyed: %v", fake.getDestroyed())
+		}
+	})
+
+	t.Run("should adopt foreign filesystem", func(t *testing.T) {
+		err := d.Create(&volume.CreateRequest{Name: "foreign", Options: map[string]string{"adopt": "true"}})
+		if err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+
+		properties := fake.getUserProperties("poolA/datasetA/foreign")
+		if value := properties["com.nexenta.docker:managed-by"]; value != "nexentastor-docker-volume-plugin" {
+			t.Errorf("managed-by property expected to be set, got: %+v", properties)
+		}
+		if value := properties["com.nexenta.docker:options"]; value != `{"protocol":"nfs","readonly":"false"}` {
+			t.Errorf("adopt option expected not to be saved, got: '%s'", value)
+		}
+
+		res, err := d.List()
+		if err != nil || len(res.Volumes) != 2 || !hasVolume(res.Volumes, "foreign") {
+			t.Errorf("List() expected to return adopted volume, got: %+v, %v", res, err)
+		}
+	})
+
+	t.Run("should fail to adopt not existing filesystem", func(t *testing.T) {
+		err := d.Create(&volume.CreateRequest{Name: "missing", Options: map[string]string{"adopt": "true"}})
+		if err == nil || !strings.HasPrefix(err.Error(), "NotFound:") {
+			t.Errorf("Create() expected to fail with NotFound error, got: %v", err)
+		}
+		for _, path := range fake.getCreated() {
+			if path == "poolA/datasetA/missing" {
+				t.Errorf("filesystem must not be created on adoption")
+			}
+		}
+	})
+
+	t.Run("should fail on invalid adopt option", func(t *testing.T) {
+		err := d.Create(&volume.CreateRequest{Name: "other", Options: map[string]string{"adopt": "/maybe"}})
+		if err == nil || !strings.HasPrefix(err.Error(), "InvalidArgument:") {
+			t.Errorf("Create() expected to fail with InvalidArgument error, got: %v", err)
+		}
+	})
+
+	t.Run("should list foreign filesystems if managedVolumesOnly is not set", func(t *testing.T) {
+		cfg := newTestConfig(t, dir, server.URL, "poolA/datasetA", "listCacheTtl: 0")
+		if err := d.Reload(cfg); err != nil {
+			t.Fatalf("Reload(): %s", err)
+		}
+
+		res, err := d.List()
+		if err != nil || len(res.Volumes) != 3 || !hasVolume(res.Volumes, "other") {
+			t.Errorf("List() expected to return all 3 volumes, got: %+v, %v", res, err)
+		}
+	})
+}
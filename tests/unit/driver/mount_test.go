@@ -0,0 +1,540 @@
+package driver_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/sirupsen/logrus"
+	k8sMount "k8s.io/kubernetes/pkg/util/mount"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/driver"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/mounter"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/state"
+)
+
+// fake mount/umount commands keep the mount table in a file: "<DEVICE> <PATH> <OPTIONS>" per line,
+// bind mount waits while the block file exists
+const fakeMountCommand = `#!/bin/sh
+echo "mount $*" >> %[1]s
+while [ $# -gt 2 ]; do
+	if [ "$1" = "-o" ]; then options="$2"; shift; fi
+	shift
+done
+while [ "$options" = "bind" ] && [ -e %[3]s ]; do sleep 0.05; done
+echo "$1 $2 $options" >> %[2]s
+`
+
+const fakeUmountCommand = `#!/bin/sh
+echo "umount $*" >> %[1]s
+for target; do :; done
+grep -v "^[^ ]* $target " %[2]s > %[2]s.tmp
+mv %[2]s.tmp %[2]s
+`
+
+// fakeMountTable - mount table written by fake mount/umount commands
+type fakeMountTable struct {
+	*k8sMount.FakeMounter
+	path string
+}
+
+// List returns mounts from the fake mount table file
+func (m *fakeMountTable) List() ([]k8sMount.MountPoint, error) {
+	content, err := ioutil.ReadFile(m.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	mounts := []k8sMount.MountPoint{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		mount := k8sMount.MountPoint{Device: fields[0], Path: fields[1]}
+		if len(fields) > 2 {
+			mount.Opts = strings.Split(fields[2], ",")
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+// IsLikelyNotMountPoint checks the path in the fake mount table, the path must exist
+func (m *fakeMountTable) IsLikelyNotMountPoint(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return true, err
+	}
+	mounts, err := m.List()
+	if err != nil {
+		return true, err
+	}
+	for _, mount := range mounts {
+		if mount.Path == path {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fakeMounts - plugin mount points root with fake mount table and mount/umount commands in PATH
+type fakeMounts struct {
+	root      string
+	stateFile string
+	calls     string
+	block     string
+	table     *fakeMountTable
+	log       *logrus.Entry
+}
+
+// setupFakeMounts puts fake mount/umount commands first in PATH, returns a function to restore PATH
+func setupFakeMounts(t *testing.T, dir string) (*fakeMounts, func()) {
+	binDir := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(binDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &fakeMounts{
+		root:      filepath.Join(dir, "mnt"),
+		stateFile: filepath.Join(dir, "state.json"),
+		calls:     filepath.Join(dir, "calls.log"),
+		block:     filepath.Join(dir, "block"),
+		table:     &fakeMountTable{FakeMounter: &k8sMount.FakeMounter{}, path: filepath.Join(dir, "mounts")},
+		log:       newTestLog(),
+	}
+	for name, template := range map[string]string{"mount": fakeMountCommand, "umount": fakeUmountCommand} {
+		content := fmt.Sprintf(template, m.calls, m.table.path, m.block)
+		if err := ioutil.WriteFile(filepath.Join(binDir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+":"+path)
+	return m, func() { os.Setenv("PATH", path) }
+}
+
+// newDriver creates a driver which mounts volumes to the fake mount table
+func (m *fakeMounts) newDriver(t *testing.T, cfg *config.Config) *driver.Driver {
+	d, err := driver.New(driver.Args{
+		Config:          cfg,
+		Log:             m.log,
+		StateFile:       m.stateFile,
+		MountPointsRoot: m.root,
+		Mounter:         mounter.NewWithInterface(m.log, m.table),
+	})
+	if err != nil {
+		t.Fatalf("cannot create driver: %s", err)
+	}
+	return d
+}
+
+// mount adds a mount to the fake mount table and creates its mount point
+func (m *fakeMounts) mount(t *testing.T, device, path string, options ...string) {
+	if err := os.MkdirAll(path, 0750); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(m.table.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "%s %s %s\n", device, path, strings.Join(options, ","))
+}
+
+// saveVolume saves the volume with container bind mounts (container ID -> path) to the state file
+func (m *fakeMounts) saveVolume(t *testing.T, name string, volume state.Volume, binds map[string]string) {
+	store, err := state.New(m.stateFile, newTestLog())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetVolume(name, volume); err != nil {
+		t.Fatal(err)
+	}
+	for containerID, path := range binds {
+		if err := store.AddBind(name, containerID, state.Bind{Path: path, MountedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// mounted returns sorted mount points relative to the root
+func (m *fakeMounts) mounted(t *testing.T) []string {
+	mounts, err := m.table.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, mount := range mounts {
+		paths = append(paths, strings.TrimPrefix(mount.Path, m.root+"/"))
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// countCalls returns count of fake commands called with the prefix, e.g. "mount -t nfs"
+func (m *fakeMounts) countCalls(t *testing.T, prefix string) int {
+	content, err := ioutil.ReadFile(m.calls)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// readState loads the state file written by the driver
+func (m *fakeMounts) readState(t *testing.T) map[string]state.Volume {
+	store, err := state.New(m.stateFile, newTestLog())
+	if err != nil {
+		t.Fatalf("cannot read state file: %s", err)
+	}
+	return store.Volumes()
+}
+
+// bindIDs returns sorted container IDs of the volume bind mounts from the state
+func bindIDs(volumes map[string]state.Volume, name string) string {
+	ids := []string{}
+	for id := range volumes[name].Binds {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestDriver_MountBinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounts, cleanup := setupFakeMounts(t, dir)
+	defer cleanup()
+
+	fake := newFakeNS("poolA/datasetA", "poolA/datasetA/app", "poolA/datasetA/app-db")
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	cfg := newTestConfig(t, dir, server.URL, "poolA/datasetA")
+	d := mounts.newDriver(t, cfg)
+
+	mount := func(name, containerID string) {
+		res, err := d.Mount(&volume.MountRequest{Name: name, ID: containerID})
+		if err != nil {
+			t.Fatalf("Mount('%s', '%s'): %s", name, containerID, err)
+		}
+		if expected := filepath.Join(mounts.root, "bind", name, containerID); res.Mountpoint != expected {
+			t.Errorf("Mount() expected to return '%s' mount point, got: '%s'", expected, res.Mountpoint)
+		}
+	}
+	unmount := func(name, containerID string) {
+		if err := d.Unmount(&volume.UnmountRequest{Name: name, ID: containerID}); err != nil {
+			t.Fatalf("Unmount('%s', '%s'): %s", name, containerID, err)
+		}
+	}
+	expectBinds := func(name, expected string) {
+		if ids := bindIDs(mounts.readState(t), name); ids != expected {
+			t.Errorf("volume '%s' expected to have binds '%s' in the state, got: '%s'", name, expected, ids)
+		}
+	}
+	expectMounted := func(expected ...string) {
+		if paths := mounts.mounted(t); strings.Join(paths, " ") != strings.Join(expected, " ") {
+			t.Errorf("expected mounts: %v, got: %v", expected, paths)
+		}
+	}
+
+	t.Run("should count binds of volumes with common name prefix separately", func(t *testing.T) {
+		mount("app", "c1")
+		mount("app", "c2")
+		mount("app-db", "c1")
+		mount("app-db", "c3")
+
+		expectBinds("app", "c1,c2")
+		expectBinds("app-db", "c1,c3")
+		expectMounted("bind/app-db/c1", "bind/app-db/c3", "bind/app/c1", "bind/app/c2", "volume/app", "volume/app-db")
+		if count := mounts.countCalls(t, "mount -t nfs"); count != 2 {
+			t.Errorf("each volume expected to be mounted once, got %d NFS mounts", count)
+		}
+	})
+
+	t.Run("should keep volume mounted while other containers use it", func(t *testing.T) {
+		unmount("app", "c1")
+		unmount("app-db", "c1")
+
+		expectBinds("app", "c2")
+		expectBinds("app-db", "c3")
+		expectMounted("bind/app-db/c3", "bind/app/c2", "volume/app", "volume/app-db")
+	})
+
+	t.Run("should unmount volume after the last container", func(t *testing.T) {
+		unmount("app", "c2")
+
+		if _, ok := mounts.readState(t)["app"]; ok {
+			t.Errorf("volume 'app' expected to be removed from the state")
+		}
+		expectBinds("app-db", "c3")
+		expectMounted("bind/app-db/c3", "volume/app-db")
+
+		unmount("app-db", "c3")
+		expectMounted()
+		if volumes := mounts.readState(t); len(volumes) != 0 {
+			t.Errorf("state expected to be empty, got: %+v", volumes)
+		}
+	})
+
+	t.Run("should unmount legacy bind mount", func(t *testing.T) {
+		containerID := strings.Repeat("ab", 32)
+		volumeMountPoint := filepath.Join(mounts.root, "volume", "app")
+		legacyPath := filepath.Join(mounts.root, "bind", "app-"+containerID)
+		options := []string{"vers=3", "timeo=100"}
+
+		// volume mounted by a previous plugin version
+		mounts.mount(t, "20.1.1.1:/poolA/datasetA/app", volumeMountPoint, options...)
+		mounts.mount(t, volumeMountPoint, legacyPath, "bind")
+		mounts.saveVolume(t, "app", state.Volume{
+			Source:     "20.1.1.1:/poolA/datasetA/app",
+			Options:    options,
+			MountPoint: volumeMountPoint,
+			MountedAt:  time.Now(),
+		}, map[string]string{containerID: legacyPath})
+
+		d = mounts.newDriver(t, cfg)
+		expectBinds("app", containerID)
+
+		mount("app", "c4")
+		unmount("app", containerID)
+		expectBinds("app", "c4")
+		expectMounted("bind/app/c4", "volume/app")
+		if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+			t.Errorf("legacy bind mount point expected to be removed, got: %v", err)
+		}
+
+		unmount("app", "c4")
+		expectMounted()
+	})
+}
+
+func TestDriver_ShutdownUnmount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounts, cleanup := setupFakeMounts(t, dir)
+	defer cleanup()
+
+	server := httptest.NewTLSServer(newFakeNS("poolA/datasetA", "poolA/datasetA/app"))
+	defer server.Close()
+
+	cfg := newTestConfig(t, dir, server.URL, "poolA/datasetA", "shutdownTimeout: 0", "unmountOnShutdown: true")
+	d := mounts.newDriver(t, cfg)
+
+	// Mount() holds the volume lock while bind mount is blocked, volume is mounted and has no binds yet
+	if err := ioutil.WriteFile(mounts.block, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mountErr := make(chan error, 1)
+	go func() {
+		_, err := d.Mount(&volume.MountRequest{Name: "app", ID: "c1"})
+		mountErr <- err
+	}()
+	for i := 0; i < 100 && mounts.countCalls(t, "mount -o bind") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("should skip volume locked by not finished request", func(t *testing.T) {
+		shutdownErr := make(chan error, 1)
+		go func() {
+			shutdownErr <- d.Shutdown()
+		}()
+
+		select {
+		case err := <-shutdownErr:
+			if err != nil {
+				t.Errorf("Shutdown() expected to succeed, got: %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Shutdown() expected not to wait for the volume lock")
+		}
+		if count := mounts.countCalls(t, "umount"); count != 0 {
+			t.Errorf("locked volume expected not to be unmounted, got %d umount call(s)", count)
+		}
+	})
+
+	t.Run("should let the request finish mount", func(t *testing.T) {
+		os.Remove(mounts.block)
+		if err := <-mountErr; err != nil {
+			t.Errorf("Mount() expected to succeed, got: %s", err)
+		}
+		if paths := mounts.mounted(t); strings.Join(paths, " ") != "bind/app/c1 volume/app" {
+			t.Errorf("volume expected to stay mounted, got: %v", paths)
+		}
+	})
+}
+
+func TestDriver_MountReuse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounts, cleanup := setupFakeMounts(t, dir)
+	defer cleanup()
+
+	fake := newFakeNS("poolA/datasetA")
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	d := mounts.newDriver(t, newTestConfig(t, dir, server.URL, "poolA/datasetA", "retryAttempts: 1"))
+
+	mount := func(containerID string) error {
+		_, err := d.Mount(&volume.MountRequest{Name: "app", ID: containerID})
+		return err
+	}
+
+	err = d.Create(&volume.CreateRequest{Name: "app", Options: map[string]string{"mountOptions": "noatime"}})
+	if err != nil {
+		t.Fatalf("Create(): %s", err)
+	}
+	if err := mount("c1"); err != nil {
+		t.Fatalf("Mount(): %s", err)
+	}
+
+	t.Run("should save volume mount options to the state", func(t *testing.T) {
+		app := mounts.readState(t)["app"]
+		if strings.Join(app.VolumeOptions, ",") != "noatime" || strings.Join(app.Options, ",") != "noatime,vers=3,timeo=100" {
+			t.Errorf("volume expected to be mounted with 'noatime' volume option, got: %+v", app)
+		}
+	})
+
+	t.Run("should reuse healthy mount w/o NexentaStor requests", func(t *testing.T) {
+		fake.setUnavailable(1000)
+		defer fake.setUnavailable(0)
+
+		if err := mount("c2"); err != nil {
+			t.Fatalf("Mount() expected to succeed while NexentaStor is unavailable, got: %s", err)
+		}
+		if count := mounts.countCalls(t, "mount -t nfs"); count != 1 {
+			t.Errorf("volume expected to be mounted once, got %d NFS mounts", count)
+		}
+	})
+
+	t.Run("should get filesystem from NexentaStor if mount is not healthy", func(t *testing.T) {
+		os.RemoveAll(filepath.Join(mounts.root, "volume", "app"))
+
+		fake.setUnavailable(1000)
+		if err := mount("c3"); err == nil {
+			t.Error("Mount() of not healthy mount expected to fail while NexentaStor is unavailable")
+		}
+
+		fake.setUnavailable(0)
+		if err := mount("c3"); err != nil {
+			t.Fatalf("Mount(): %s", err)
+		}
+		if ids := bindIDs(mounts.readState(t), "app"); ids != "c1,c2,c3" {
+			t.Errorf("volume expected to have binds 'c1,c2,c3' in the state, got: '%s'", ids)
+		}
+	})
+}
+
+func TestDriver_RemountAlias(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounts, cleanup := setupFakeMounts(t, dir)
+	defer cleanup()
+
+	server := httptest.NewTLSServer(newFakeNS("poolA/datasetA", "legacy/data/fs", "legacy/data/other"))
+	defer server.Close()
+
+	cfg := newTestConfig(t, dir, server.URL, "poolA/datasetA", "adoptableRoots: legacy/data")
+	d := mounts.newDriver(t, cfg)
+	for name, path := range map[string]string{"legacy": "legacy/data/fs", "recovered": "legacy/data/other"} {
+		if err := d.Create(&volume.CreateRequest{Name: name, Options: map[string]string{"adopt": path}}); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+	}
+
+	// not used alias volumes were mounted from old NS mount points and their mount points are gone,
+	// "recovered" volume has no filesystem path in the state
+	options := []string{"vers=3", "timeo=100"}
+	for name, filesystem := range map[string]string{"legacy": "legacy/data/fs", "recovered": ""} {
+		mountPoint := filepath.Join(mounts.root, "volume", name)
+		mounts.mount(t, "20.1.1.1:/old/"+name, mountPoint, options...)
+		mounts.saveVolume(t, name, state.Volume{
+			Filesystem: filesystem,
+			Source:     "20.1.1.1:/old/" + name,
+			Options:    options,
+			MountPoint: mountPoint,
+			MountedAt:  time.Now(),
+		}, nil)
+		if err := os.RemoveAll(mountPoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// dry run keeps not used volumes mounted on start
+	cfg = newTestConfig(t, dir, server.URL, "poolA/datasetA",
+		"adoptableRoots: legacy/data", "reconcileDryRun: true", "healthCheckInterval: 1")
+	d = mounts.newDriver(t, cfg)
+	stop := make(chan struct{})
+	defer close(stop)
+	d.StartHealthCheck(stop)
+
+	expected := map[string]string{
+		"legacy":    "20.1.1.1:/legacy/data/fs",
+		"recovered": "20.1.1.1:/legacy/data/other",
+	}
+	remounted := func() bool {
+		volumes := mounts.readState(t)
+		for name, source := range expected {
+			if volumes[name].Source != source {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 100 && !remounted(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Run("should remount alias volume from its filesystem mount point", func(t *testing.T) {
+		volumes := mounts.readState(t)
+		for name, source := range expected {
+			if volumes[name].Source != source {
+				t.Errorf("volume '%s' expected to be remounted from '%s', got: %+v", name, source, volumes[name])
+			}
+		}
+		table, err := mounts.table.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mount := range table {
+			name := filepath.Base(mount.Path)
+			if mount.Device != expected[name] {
+				t.Errorf("volume '%s' expected to be mounted from '%s', got: '%s'", name, expected[name], mount.Device)
+			}
+		}
+		if volumes["recovered"].Filesystem != "legacy/data/other" {
+			t.Errorf("recovered volume expected to get filesystem path in the state, got: %+v", volumes["recovered"])
+		}
+	})
+}
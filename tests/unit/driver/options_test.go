@@ -0,0 +1,146 @@
+package driver_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestDriver_VolumeOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := newFakeNS("poolA/datasetA", "poolA/datasetA/foreign")
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	cfg := newTestConfig(t, dir, server.URL, "poolA/datasetA")
+	d := newTestDriver(t, dir, cfg)
+
+	t.Run("should return saved options on another host", func(t *testing.T) {
+		err := d.Create(&volume.CreateRequest{
+			Name: "vol",
+			Options: map[string]string{
+				"protocol":     "NFS",
+				"mountOptions": "noatime, nosuid",
+				"readonly":     "1",
+				"owner":        "1000:1000",
+			},
+		})
+		if err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+
+		otherDir := filepath.Join(dir, "other")
+		if err := os.Mkdir(otherDir, 0750); err != nil {
+			t.Fatal(err)
+		}
+		other := newTestDriver(t, otherDir, cfg)
+
+		res, err := other.Get(&volume.GetRequest{Name: "vol"})
+		if err != nil || res == nil {
+			t.Fatalf("Get() expected to return volume 'vol', got: %+v, %v", res, err)
+		}
+		expected := map[string]string{
+			"protocol":     "nfs",
+			"mountOptions": "noatime,nosuid",
+			"readonly":     "true",
+			"owner":        "1000:1000",
+		}
+		options, ok := res.Volume.Status["options"]
+		if !ok || !reflect.DeepEqual(toStringMap(options), expected) {
+			t.Errorf("volume status expected to have options %+v, got: %+v", expected, res.Volume.Status)
+		}
+	})
+
+	t.Run("should return default options of foreign filesystem", func(t *testing.T) {
+		res, err := d.Get(&volume.GetRequest{Name: "foreign"})
+		if err != nil || res == nil {
+			t.Fatalf("Get() expected to return volume 'foreign', got: %+v, %v", res, err)
+		}
+		expected := map[string]string{"protocol": "nfs", "readonly": "false"}
+		if options := toStringMap(res.Volume.Status["options"]); !reflect.DeepEqual(options, expected) {
+			t.Errorf("volume status expected to have options %+v, got: %+v", expected, res.Volume.Status)
+		}
+	})
+
+	t.Run("should not change options of existing volume", func(t *testing.T) {
+		for _, options := range []map[string]string{
+			{"mountOptions": "nosuid"},
+			{"readonly": "false"},
+			{"owner": "0:0", "size": "1G"},
+		} {
+			err := d.Create(&volume.CreateRequest{Name: "vol", Options: options})
+			if err == nil || !strings.HasPrefix(err.Error(), "FailedPrecondition:") {
+				t.Errorf("Create() with options %+v expected to fail with FailedPrecondition error, got: %v", options, err)
+			}
+		}
+		if quota := fake.getQuota("poolA/datasetA/vol"); quota != 0 {
+			t.Errorf("volume expected not to be resized, got quota: %d", quota)
+		}
+
+		err := d.Create(&volume.CreateRequest{Name: "foreign", Options: map[string]string{"readonly": "true"}})
+		if err == nil || !strings.HasPrefix(err.Error(), "FailedPrecondition:") {
+			t.Errorf("Create() of not managed filesystem expected to fail with FailedPrecondition error, got: %v", err)
+		}
+	})
+
+	t.Run("should accept saved options of existing volume", func(t *testing.T) {
+		for _, options := range []map[string]string{
+			{},
+			{"readonly": "true"},
+			{"protocol": "nfs", "mountOptions": "noatime,nosuid", "owner": "1000:1000"},
+		} {
+			if err := d.Create(&volume.CreateRequest{Name: "vol", Options: options}); err != nil {
+				t.Errorf("Create() with options %+v expected to succeed, got: %s", options, err)
+			}
+		}
+		options := fake.getUserProperties("poolA/datasetA/vol")["com.nexenta.docker:options"]
+		if !strings.Contains(options, `"mountOptions":"noatime,nosuid"`) {
+			t.Errorf("saved options expected not to be changed, got: '%s'", options)
+		}
+	})
+
+	t.Run("should fail on invalid options", func(t *testing.T) {
+		for _, options := range []map[string]string{
+			{"size": "1X"},
+			{"allowShrink": "maybe"},
+			{"quota": "1G"},
+			{"protocol": "smb"},
+			{"readonly": "maybe"},
+			{"owner": "root"},
+		} {
+			err := d.Create(&volume.CreateRequest{Name: "invalid", Options: options})
+			if err == nil || !strings.HasPrefix(err.Error(), "InvalidArgument:") {
+				t.Errorf("Create() with options %+v expected to fail with InvalidArgument error, got: %v", options, err)
+			}
+		}
+		for _, path := range fake.getCreated() {
+			if path == "poolA/datasetA/invalid" {
+				t.Errorf("filesystem must not be created with invalid options")
+			}
+		}
+	})
+}
+
+// toStringMap converts map of any string type to map[string]string
+func toStringMap(value interface{}) map[string]string {
+	result := map[string]string{}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Map {
+		return nil
+	}
+	for _, key := range v.MapKeys() {
+		result[key.String()] = v.MapIndex(key).String()
+	}
+	return result
+}
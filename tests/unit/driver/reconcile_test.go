@@ -0,0 +1,188 @@
+package driver_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/driver"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/state"
+)
+
+// summaryHook - keeps fields of the reconciliation summary log entry
+type summaryHook struct {
+	mu     sync.Mutex
+	fields logrus.Fields
+}
+
+func (h *summaryHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *summaryHook) Fire(entry *logrus.Entry) error {
+	if entry.Data["func"] == "reconcile()" && strings.HasPrefix(entry.Message, "done:") {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.fields = logrus.Fields{}
+		for key, value := range entry.Data {
+			h.fields[key] = value
+		}
+	}
+	return nil
+}
+
+func (h *summaryHook) expect(t *testing.T, expected map[string]int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.fields == nil {
+		t.Fatal("reconciliation summary expected to be logged")
+	}
+	for key, value := range expected {
+		if h.fields[key] != value {
+			t.Errorf("reconciliation summary expected to have %s=%d, got: %v", key, value, h.fields)
+		}
+	}
+}
+
+func TestParseContainerBindMountPath(t *testing.T) {
+	root := "/mnt/nexentastor"
+	containerID := strings.Repeat("0f", 32)
+
+	valid := map[string][2]string{
+		"/mnt/nexentastor/bind/app/c1":                {"app", "c1"},
+		"/mnt/nexentastor/bind/app-db/" + containerID: {"app-db", containerID},
+		"/mnt/nexentastor/bind/app-" + containerID:    {"app", containerID},
+		"/mnt/nexentastor/bind/app-db-" + containerID: {"app-db", containerID},
+	}
+	for path, expected := range valid {
+		volumeName, id, ok := driver.ParseContainerBindMountPath(root, path)
+		if !ok || volumeName != expected[0] || id != expected[1] {
+			t.Errorf(
+				"ParseContainerBindMountPath('%s') expected to return '%s', '%s', got: '%s', '%s', %t",
+				path, expected[0], expected[1], volumeName, id, ok,
+			)
+		}
+	}
+
+	invalid := []string{
+		"/mnt/nexentastor/bind/app",
+		"/mnt/nexentastor/bind/app-c1",
+		"/mnt/nexentastor/bind/app-" + strings.ToUpper(containerID),
+		"/mnt/nexentastor/bind/app/c1/data",
+		"/mnt/nexentastor/volume/app",
+		"/mnt/other/bind/app/c1",
+	}
+	for _, path := range invalid {
+		if volumeName, id, ok := driver.ParseContainerBindMountPath(root, path); ok {
+			t.Errorf("ParseContainerBindMountPath('%s') expected to fail, got: '%s', '%s'", path, volumeName, id)
+		}
+	}
+}
+
+func TestDriver_Reconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounts, cleanup := setupFakeMounts(t, dir)
+	defer cleanup()
+
+	hook := &summaryHook{}
+	mounts.log.Logger.AddHook(hook)
+
+	server := httptest.NewTLSServer(newFakeNS("poolA/datasetA"))
+	defer server.Close()
+
+	// "app" is used by container c1, c2 bind is gone, c3 bind is missed in the state;
+	// "orphan" volume and its legacy bind are missed in the state, "gone" volume is not mounted anymore
+	legacyID := strings.Repeat("0f", 32)
+	options := []string{"vers=3", "timeo=100"}
+	mounts.mount(t, "20.1.1.1:/poolA/datasetA/app", filepath.Join(mounts.root, "volume/app"), options...)
+	mounts.mount(t, filepath.Join(mounts.root, "volume/app"), filepath.Join(mounts.root, "bind/app/c1"), "bind")
+	mounts.mount(t, filepath.Join(mounts.root, "volume/app"), filepath.Join(mounts.root, "bind/app/c3"), "bind")
+	mounts.mount(t, "20.1.1.1:/poolA/datasetA/orphan", filepath.Join(mounts.root, "volume/orphan"), options...)
+	mounts.mount(
+		t,
+		filepath.Join(mounts.root, "volume/orphan"),
+		filepath.Join(mounts.root, "bind/orphan-"+legacyID),
+		"bind",
+	)
+	if err := os.MkdirAll(filepath.Join(mounts.root, "bind/stale"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	mounts.saveVolume(t, "app", state.Volume{
+		Source:     "20.1.1.1:/poolA/datasetA/app",
+		Options:    options,
+		MountPoint: filepath.Join(mounts.root, "volume/app"),
+		MountedAt:  time.Now(),
+	}, map[string]string{
+		"c1": filepath.Join(mounts.root, "bind/app/c1"),
+		"c2": filepath.Join(mounts.root, "bind/app/c2"),
+	})
+	mounts.saveVolume(t, "gone", state.Volume{
+		Source:     "20.1.1.1:/poolA/datasetA/gone",
+		Options:    options,
+		MountPoint: filepath.Join(mounts.root, "volume/gone"),
+		MountedAt:  time.Now(),
+	}, nil)
+	allMounts := []string{"bind/app/c1", "bind/app/c3", "bind/orphan-" + legacyID, "volume/app", "volume/orphan"}
+
+	expectMounted := func(expected ...string) {
+		if paths := mounts.mounted(t); strings.Join(paths, " ") != strings.Join(expected, " ") {
+			t.Errorf("expected mounts: %v, got: %v", expected, paths)
+		}
+	}
+
+	t.Run("should only report actions in dry run mode", func(t *testing.T) {
+		mounts.newDriver(t, newTestConfig(t, dir, server.URL, "poolA/datasetA", "reconcileDryRun: true"))
+
+		hook.expect(t, map[string]int{
+			"removedRecords":   2,
+			"adoptedMounts":    0,
+			"unmountedBinds":   0,
+			"unmountedVolumes": 0,
+			"removedDirs":      0,
+			"failures":         0,
+			"dryRunSkipped":    4,
+		})
+		expectMounted(allMounts...)
+		if _, err := os.Stat(filepath.Join(mounts.root, "bind/stale")); err != nil {
+			t.Errorf("empty directory expected to be kept in dry run mode, got: %s", err)
+		}
+		volumes := mounts.readState(t)
+		if _, ok := volumes["gone"]; !ok || bindIDs(volumes, "app") != "c1,c2" {
+			t.Errorf("state file expected not to be changed in dry run mode, got: %+v", volumes)
+		}
+	})
+
+	t.Run("should clean up stale mounts and state records", func(t *testing.T) {
+		mounts.newDriver(t, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+
+		hook.expect(t, map[string]int{
+			"removedRecords":   2,
+			"adoptedMounts":    0,
+			"unmountedBinds":   2,
+			"unmountedVolumes": 1,
+			"removedDirs":      1,
+			"failures":         0,
+			"dryRunSkipped":    0,
+		})
+		expectMounted("bind/app/c1", "volume/app")
+		if _, err := os.Stat(filepath.Join(mounts.root, "bind/stale")); !os.IsNotExist(err) {
+			t.Errorf("empty directory expected to be removed, got: %v", err)
+		}
+		volumes := mounts.readState(t)
+		if _, ok := volumes["gone"]; ok || len(volumes) != 1 || bindIDs(volumes, "app") != "c1" {
+			t.Errorf("state expected to have only volume 'app' with bind 'c1', got: %+v", volumes)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package driver_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/audit"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/driver"
+)
+
+const gb = int64(1 << 30)
+
+func TestDriver_Resize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fake := newFakeNS("poolA/datasetA", "poolA/datasetA/existing", "legacy/data/fs")
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	cfg := newTestConfig(t, dir, server.URL, "poolA/datasetA", "adoptableRoots: legacy/data")
+	d := newTestDriver(t, dir, cfg)
+
+	create := func(name string, options map[string]string) error {
+		return d.Create(&volume.CreateRequest{Name: name, Options: options})
+	}
+
+	t.Run("should create filesystem with size", func(t *testing.T) {
+		if err := create("vol", map[string]string{"size": "10G"}); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+		if quota := fake.getQuota("poolA/datasetA/vol"); quota != 10*gb {
+			t.Errorf("created filesystem expected to have 10G quota, got: %d", quota)
+		}
+		res, err := d.Get(&volume.GetRequest{Name: "vol"})
+		if err != nil || res == nil || res.Volume.Status["size"] != "10G" {
+			t.Errorf("Get() expected to return volume status with 10G size, got: %+v, %v", res, err)
+		}
+	})
+
+	t.Run("should grow existing volume", func(t *testing.T) {
+		if err := create("vol", map[string]string{"size": "50G"}); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+		if quota := fake.getQuota("poolA/datasetA/vol"); quota != 50*gb {
+			t.Errorf("volume expected to have 50G quota, got: %d", quota)
+		}
+	})
+
+	t.Run("should not limit unlimited volume w/o allowShrink option", func(t *testing.T) {
+		err := create("existing", map[string]string{"size": "50G"})
+		if err == nil || !strings.HasPrefix(err.Error(), "FailedPrecondition:") {
+			t.Errorf("Create() expected to fail with FailedPrecondition error, got: %v", err)
+		}
+		if quota := fake.getQuota("poolA/datasetA/existing"); quota != 0 {
+			t.Errorf("volume expected to stay unlimited, got: %d", quota)
+		}
+
+		if err := create("existing", map[string]string{"size": "50G", "allowShrink": "true"}); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+		if quota := fake.getQuota("poolA/datasetA/existing"); quota != 50*gb {
+			t.Errorf("volume expected to have 50G quota, got: %d", quota)
+		}
+	})
+
+	t.Run("should not shrink volume w/o allowShrink option", func(t *testing.T) {
+		err := create("vol", map[string]string{"size": "20G"})
+		if err == nil || !strings.HasPrefix(err.Error(), "FailedPrecondition:") {
+			t.Errorf("Create() expected to fail with FailedPrecondition error, got: %v", err)
+		}
+		if quota := fake.getQuota("poolA/datasetA/vol"); quota != 50*gb {
+			t.Errorf("volume expected to keep 50G quota, got: %d", quota)
+		}
+	})
+
+	t.Run("should not shrink volume below used space", func(t *testing.T) {
+		fake.setUsed("poolA/datasetA/vol", 30*gb)
+		err := create("vol", map[string]string{"size": "20G", "allowShrink": "true"})
+		if err == nil || !strings.HasPrefix(err.Error(), "FailedPrecondition:") {
+			t.Errorf("Create() expected to fail with FailedPrecondition error, got: %v", err)
+		}
+		if quota := fake.getQuota("poolA/datasetA/vol"); quota != 50*gb {
+			t.Errorf("volume expected to keep 50G quota, got: %d", quota)
+		}
+	})
+
+	t.Run("should shrink volume with allowShrink option", func(t *testing.T) {
+		if err := create("vol", map[string]string{"size": "40G", "allowShrink": "true"}); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+		if quota := fake.getQuota("poolA/datasetA/vol"); quota != 40*gb {
+			t.Errorf("volume expected to have 40G quota, got: %d", quota)
+		}
+	})
+
+	t.Run("should resize adopted filesystem of an alias", func(t *testing.T) {
+		options := map[string]string{"adopt": "legacy/data/fs", "size": "5G", "allowShrink": "true"}
+		if err := create("legacy", options); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+		if err := create("legacy", map[string]string{"size": "6G"}); err != nil {
+			t.Fatalf("Create(): %s", err)
+		}
+		if quota := fake.getQuota("legacy/data/fs"); quota != 6*gb {
+			t.Errorf("adopted filesystem expected to have 6G quota, got: %d", quota)
+		}
+	})
+
+	t.Run("should resize volume by admin command", func(t *testing.T) {
+		auditLogFile := filepath.Join(dir, "audit.log")
+		auditLog, err := audit.New(auditLogFile)
+		if err != nil {
+			t.Fatalf("cannot create audit log: %s", err)
+		}
+		defer auditLog.Close()
+
+		resize := func(name string, size int64, allowShrink bool) error {
+			return driver.ResizeVolume(driver.ResizeArgs{
+				Config:      cfg,
+				Log:         newTestLog(),
+				Audit:       auditLog,
+				Volume:      name,
+				Size:        size,
+				AllowShrink: allowShrink,
+			})
+		}
+
+		if err := resize("vol", 35*gb, false); err == nil || !strings.Contains(err.Error(), "FailedPrecondition:") {
+			t.Errorf("ResizeVolume() expected to fail with FailedPrecondition error, got: %v", err)
+		}
+		if err := resize("vol", 35*gb, true); err != nil {
+			t.Errorf("ResizeVolume(): %s", err)
+		}
+		if quota := fake.getQuota("poolA/datasetA/vol"); quota != 35*gb {
+			t.Errorf("volume expected to have 35G quota, got: %d", quota)
+		}
+		if err := resize("missing", gb, false); err == nil || !strings.Contains(err.Error(), "NotFound:") {
+			t.Errorf("ResizeVolume() expected to fail with NotFound error, got: %v", err)
+		}
+
+		content, err := ioutil.ReadFile(auditLogFile)
+		if err != nil {
+			t.Fatalf("cannot read audit log: %s", err)
+		}
+		outcomes := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			event := audit.Event{}
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				t.Fatalf("audit log line is not valid JSON: '%s': %s", line, err)
+			}
+			if event.Action != audit.ActionResize || event.RequestID == "" {
+				t.Errorf("audit log expected to have Resize events with request ID, got: %+v", event)
+			}
+			outcomes = append(outcomes, event.Volume+":"+event.Outcome)
+		}
+		expected := "vol:failure vol:success missing:failure"
+		if strings.Join(outcomes, " ") != expected {
+			t.Errorf("audit log expected to have events '%s', got: %v", expected, outcomes)
+		}
+	})
+}
+
+func TestParseSize(t *testing.T) {
+	valid := map[string]int64{
+		"1073741824": gb,
+		"512M":       512 << 20,
+		"50g":        50 * gb,
+		"1.5T":       3 * gb << 9,
+		"2GiB":       2 * gb,
+		"2 GB":       2 * gb,
+	}
+	for value, expected := range valid {
+		if size, err := driver.ParseSize(value); err != nil || size != expected {
+			t.Errorf("ParseSize('%s') expected to return %d, got: %d, %v", value, expected, size, err)
+		}
+	}
+
+	for _, value := range []string{"", "0", "-1G", "1X", "G", "1.2.3G"} {
+		if size, err := driver.ParseSize(value); err == nil {
+			t.Errorf("ParseSize('%s') expected to fail, got: %d", value, size)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package driver_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// newDeadNS returns NS which drops all connections, count of received requests is stored to hits
+func newDeadNS(hits *int32) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+	}))
+}
+
+// newHungNS returns NS which doesn't respond until the release channel is closed
+func newHungNS(release chan struct{}) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+}
+
+func TestDriver_Resolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("should not wait for hung node if another node has the filesystem", func(t *testing.T) {
+		release := make(chan struct{})
+		hung := newHungNS(release)
+		defer hung.Close()
+		defer close(release)
+
+		fake := newFakeNS("poolA/datasetA", "poolA/datasetA/vol")
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, hung.URL+","+server.URL, "poolA/datasetA"))
+
+		startTime := time.Now()
+		res, err := d.Get(&volume.GetRequest{Name: "vol"})
+		if err != nil || res == nil {
+			t.Fatalf("Get() expected to find volume 'vol', got: %+v, %v", res, err)
+		}
+		if duration := time.Since(startTime); duration > 5*time.Second {
+			t.Errorf("Get() expected to return w/o waiting for hung node, returned in %s", duration)
+		}
+	})
+
+	t.Run("should cache node which owns the path", func(t *testing.T) {
+		other := newFakeNS("poolA/datasetA")
+		otherServer := httptest.NewTLSServer(other)
+		defer otherServer.Close()
+
+		owner := newFakeNS("poolA/datasetA", "poolA/datasetA/vol")
+		ownerServer := httptest.NewTLSServer(owner)
+		defer ownerServer.Close()
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, otherServer.URL+","+ownerServer.URL, "poolA/datasetA"))
+
+		for i := 0; i < 3; i++ {
+			if res, err := d.Get(&volume.GetRequest{Name: "vol"}); err != nil || res == nil {
+				t.Fatalf("Get() expected to find volume 'vol', got: %+v, %v", res, err)
+			}
+		}
+
+		if count := other.getCount("poolA/datasetA/vol"); count != 1 {
+			t.Errorf("node w/o the filesystem expected to be probed once, got: %d", count)
+		}
+	})
+
+	t.Run("should skip node which keeps failing", func(t *testing.T) {
+		var hits int32
+		dead := newDeadNS(&hits)
+		defer dead.Close()
+
+		fake := newFakeNS("poolA/datasetA")
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, dead.URL+","+server.URL, "poolA/datasetA"))
+
+		// not existing volumes are not cached, all nodes are probed each time
+		for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+			res, err := d.Get(&volume.GetRequest{Name: name})
+			if err != nil || res != nil {
+				t.Fatalf("Get() expected to return empty response for not existing volume, got: %+v, %v", res, err)
+			}
+		}
+
+		// Get of not existing volume resolves the volume path and then plugin's dataset to read volume aliases,
+		// the dataset probe of the failing node may be still in flight when the request is finished,
+		// so the failure is not counted
+		if count := atomic.LoadInt32(&hits); count < 3 || count > 4 {
+			t.Errorf("failing node expected to be probed 3 times before it's skipped, got: %d", count)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package driver_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestDriver_Retry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("should retry request while pool is busy", func(t *testing.T) {
+		fake := newFakeNS("poolA/datasetA")
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+
+		fake.setBusy(1)
+		if err := d.Create(&volume.CreateRequest{Name: "vol"}); err != nil {
+			t.Fatalf("Create() expected to succeed after failover, got: %s", err)
+		}
+		if created := fake.getCreated(); len(created) != 1 || created[0] != "poolA/datasetA/vol" {
+			t.Errorf("filesystem 'poolA/datasetA/vol' expected to be created once, got: %v", created)
+		}
+	})
+
+	t.Run("should retry request failed with HTTP 5xx response", func(t *testing.T) {
+		fake := newFakeNS("poolA/datasetA", "poolA/datasetA/vol")
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+
+		fake.setUnavailable(2)
+		if res, err := d.List(); err != nil || !hasVolume(res.Volumes, "vol") {
+			t.Fatalf("List() expected to return volume 'vol' after retries, got: %+v, %v", res, err)
+		}
+	})
+
+	t.Run("should delete share and filesystem if ACL cannot be set", func(t *testing.T) {
+		fake := newFakeNS("poolA/datasetA")
+		fake.aclFails = true
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+
+		err := d.Create(&volume.CreateRequest{Name: "vol"})
+		if err == nil || !strings.Contains(err.Error(), "ACL") {
+			t.Fatalf("Create() expected to fail with ACL error, got: %v", err)
+		}
+		if destroyed := fake.getDestroyed(); len(destroyed) != 1 || destroyed[0] != "poolA/datasetA/vol" {
+			t.Errorf("created filesystem 'poolA/datasetA/vol' expected to be destroyed, got: %v", destroyed)
+		}
+	})
+
+	t.Run("should retry request on the node which owns the pool after failover", func(t *testing.T) {
+		var hits int32
+		dead := newDeadNS(&hits)
+		defer dead.Close()
+
+		fake := newFakeNS("poolA/datasetA", "poolA/datasetA/vol")
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, dead.URL+","+server.URL, "poolA/datasetA"))
+
+		// pool is being imported on the new owner, it isn't available on any node yet
+		fake.setBusy(2)
+		res, err := d.Get(&volume.GetRequest{Name: "vol"})
+		if err != nil || res == nil {
+			t.Fatalf("Get() expected to find volume 'vol' after failover, got: %+v, %v", res, err)
+		}
+		// Get resolves the volume path, the last probe of the failed node may be still in flight
+		// when the volume path is resolved
+		if count := atomic.LoadInt32(&hits); count > 4 {
+			t.Errorf("failed node expected to be skipped after 3 failures, got %d request(s)", count)
+		}
+	})
+
+	t.Run("should not retry request of not existing volume", func(t *testing.T) {
+		fake := newFakeNS("poolA/datasetA")
+		server := httptest.NewTLSServer(fake)
+		defer server.Close()
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, server.URL, "poolA/datasetA"))
+
+		res, err := d.Get(&volume.GetRequest{Name: "not-existing"})
+		if err != nil || res != nil {
+			t.Fatalf("Get() expected to return empty response, got: %+v, %v", res, err)
+		}
+		if count := fake.getCount("poolA/datasetA/not-existing"); count != 1 {
+			t.Errorf("not existing filesystem expected to be requested once, got: %d", count)
+		}
+	})
+}
+
+func TestDriver_Deadline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("should return DeadlineExceeded error if NS doesn't respond in requestTimeout", func(t *testing.T) {
+		release := make(chan struct{})
+		hung := newHungNS(release)
+		defer hung.Close()
+		defer close(release)
+
+		d := newTestDriver(t, dir, newTestConfig(t, dir, hung.URL, "poolA/datasetA", "requestTimeout: 1"))
+
+		startTime := time.Now()
+		err := d.Create(&volume.CreateRequest{Name: "vol"})
+		if err == nil || !strings.HasPrefix(err.Error(), "DeadlineExceeded: Request is not finished in 1s") {
+			t.Fatalf("DeadlineExceeded error expected, got: %v", err)
+		}
+		if duration := time.Since(startTime); duration > 5*time.Second {
+			t.Errorf("Create() expected to return in about 1s, returned in %s", duration)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package logger_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/logger"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logger-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.log")
+	ioutil.WriteFile(path, []byte("old content\n"), 0644)
+
+	f, err := logger.NewRotatingFile(path)
+	if err != nil {
+		t.Fatalf("cannot create rotating file: %s", err)
+	}
+	defer f.Close()
+
+	t.Run("should append to existing file", func(t *testing.T) {
+		f.Write([]byte("new\n"))
+		content, _ := ioutil.ReadFile(path)
+		if string(content) != "old content\nnew\n" {
+			t.Fatalf("file should contain old and new content, got: '%s'", content)
+		}
+	})
+
+	t.Run("should rotate file by size and keep limited count of old files", func(t *testing.T) {
+		f.SetLimits(20, 2)
+		for i := 0; i < 10; i++ {
+			f.Write([]byte(fmt.Sprintf("line %02d ......\n", i))) // 16 bytes
+		}
+
+		files, _ := filepath.Glob(path + "*")
+		if len(files) != 3 {
+			t.Fatalf("should be 3 files (current and 2 rotated), got: %v", files)
+		}
+
+		content, _ := ioutil.ReadFile(path)
+		if string(content) != "line 09 ......\n" {
+			t.Fatalf("current file should contain the last line only, got: '%s'", content)
+		}
+		content, _ = ioutil.ReadFile(path + ".2")
+		if string(content) != "line 07 ......\n" {
+			t.Fatalf("the oldest rotated file should contain the line 07, got: '%s'", content)
+		}
+	})
+
+	t.Run("should keep writing to the current file if it cannot be rotated", func(t *testing.T) {
+		// rotated file cannot be replaced by the current one or removed while it's a non-empty directory
+		os.Remove(path + ".1")
+		os.Remove(path + ".2")
+		if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		f.SetLimits(20, 1)
+		for i := 10; i < 13; i++ {
+			line := fmt.Sprintf("line %02d ......\n", i)
+			if n, err := f.Write([]byte(line)); n != len(line) || err != nil {
+				t.Fatalf("write should not fail, got: %d, %v", n, err)
+			}
+		}
+
+		content, _ := ioutil.ReadFile(path)
+		if string(content) != "line 09 ......\nline 10 ......\nline 11 ......\nline 12 ......\n" {
+			t.Fatalf("current file should keep all lines, got: '%s'", content)
+		}
+
+		os.RemoveAll(path + ".1")
+		f.Write([]byte("line 13 ......\n"))
+		content, _ = ioutil.ReadFile(path)
+		if string(content) != "line 13 ......\n" {
+			t.Fatalf("file should be rotated again when it's possible, got: '%s'", content)
+		}
+	})
+}
+
+func TestLogger_Configure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logger-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lg := logger.New(logrus.Fields{"cmp": "Main"}, filepath.Join(dir, "test.log"))
+	var buf bytes.Buffer
+	lg.Entry().Logger.SetOutput(&buf)
+
+	t.Run("should filter entries by component level", func(t *testing.T) {
+		lg.Configure(&config.Config{
+			LogFormat: config.LogFormatText,
+			LogLevels: map[string]string{"RestClient": "debug", "Mounter": "warn"},
+		})
+
+		lg.Entry().WithField("cmp", "RestClient").Debug("rest-debug")
+		lg.Entry().WithField("cmp", "Driver").Debug("driver-debug")
+		lg.Entry().WithField("cmp", "Driver").Info("driver-info")
+		lg.Entry().WithField("cmp", "Mounter").Info("mounter-info")
+
+		output := buf.String()
+		for _, message := range []string{"rest-debug", "driver-info"} {
+			if !strings.Contains(output, message) {
+				t.Errorf("log should contain '%s', got: %s", message, output)
+			}
+		}
+		for _, message := range []string{"driver-debug", "mounter-info"} {
+			if strings.Contains(output, message) {
+				t.Errorf("log should not contain '%s', got: %s", message, output)
+			}
+		}
+	})
+
+	t.Run("should write JSON lines", func(t *testing.T) {
+		buf.Reset()
+		lg.Configure(&config.Config{LogFormat: config.LogFormatJSON})
+
+		lg.Entry().WithField("cmp", "Driver").Info("json-info")
+
+		if !strings.HasPrefix(buf.String(), "{") || !strings.Contains(buf.String(), `"msg":"json-info"`) {
+			t.Errorf("log should contain JSON line, got: %s", buf.String())
+		}
+	})
+}
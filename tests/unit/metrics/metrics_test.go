@@ -0,0 +1,78 @@
+package metrics_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Nexenta/go-nexentastor/pkg/ns"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/metrics"
+)
+
+func testContains(t *testing.T, output, expected string) {
+	if !strings.Contains(output, expected) {
+		t.Errorf("output should contain '%s', but got:\n%s", expected, output)
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := metrics.NewCounterVec("test_total", "Test counter.", "method", "status")
+	c.Inc("Mount", "ok")
+	c.Inc("Mount", "ok")
+	c.Inc("Mount", "error")
+
+	var buf bytes.Buffer
+	c.Write(&buf)
+	output := buf.String()
+
+	testContains(t, output, "# TYPE test_total counter\n")
+	testContains(t, output, `test_total{method="Mount",status="ok"} 2`+"\n")
+	testContains(t, output, `test_total{method="Mount",status="error"} 1`+"\n")
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := metrics.NewHistogramVec("test_seconds", "Test histogram.", "node")
+	h.Observe(0.02, "ns1")
+	h.Observe(3, "ns1")
+
+	var buf bytes.Buffer
+	h.Write(&buf)
+	output := buf.String()
+
+	testContains(t, output, "# TYPE test_seconds histogram\n")
+	testContains(t, output, `test_seconds_bucket{node="ns1",le="0.01"} 0`+"\n")
+	testContains(t, output, `test_seconds_bucket{node="ns1",le="0.05"} 1`+"\n")
+	testContains(t, output, `test_seconds_bucket{node="ns1",le="5"} 2`+"\n")
+	testContains(t, output, `test_seconds_bucket{node="ns1",le="+Inf"} 2`+"\n")
+	testContains(t, output, `test_seconds_sum{node="ns1"} 3.02`+"\n")
+	testContains(t, output, `test_seconds_count{node="ns1"} 2`+"\n")
+}
+
+func TestGaugeFunc(t *testing.T) {
+	g := metrics.NewGaugeFunc("test_mounts", "Test gauge.", "volume")
+	g.SetCollectFunc(func() map[string]float64 {
+		return map[string]float64{metrics.Join(`a"b`): 3}
+	})
+
+	var buf bytes.Buffer
+	g.Write(&buf)
+
+	testContains(t, buf.String(), `test_mounts{volume="a\"b"} 3`+"\n")
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := map[string]error{
+		"InvalidArgument": fmt.Errorf("InvalidArgument: req.Name must be provided"),
+		"ENOENT":          &ns.NefError{Code: "ENOENT", Err: fmt.Errorf("not found")},
+		"EBUSY":           fmt.Errorf("InternalError: Cannot create filesystem: request error [code: EBUSY]"),
+		"Unknown":         fmt.Errorf("something went wrong"),
+	}
+
+	for expected, err := range tests {
+		if code := metrics.ErrorCode(err); code != expected {
+			t.Errorf("ErrorCode('%s') should return '%s', but got '%s'", err, expected, code)
+		}
+	}
+}
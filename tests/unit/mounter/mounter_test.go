@@ -0,0 +1,193 @@
+package mounter_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/mounter"
+)
+
+const testTimeout = 200 * time.Millisecond
+
+// fake mount/umount commands write their arguments to the log file,
+// "sleep" is started as a child process to check that the whole process group is killed
+const fakeCommandTemplate = `#!/bin/sh
+echo "$(basename $0) $*" >> %s
+%s
+`
+
+func writeFakeCommand(t *testing.T, binDir, name, body string) {
+	path := filepath.Join(binDir, name)
+	content := fmt.Sprintf(fakeCommandTemplate, filepath.Join(binDir, "calls.log"), body)
+	if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatalf("cannot write fake command '%s': %s", path, err)
+	}
+}
+
+func readCalls(t *testing.T, binDir string) []string {
+	content, err := ioutil.ReadFile(filepath.Join(binDir, "calls.log"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+// setup creates a directory with fake commands, puts it first in PATH and returns a cleanup function
+func setup(t *testing.T) (binDir, targetPath string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "mounter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binDir = filepath.Join(dir, "bin")
+	targetPath = filepath.Join(dir, "target")
+	for _, path := range []string{binDir, targetPath} {
+		if err := os.Mkdir(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+":"+path)
+
+	return binDir, targetPath, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestMounter() *mounter.Mounter {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	return mounter.New(logrus.NewEntry(logger)).WithTimeouts(testTimeout, testTimeout)
+}
+
+func testCalls(t *testing.T, binDir string, expected []string) {
+	calls := readCalls(t, binDir)
+	if strings.Join(calls, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("expected calls: %v, got: %v", expected, calls)
+	}
+}
+
+func TestMounter_Mount(t *testing.T) {
+	t.Run("should kill hung mount command and detach target path", func(t *testing.T) {
+		binDir, targetPath, cleanup := setup(t)
+		defer cleanup()
+
+		writeFakeCommand(t, binDir, "mount", "sleep 10")
+		writeFakeCommand(t, binDir, "umount", "exit 0")
+
+		startTime := time.Now()
+		err := newTestMounter().Mount("10.1.1.1:/pool/fs", targetPath, "nfs", []string{"vers=3"})
+		if err == nil || !strings.HasPrefix(err.Error(), "DeadlineExceeded:") {
+			t.Fatalf("DeadlineExceeded error expected, got: %v", err)
+		}
+		if duration := time.Since(startTime); duration > 5*time.Second {
+			t.Errorf("Mount() expected to return in about %s, returned in %s", testTimeout, duration)
+		}
+
+		testCalls(t, binDir, []string{
+			"mount -t nfs -o vers=3 10.1.1.1:/pool/fs " + targetPath,
+			"umount -l " + targetPath,
+		})
+	})
+
+	t.Run("should kill mount command when context is done", func(t *testing.T) {
+		binDir, targetPath, cleanup := setup(t)
+		defer cleanup()
+
+		writeFakeCommand(t, binDir, "mount", "sleep 10")
+		writeFakeCommand(t, binDir, "umount", "exit 0")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(testTimeout/4, cancel)
+
+		m := newTestMounter().WithTimeouts(time.Minute, time.Minute).WithContext(ctx)
+		err := m.Mount("10.1.1.1:/pool/fs", targetPath, "nfs", nil)
+		if err == nil || !strings.HasPrefix(err.Error(), "Canceled:") {
+			t.Fatalf("Canceled error expected, got: %v", err)
+		}
+
+		testCalls(t, binDir, []string{
+			"mount -t nfs 10.1.1.1:/pool/fs " + targetPath,
+			"umount -l " + targetPath,
+		})
+	})
+
+	t.Run("should return mount command output on failure", func(t *testing.T) {
+		binDir, targetPath, cleanup := setup(t)
+		defer cleanup()
+
+		writeFakeCommand(t, binDir, "mount", "echo 'access denied by server'; exit 32")
+
+		err := newTestMounter().Mount("10.1.1.1:/pool/fs", targetPath, "nfs", nil)
+		if err == nil || !strings.HasPrefix(err.Error(), "InternalError:") {
+			t.Fatalf("InternalError error expected, got: %v", err)
+		}
+		if !strings.Contains(err.Error(), "access denied by server") {
+			t.Errorf("error expected to contain command output, got: %s", err)
+		}
+	})
+}
+
+func TestMounter_Unmount(t *testing.T) {
+	t.Run("should fall back to lazy unmount if umount hangs", func(t *testing.T) {
+		binDir, targetPath, cleanup := setup(t)
+		defer cleanup()
+
+		writeFakeCommand(t, binDir, "umount", `
+case "$1" in
+	-f) sleep 10 ;;
+	-l) exit 0 ;;
+	*) sleep 10 ;;
+esac`)
+
+		if err := newTestMounter().Unmount(targetPath); err != nil {
+			t.Fatalf("Unmount() expected to succeed with lazy unmount, got: %s", err)
+		}
+
+		testCalls(t, binDir, []string{
+			"umount " + targetPath,
+			"umount -f " + targetPath,
+			"umount -l " + targetPath,
+		})
+
+		if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+			t.Errorf("target path '%s' expected to be removed, got: %v", targetPath, err)
+		}
+	})
+
+	t.Run("should return DeadlineExceeded error if all unmount attempts fail", func(t *testing.T) {
+		binDir, targetPath, cleanup := setup(t)
+		defer cleanup()
+
+		writeFakeCommand(t, binDir, "umount", `[ "$1" = "-l" ] && exit 32; sleep 10`)
+
+		err := newTestMounter().Unmount(targetPath)
+		if err == nil || !strings.HasPrefix(err.Error(), "DeadlineExceeded:") {
+			t.Fatalf("DeadlineExceeded error expected, got: %v", err)
+		}
+	})
+
+	t.Run("should not retry failed umount command", func(t *testing.T) {
+		binDir, targetPath, cleanup := setup(t)
+		defer cleanup()
+
+		writeFakeCommand(t, binDir, "umount", "echo 'target is busy'; exit 32")
+
+		err := newTestMounter().Unmount(targetPath)
+		if err == nil || !strings.Contains(err.Error(), "target is busy") {
+			t.Fatalf("InternalError error with command output expected, got: %v", err)
+		}
+
+		testCalls(t, binDir, []string{"umount " + targetPath})
+	})
+}
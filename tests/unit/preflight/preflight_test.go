@@ -0,0 +1,173 @@
+package preflight_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/config"
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/preflight"
+)
+
+// fakeNS - minimal NexentaStor REST API for preflight checks
+type fakeNS struct {
+	dataset      string
+	licenseValid bool
+	cluster      string
+}
+
+func (f *fakeNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path := strings.TrimLeft(r.URL.Path, "/"); {
+	case r.Method == http.MethodPost && path == "auth/login":
+		writeJSON(w, http.StatusOK, map[string]string{"token": "token"})
+	case r.Method == http.MethodGet && path == "settings/license":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"valid": f.licenseValid, "expires": "2030-01-01"})
+	case r.Method == http.MethodGet && path == "storage/filesystems":
+		data := []map[string]string{}
+		if r.URL.Query().Get("path") == f.dataset {
+			data = append(data, map[string]string{"path": f.dataset, "mountPoint": "/" + f.dataset})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+	case r.Method == http.MethodGet && path == "rsf/clusters":
+		data := []map[string]string{}
+		if f.cluster != "" {
+			data = append(data, map[string]string{"clusterName": f.cluster})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": data})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "not found", "code": "ENOENT"})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// newNfsListener listens on a local port instead of NFS server, returns the port
+func newNfsListener(t *testing.T) (net.Listener, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return listener, port
+}
+
+// closedPort returns a local port nobody listens on
+func closedPort(t *testing.T) string {
+	listener, port := newNfsListener(t)
+	listener.Close()
+	return port
+}
+
+// closedAddress returns REST API URL of a local port nobody listens on
+func closedAddress(t *testing.T) string {
+	return "https://127.0.0.1:" + closedPort(t)
+}
+
+func newTestConfig(t *testing.T, dir, address string) *config.Config {
+	path := filepath.Join(dir, "config.yaml")
+	content := fmt.Sprintf(
+		"restIp: %s\nusername: usr\npassword: pwd\ndefaultDataset: poolA/datasetA\ndefaultDataIp: 127.0.0.1\n",
+		address,
+	)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.New(path)
+	if err != nil {
+		t.Fatalf("cannot read config file '%s': %s", path, err)
+	}
+	return cfg
+}
+
+func runPreflight(t *testing.T, cfg *config.Config, nfsPort string) (*preflight.Report, string) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	report := preflight.Run(preflight.Args{Config: cfg, Log: logrus.NewEntry(logger), NfsPort: nfsPort})
+
+	var output bytes.Buffer
+	report.Print(&output)
+	return report, output.String()
+}
+
+func TestPreflight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preflight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, nfsPort := newNfsListener(t)
+	defer listener.Close()
+
+	t.Run("should pass all checks", func(t *testing.T) {
+		nodeA := httptest.NewTLSServer(&fakeNS{dataset: "poolA/datasetA", licenseValid: true, cluster: "c1"})
+		defer nodeA.Close()
+		nodeB := httptest.NewTLSServer(&fakeNS{licenseValid: true, cluster: "c1"})
+		defer nodeB.Close()
+
+		report, output := runPreflight(t, newTestConfig(t, dir, nodeA.URL+","+nodeB.URL), nfsPort)
+		if report.Failed() || report.ExitCode() != 0 {
+			t.Errorf("all checks expected to pass, got:\n%s", output)
+		}
+		if len(report.Checks) != 7 || !strings.Contains(output, "Result: OK (7 checks passed)") {
+			t.Errorf("report expected to have 7 passed checks, got:\n%s", output)
+		}
+	})
+
+	t.Run("should fail on invalid license, missing dataset and closed NFS port", func(t *testing.T) {
+		node := httptest.NewTLSServer(&fakeNS{dataset: "poolA/other", licenseValid: false})
+		defer node.Close()
+
+		report, output := runPreflight(t, newTestConfig(t, dir, node.URL), closedPort(t))
+		if !report.Failed() || report.ExitCode() != 1 {
+			t.Errorf("checks expected to fail, got:\n%s", output)
+		}
+		for _, name := range []string{"license on", "default dataset 'poolA/datasetA'", "NFS on default data IP"} {
+			if !strings.Contains(output, "[FAIL] "+name) {
+				t.Errorf("'%s' check expected to fail, got:\n%s", name, output)
+			}
+		}
+		if !strings.Contains(output, "Result: FAILED (3 of 5 checks failed)") {
+			t.Errorf("report expected to have 3 failed checks, got:\n%s", output)
+		}
+	})
+
+	t.Run("should fail on unreachable node", func(t *testing.T) {
+		node := httptest.NewTLSServer(&fakeNS{dataset: "poolA/datasetA", licenseValid: true, cluster: "c1"})
+		defer node.Close()
+		unreachable := closedAddress(t)
+
+		report, output := runPreflight(t, newTestConfig(t, dir, node.URL+","+unreachable), nfsPort)
+		if !report.Failed() || report.ExitCode() != 1 {
+			t.Errorf("checks expected to fail, got:\n%s", output)
+		}
+		if !strings.Contains(output, "[FAIL] login to "+unreachable) {
+			t.Errorf("login to unreachable node expected to fail, got:\n%s", output)
+		}
+		if !strings.Contains(output, "[PASS] login to "+node.URL) {
+			t.Errorf("login to available node expected to pass, got:\n%s", output)
+		}
+	})
+
+	t.Run("should stop if no node is reachable", func(t *testing.T) {
+		report, output := runPreflight(t, newTestConfig(t, dir, closedAddress(t)), nfsPort)
+		if report.ExitCode() != 1 || len(report.Checks) != 1 {
+			t.Errorf("only failed login check expected, got:\n%s", output)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Nexenta/nexentastor-docker-volume-plugin/pkg/state"
+)
+
+func newLog() *logrus.Entry {
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+	return l.WithField("test", "state")
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+
+	s, err := state.New(path, newLog())
+	if err != nil {
+		t.Fatalf("cannot create state for not existing file: %s", err)
+	}
+
+	t.Run("volume and binds are saved", func(t *testing.T) {
+		err := s.SetVolume("vol1", state.Volume{
+			Source:     "10.3.3.4:/pool/ds/vol1",
+			Options:    []string{"vers=3", "timeo=100"},
+			Node:       "https://10.3.3.4:8443",
+			MountPoint: "/mnt/volume/vol1",
+			MountedAt:  time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("cannot set volume: %s", err)
+		}
+		for _, id := range []string{"c1", "c2"} {
+			if err := s.AddBind("vol1", id, state.Bind{Path: "/mnt/bind/vol1-" + id}); err != nil {
+				t.Fatalf("cannot add bind: %s", err)
+			}
+		}
+		if err := s.AddBind("vol2", "c1", state.Bind{}); err == nil {
+			t.Error("bind of a volume which is not in state should fail")
+		}
+
+		reloaded, err := state.New(path, newLog())
+		if err != nil {
+			t.Fatalf("cannot reload state: %s", err)
+		}
+		volume, ok := reloaded.GetVolume("vol1")
+		if !ok {
+			t.Fatal("volume is not found in reloaded state")
+		}
+		if volume.Source != "10.3.3.4:/pool/ds/vol1" || len(volume.Options) != 2 || len(volume.Binds) != 2 {
+			t.Errorf("unexpected reloaded volume: %+v", volume)
+		}
+	})
+
+	t.Run("SetVolume keeps binds", func(t *testing.T) {
+		if err := s.SetVolume("vol1", state.Volume{Source: "10.3.3.5:/pool/ds/vol1"}); err != nil {
+			t.Fatalf("cannot set volume: %s", err)
+		}
+		if volume, _ := s.GetVolume("vol1"); len(volume.Binds) != 2 {
+			t.Errorf("binds are lost: %+v", volume)
+		}
+	})
+
+	t.Run("returned volume is a copy", func(t *testing.T) {
+		volume, _ := s.GetVolume("vol1")
+		delete(volume.Binds, "c1")
+		if volume, _ := s.GetVolume("vol1"); len(volume.Binds) != 2 {
+			t.Errorf("state is changed through returned value: %+v", volume)
+		}
+	})
+
+	t.Run("RemoveBind returns binds left", func(t *testing.T) {
+		if left, err := s.RemoveBind("vol1", "c1"); err != nil || left != 1 {
+			t.Errorf("expected 1 bind left, got: %d, %v", left, err)
+		}
+		if left, err := s.RemoveBind("vol1", "c1"); err != nil || left != 1 {
+			t.Errorf("removal of unknown bind should not change count, got: %d, %v", left, err)
+		}
+		if left, err := s.RemoveBind("vol1", "c2"); err != nil || left != 0 {
+			t.Errorf("expected 0 binds left, got: %d, %v", left, err)
+		}
+		if left, err := s.RemoveBind("unknown", "c2"); err != nil || left != 0 {
+			t.Errorf("expected 0 binds for unknown volume, got: %d, %v", left, err)
+		}
+	})
+
+	t.Run("RemoveVolume", func(t *testing.T) {
+		if err := s.RemoveVolume("vol1"); err != nil {
+			t.Fatalf("cannot remove volume: %s", err)
+		}
+		reloaded, err := state.New(path, newLog())
+		if err != nil {
+			t.Fatalf("cannot reload state: %s", err)
+		}
+		if volumes := reloaded.Volumes(); len(volumes) != 0 {
+			t.Errorf("expected empty state, got: %+v", volumes)
+		}
+	})
+
+	t.Run("no temp files left", func(t *testing.T) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Errorf("expected only state file in '%s', got %d files", dir, len(files))
+		}
+	})
+
+	t.Run("broken file is moved aside", func(t *testing.T) {
+		if err := ioutil.WriteFile(path, []byte(`{"version":1,"volumes":{`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		broken, err := state.New(path, newLog())
+		if err != nil {
+			t.Fatalf("broken state file should not fail: %s", err)
+		}
+		if volumes := broken.Volumes(); len(volumes) != 0 {
+			t.Errorf("expected empty state, got: %+v", volumes)
+		}
+		if _, err := os.Stat(path + ".broken"); err != nil {
+			t.Errorf("broken state file is not moved: %s", err)
+		}
+	})
+}